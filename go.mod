@@ -6,10 +6,12 @@ require (
 	github.com/google/uuid v1.6.0
 	github.com/ncruces/go-sqlite3 v0.26.2
 	github.com/tiredkangaroo/websocket v0.0.0-20250331164906-3c827d2ce87b
+	golang.org/x/net v0.40.0
 )
 
 require (
 	github.com/ncruces/julianday v1.0.0 // indirect
 	github.com/tetratelabs/wazero v1.9.0 // indirect
 	golang.org/x/sys v0.33.0 // indirect
+	golang.org/x/text v0.26.0 // indirect
 )
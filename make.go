@@ -9,6 +9,8 @@ import (
 	"path"
 	"runtime"
 	"time"
+
+	"github.com/tiredkangaroo/cap/proxy/ca"
 )
 
 type Command int
@@ -87,7 +89,15 @@ func genCA() {
 		slog.Error("error creating certs directory", "error", err)
 		return
 	}
-	cmd("01", fmt.Sprintf("openssl req -x509 -newkey rsa:4096 -keyout %s/ca.key -out %s/ca.crt -days 3650 -nodes -subj \"/CN=CAP\"", CERTS_DIR, CERTS_DIR))
+	authority, err := ca.Generate(ca.KeyTypeECDSA, 3650*24*time.Hour)
+	if err != nil {
+		slog.Error("error generating CA", "error", err)
+		return
+	}
+	if err := authority.Save(path.Join(CERTS_DIR, "ca.crt"), path.Join(CERTS_DIR, "ca.key")); err != nil {
+		slog.Error("error saving CA", "error", err)
+		return
+	}
 	fmt.Println("CA certificate and key generated in", CERTS_DIR)
 	fmt.Println("NOTE: this certificate expires in 3650 day (~10 years). You can regenerate it at any time by running this command again.")
 	fmt.Printf("NOTE: you NEED to trust this CA certificate in your system/browser for the proxy to work properly. prompt for trust (Y/n)? ")
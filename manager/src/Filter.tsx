@@ -221,7 +221,11 @@ function resolveFilterWithLocalUniqueValues(
             key.uniqueValues as Iterable<string | number>,
         );
         // excludes starred because its a boolean type
-        const vKey = key.name as "clientIP" | "clientApplication" | "host";
+        const vKey = key.name as
+            | "clientIP"
+            | "clientUser"
+            | "clientApplication"
+            | "host";
         requests.forEach((req) => {
             if (req[vKey]) {
                 uniqueValues.add(req[vKey]!);
@@ -503,6 +503,12 @@ async function getCurrentlyShownRequests(
             (req) => req.clientIP === ci.selectedValue,
         );
     }
+    let cu = filter.find((f) => f.name === "clientUser");
+    if (cu !== undefined && cu.selectedValue !== undefined) {
+        localCurrentlyShownRequests = localCurrentlyShownRequests.filter(
+            (req) => req.clientUser === cu.selectedValue,
+        );
+    }
 
     const currentlyShownRequests = [
         // using map elimnates id dups
@@ -1,5 +1,13 @@
 import { downloadBody, downloadRequest } from "./downloadRequest";
-import { Request, RequestContentProps, RequestsViewConfig } from "./types";
+import {
+    AppliedRewrite,
+    Request,
+    RequestContentProps,
+    RequestsViewConfig,
+    SSEEvent,
+    TLSInfo,
+    WebSocketFrame,
+} from "./types";
 import { Proxy } from "./api/api";
 import { CiLock, CiUnlock } from "react-icons/ci";
 import { JsonEditor } from "json-edit-react";
@@ -10,7 +18,7 @@ import {
     CollapsibleContent,
 } from "./components/ui/collapsible";
 
-import { useContext, useRef, useState } from "react";
+import { useContext, useEffect, useRef, useState } from "react";
 import { FaRegStar, FaRegTrashCan, FaStar } from "react-icons/fa6";
 import { Timeline } from "./Timeline";
 import {
@@ -31,8 +39,10 @@ const stateColors: Record<string, string> = {
     Canceled: "#806262",
     Done: "#62806b",
     Error: "oklch(50.5% 0.213 27.518)",
+    Rejected: "#806262",
     "Approval Timeout": "#806262",
     "Waiting Approval": "#806262",
+    "Waiting Response Approval": "#806262",
 };
 
 const darkStateColors: Record<string, string> = {
@@ -40,8 +50,10 @@ const darkStateColors: Record<string, string> = {
     Canceled: "#f2a6a6", // Light desaturated red
     Done: "#a6f2c3", // Soft mint green
     Error: "oklch(85% 0.2 27.5)", // Lighter and more saturated version
+    Rejected: "#f2a6a6", // Same as Canceled
     "Approval Timeout": "#f2a6a6", // Same as Canceled
     "Waiting Approval": "#f2a6a6", // Same as Canceled
+    "Waiting Response Approval": "#f2a6a6", // Same as Canceled
 };
 
 export function RequestView(props: {
@@ -128,6 +140,10 @@ export function RequestView(props: {
                         proxy={props.proxy}
                         id={props.request.id}
                         state={props.request.state}
+                        approvalDeadline={props.request.approvalDeadline}
+                        approvalTimeoutAction={
+                            props.request.approvalTimeoutAction
+                        }
                         setEditMode={setEditMode}
                         hide={props.requestsViewConfig.hideState}
                     />
@@ -256,7 +272,51 @@ export function RequestViewContent(props: RequestContentProps) {
                         props.setRequest({ ...props.request, host: v });
                     }}
                 />
+                <FieldView
+                    name="Inbound"
+                    value={
+                        props.request.inbound &&
+                        props.request.inbound !== "http"
+                            ? props.request.inbound.toUpperCase()
+                            : undefined
+                    }
+                    hide={props.requestsViewConfig.hideHost}
+                    editMode={false}
+                    disableEdits
+                />
+                <FieldView
+                    name="Mapped To"
+                    value={
+                        props.request.mapRemoteRule
+                            ? `${props.request.upstreamSecure ? "https" : "http"}://${props.request.upstreamHost}`
+                            : undefined
+                    }
+                    hide={props.requestsViewConfig.hideHost}
+                    editMode={false}
+                    disableEdits
+                />
+                <FieldView
+                    name="Upstream Proxy"
+                    value={props.request.upstreamProxy}
+                    hide={props.requestsViewConfig.hideHost}
+                    editMode={false}
+                    disableEdits
+                />
+                <FieldView
+                    name="MITM Bypass"
+                    value={props.request.mitmBypass}
+                    hide={props.requestsViewConfig.hideHost}
+                    editMode={false}
+                    disableEdits
+                />
                 <div className="mt-4"></div>
+                <FieldView
+                    name="Proxy User"
+                    value={props.request.clientUser}
+                    hide={props.requestsViewConfig.hideClientUser}
+                    editMode={false}
+                    disableEdits
+                />
                 <FieldView
                     name="Client Username"
                     value={props.request.clientAuthorizationUser}
@@ -332,6 +392,19 @@ export function RequestViewContent(props: RequestContentProps) {
                 setRequest={props.setRequest}
                 proxy={props.proxy}
             />
+            <WebSocketView
+                request={props.request}
+                setRequest={props.setRequest}
+                proxy={props.proxy}
+            />
+            <SSEView
+                request={props.request}
+                setRequest={props.setRequest}
+                proxy={props.proxy}
+            />
+            <RewritesView rewrites={props.request.rewrites} />
+            <TLSView name="Client TLS" info={props.request.clientTLS} />
+            <TLSView name="Upstream TLS" info={props.request.upstreamTLS} />
             <FieldView
                 name="Bytes Transferred"
                 hide={props.requestsViewConfig.hideBytesTransferred}
@@ -368,6 +441,10 @@ function ResponseView(props: {
     ) {
         return <></>;
     }
+    // the response can only be edited while it waits for approval
+    const editingResponse =
+        props.editMode &&
+        props.request.state === "Waiting Response Approval";
     return (
         <div className="bg-white dark:bg-gray-700 rounded-lg shadow p-4 space-y-3">
             <h2 className="text-lg font-semibold">Response</h2>
@@ -386,12 +463,47 @@ function ResponseView(props: {
                         {statusCodeToName(props.request.response?.statusCode)}
                     </>
                 ) : null}
+                {props.request.mocked && (
+                    <span
+                        className="mt-auto mb-auto text-sm text-white px-2 rounded"
+                        style={{ backgroundColor: "#5383e6" }}
+                        title="built by a mock rule, the host was not contacted"
+                    >
+                        mocked
+                    </span>
+                )}
             </div>
+            {editingResponse && (
+                <FieldView
+                    name="Status Code"
+                    value={props.request.response.statusCode}
+                    hide={false}
+                    editMode={true}
+                    setValue={(v) =>
+                        props.setRequest({
+                            ...props.request,
+                            response: {
+                                ...props.request.response,
+                                statusCode: Number(v),
+                            },
+                        })
+                    }
+                />
+            )}
             <FieldView
                 name="Headers"
                 value={props.request.response?.headers}
                 hide={props.requestsViewConfig.hideResponseHeaders}
-                editMode={props.editMode}
+                editMode={editingResponse}
+                setValue={(v) =>
+                    props.setRequest({
+                        ...props.request,
+                        response: {
+                            ...props.request.response,
+                            headers: v,
+                        },
+                    })
+                }
             />
             {!props.requestsViewConfig.hideResponseBody && (
                 <>
@@ -399,7 +511,7 @@ function ResponseView(props: {
                         request={props.request}
                         isRequestBody={false}
                         hide={false}
-                        editMode={props.editMode}
+                        editMode={editingResponse}
                         setValue={(v: string | undefined) =>
                             props.setRequest({
                                 ...props.request,
@@ -428,6 +540,219 @@ function ResponseView(props: {
     );
 }
 
+// WebSocketView shows the message log of a connection upgraded to WebSocket.
+function WebSocketView(props: {
+    request: Request;
+    setRequest: (req: Request) => void;
+    proxy: Proxy;
+}) {
+    if (props.request.response?.statusCode !== 101) {
+        return <></>;
+    }
+    const frames = props.request.websocketFrames;
+    return (
+        <div className="bg-white dark:bg-gray-700 rounded-lg shadow p-4 space-y-3">
+            <div className="flex flex-row items-center gap-4">
+                <h2 className="text-lg font-semibold">
+                    WebSocket Messages
+                    {frames != undefined ? ` (${frames.length})` : ""}
+                </h2>
+                {frames == undefined && (
+                    <button
+                        className="text-sm bg-blue-600 hover:bg-blue-700 text-white px-3 py-1 rounded shadow"
+                        onClick={async () => {
+                            const frames = await props.proxy.getWebSocketFrames(
+                                props.request.id,
+                            );
+                            props.setRequest({
+                                ...props.request,
+                                websocketFrames: frames,
+                            });
+                        }}
+                    >
+                        Load Messages
+                    </button>
+                )}
+            </div>
+            {frames != undefined && (
+                <div className="max-h-96 overflow-y-auto font-mono text-sm">
+                    {frames.map((frame, i) => (
+                        <WebSocketFrameView key={i} frame={frame} />
+                    ))}
+                </div>
+            )}
+        </div>
+    );
+}
+
+function WebSocketFrameView(props: { frame: WebSocketFrame }) {
+    const outgoing = props.frame.direction === "client-to-server";
+    return (
+        <div
+            className={`flex flex-row gap-3 border-b border-gray-200 dark:border-gray-600 py-1 ${outgoing ? "text-green-800 dark:text-green-400" : "text-blue-800 dark:text-blue-300"}`}
+        >
+            <span className="shrink-0">{outgoing ? "↑" : "↓"}</span>
+            <span className="shrink-0 text-gray-500">
+                {new Date(props.frame.datetime).toLocaleTimeString()}
+            </span>
+            <span className="shrink-0 w-24">
+                {props.frame.opcodeName}
+                {props.frame.fin ? "" : " (partial)"}
+            </span>
+            <span className="break-all">{framePayloadText(props.frame)}</span>
+        </div>
+    );
+}
+
+// RewritesView lists the rewrite rules applied to the request and its response.
+function RewritesView(props: { rewrites?: Array<AppliedRewrite> | null }) {
+    if (!props.rewrites || props.rewrites.length == 0) {
+        return <></>;
+    }
+    return (
+        <div className="bg-white dark:bg-gray-700 rounded-lg shadow p-4 space-y-1">
+            <h2 className="text-lg font-semibold">
+                Rewrites ({props.rewrites.length})
+            </h2>
+            {props.rewrites.map((rewrite, i) => (
+                <div key={i} className="flex flex-row gap-3 text-sm">
+                    <span className="w-20 shrink-0 text-gray-500">
+                        {rewrite.stage}
+                    </span>
+                    <span className="w-28 shrink-0 text-blue-800 dark:text-blue-300">
+                        {rewrite.target}
+                    </span>
+                    <span className="break-all">{rewrite.name}</span>
+                    <span className="ml-auto shrink-0 text-gray-500">
+                        {rewrite.count} replaced
+                    </span>
+                </div>
+            ))}
+        </div>
+    );
+}
+
+// TLSView shows what was negotiated in a TLS handshake of the request, and the certificate chain the host
+// presented.
+function TLSView(props: { name: string; info?: TLSInfo | null }) {
+    if (!props.info) {
+        return <></>;
+    }
+    const info = props.info;
+    return (
+        <div className="bg-white dark:bg-gray-700 rounded-lg shadow p-4 space-y-1">
+            <h2 className="text-lg font-semibold">{props.name}</h2>
+            <p className="text-sm">
+                {info.version}, {info.cipherSuite}
+                {info.alpn && `, ${info.alpn}`}
+                {info.resumed && ", resumed"}
+            </p>
+            {info.serverName && (
+                <p className="text-sm text-gray-500">SNI {info.serverName}</p>
+            )}
+            {info.chain?.map((cert, i) => (
+                <div key={i} className="text-sm font-[monospace] pt-1">
+                    <p className="break-all">{cert.subject}</p>
+                    <p className="break-all text-gray-500">
+                        issued by {cert.issuer}, valid until{" "}
+                        {new Date(cert.notAfter).toLocaleDateString()}
+                    </p>
+                    <p className="break-all text-gray-500">
+                        SHA-256 {cert.fingerprint}
+                    </p>
+                </div>
+            ))}
+        </div>
+    );
+}
+
+// SSEView shows the events of a text/event-stream response.
+function SSEView(props: {
+    request: Request;
+    setRequest: (req: Request) => void;
+    proxy: Proxy;
+}) {
+    const contentType =
+        props.request.response?.headers?.["Content-Type"]?.[0] || "";
+    if (!contentType.startsWith("text/event-stream")) {
+        return <></>;
+    }
+    const events = props.request.sseEvents;
+    return (
+        <div className="bg-white dark:bg-gray-700 rounded-lg shadow p-4 space-y-3">
+            <div className="flex flex-row items-center gap-4">
+                <h2 className="text-lg font-semibold">
+                    Events{events != undefined ? ` (${events.length})` : ""}
+                </h2>
+                {events == undefined && (
+                    <button
+                        className="text-sm bg-blue-600 hover:bg-blue-700 text-white px-3 py-1 rounded shadow"
+                        onClick={async () => {
+                            const events = await props.proxy.getSSEEvents(
+                                props.request.id,
+                            );
+                            props.setRequest({
+                                ...props.request,
+                                sseEvents: events,
+                            });
+                        }}
+                    >
+                        Load Events
+                    </button>
+                )}
+            </div>
+            {events != undefined && (
+                <div className="max-h-96 overflow-y-auto font-mono text-sm">
+                    {events.map((event, i) => (
+                        <SSEEventView key={i} event={event} />
+                    ))}
+                </div>
+            )}
+        </div>
+    );
+}
+
+function SSEEventView(props: { event: SSEEvent }) {
+    return (
+        <div className="flex flex-row gap-3 border-b border-gray-200 dark:border-gray-600 py-1">
+            <span className="shrink-0 text-gray-500">
+                {new Date(props.event.datetime).toLocaleTimeString()}
+            </span>
+            <span className="shrink-0 w-24 text-blue-800 dark:text-blue-300">
+                {props.event.event}
+            </span>
+            {props.event.lastEventID != "" && (
+                <span className="shrink-0 text-gray-500">
+                    #{props.event.lastEventID}
+                </span>
+            )}
+            <span className="break-all whitespace-pre-wrap">
+                {props.event.data}
+            </span>
+        </div>
+    );
+}
+
+// framePayloadText returns the payload of a frame as shown in the message log.
+function framePayloadText(frame: WebSocketFrame): string {
+    const raw = atob(frame.payload);
+    const suffix = frame.truncated ? ` … (${frame.length} bytes)` : "";
+    if (frame.compressed || frame.opcode === 2) {
+        return `${frame.length} bytes of binary data`;
+    }
+    if (frame.opcode === 8 && raw.length >= 2) {
+        // close frames start with a 2 byte status code
+        const code = (raw.charCodeAt(0) << 8) | raw.charCodeAt(1);
+        return `${code} ${decodeUTF8(raw.slice(2))}`;
+    }
+    return decodeUTF8(raw) + suffix;
+}
+
+function decodeUTF8(raw: string): string {
+    const bytes = Uint8Array.from(raw, (c) => c.charCodeAt(0));
+    return new TextDecoder().decode(bytes);
+}
+
 function getStatusCodeBGColor(statusCode: number) {
     if (statusCode >= 200 && statusCode < 300) {
         return "#4CAF50"; // Vibrant Green
@@ -619,6 +944,8 @@ function StateView(props: {
     proxy: Proxy;
     id: string;
     state: string;
+    approvalDeadline?: number;
+    approvalTimeoutAction?: string;
     setEditMode: React.Dispatch<React.SetStateAction<boolean>>;
     hide: boolean;
 }) {
@@ -626,7 +953,10 @@ function StateView(props: {
     if (props.hide) {
         return <></>;
     }
-    if (props.state == "Waiting Approval") {
+    if (
+        props.state == "Waiting Approval" ||
+        props.state == "Waiting Response Approval"
+    ) {
         return (
             <div className="flex-1 flex flex-row content-center items-center justify-center">
                 <button
@@ -648,6 +978,12 @@ function StateView(props: {
                 >
                     Cancel
                 </button>
+                {props.approvalDeadline && (
+                    <ApprovalCountdown
+                        deadline={props.approvalDeadline}
+                        action={props.approvalTimeoutAction}
+                    />
+                )}
             </div>
         );
     }
@@ -665,13 +1001,29 @@ function StateView(props: {
     );
 }
 
+// ApprovalCountdown shows the seconds left until the approval times out, and what happens then.
+function ApprovalCountdown(props: { deadline: number; action?: string }) {
+    const [now, setNow] = useState(Date.now());
+    useEffect(() => {
+        const interval = setInterval(() => setNow(Date.now()), 250);
+        return () => clearInterval(interval);
+    }, []);
+    const seconds = Math.max(0, Math.ceil((props.deadline - now) / 1000));
+    return (
+        <p className="ml-2 text-sm text-gray-500" title="approval timeout">
+            {props.action ?? "cancel"} in {seconds}s
+        </p>
+    );
+}
+
 function EditButton(props: {
     proxy: Proxy;
     request: Request;
     editMode: boolean;
     setEditMode: React.Dispatch<React.SetStateAction<boolean>>;
 }) {
-    if (props.request.state !== "Waiting Approval") {
+    const waitingResponse = props.request.state === "Waiting Response Approval";
+    if (props.request.state !== "Waiting Approval" && !waitingResponse) {
         return <></>;
     }
     return (
@@ -683,7 +1035,11 @@ function EditButton(props: {
                     // pressed save
                     props.setEditMode(false);
                     console.log(props.request);
-                    props.proxy.updateRequest(props.request);
+                    if (waitingResponse) {
+                        props.proxy.updateResponse(props.request);
+                    } else {
+                        props.proxy.updateRequest(props.request);
+                    }
                 } else {
                     props.setEditMode(true);
                 }
@@ -1,5 +1,19 @@
 import { filterToObject, objectToQueryString } from "@/utils.ts";
-import { Config, FilterType, Request } from "../types.ts";
+import {
+    CAInfo,
+    LeafCertificate,
+    PinnedHost,
+    Config,
+    FilterType,
+    InterceptRule,
+    MapRemoteRule,
+    MockRule,
+    RewriteRule,
+    Request,
+    SSEEvent,
+    UpstreamProxy,
+    WebSocketFrame,
+} from "../types.ts";
 import { ClientWS } from "./ws.ts";
 
 export class Proxy {
@@ -19,11 +33,37 @@ export class Proxy {
         this.config = {
             real_ip_header: false,
             certificate_lifetime: 0,
+            ca_key_type: "",
+            ca_validity: 0,
+            certificate_cache_size: 0,
+            mirror_certificates: false,
+            mitm_include: [],
+            mitm_exclude: [],
             mitm: false,
             provide_request_body: false,
             provide_response_body: false,
             perform_delay: 0,
             require_approval: false,
+            require_response_approval: false,
+            intercept_rules: [],
+            approval_timeout: 0,
+            approval_timeout_action: "cancel",
+            rewrite_rules: [],
+            mock_rules: [],
+            map_remote_rules: [],
+            upstream_proxies: [],
+            proxy_listen: [],
+            control_listen: "",
+            socks_port: 0,
+            transparent_port: 0,
+            proxy_auth: false,
+            proxy_users: [],
+            client_allow: [],
+            client_deny: [],
+            max_conns: 0,
+            max_conns_per_client: 0,
+            client_idle_timeout: 0,
+            request_read_timeout: 0,
             get_client_process_info: false,
             timeline_based_state_updates: false,
         };
@@ -68,6 +108,26 @@ export class Proxy {
         return body;
     }
 
+    async getWebSocketFrames(id: string): Promise<Array<WebSocketFrame>> {
+        const response = await fetch(`${this.url}/request/${id}/frames`);
+        if (!response.ok) {
+            throw new Error(
+                `failed to fetch websocket frames: ${response.statusText}`,
+            );
+        }
+        return await response.json();
+    }
+
+    async getSSEEvents(id: string): Promise<Array<SSEEvent>> {
+        const response = await fetch(`${this.url}/request/${id}/events`);
+        if (!response.ok) {
+            throw new Error(
+                `failed to fetch sse events: ${response.statusText}`,
+            );
+        }
+        return await response.json();
+    }
+
     async getRequestsWithFilter(
         filter: FilterType,
         offset: number,
@@ -124,6 +184,363 @@ export class Proxy {
             throw new Error(`failed to set config: ${response.statusText}`);
         }
     }
+
+    async getRules(): Promise<Array<InterceptRule>> {
+        const response = await fetch(`${this.url}/rules`);
+        if (!response.ok) {
+            throw new Error(`failed to fetch rules: ${response.statusText}`);
+        }
+        const rules = await response.json();
+        this.config.intercept_rules = rules;
+        return rules;
+    }
+
+    async addRule(rule: InterceptRule): Promise<InterceptRule> {
+        const response = await fetch(`${this.url}/rules`, {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json",
+            },
+            body: JSON.stringify(rule),
+        });
+        if (!response.ok) {
+            throw new Error(`failed to add rule: ${await response.text()}`);
+        }
+        return await response.json();
+    }
+
+    async updateRule(rule: InterceptRule): Promise<InterceptRule> {
+        const response = await fetch(`${this.url}/rules/${rule.id}`, {
+            method: "PUT",
+            headers: {
+                "Content-Type": "application/json",
+            },
+            body: JSON.stringify(rule),
+        });
+        if (!response.ok) {
+            throw new Error(`failed to update rule: ${await response.text()}`);
+        }
+        return await response.json();
+    }
+
+    async deleteRule(id: string): Promise<void> {
+        const response = await fetch(`${this.url}/rules/${id}`, {
+            method: "DELETE",
+        });
+        if (!response.ok) {
+            throw new Error(`failed to delete rule: ${response.statusText}`);
+        }
+    }
+
+    async getRewriteRules(): Promise<Array<RewriteRule>> {
+        const response = await fetch(`${this.url}/rewrites`);
+        if (!response.ok) {
+            throw new Error(
+                `failed to fetch rewrite rules: ${response.statusText}`,
+            );
+        }
+        const rules = await response.json();
+        this.config.rewrite_rules = rules;
+        return rules;
+    }
+
+    async addRewriteRule(rule: RewriteRule): Promise<RewriteRule> {
+        const response = await fetch(`${this.url}/rewrites`, {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json",
+            },
+            body: JSON.stringify(rule),
+        });
+        if (!response.ok) {
+            throw new Error(
+                `failed to add rewrite rule: ${await response.text()}`,
+            );
+        }
+        return await response.json();
+    }
+
+    async updateRewriteRule(rule: RewriteRule): Promise<RewriteRule> {
+        const response = await fetch(`${this.url}/rewrites/${rule.id}`, {
+            method: "PUT",
+            headers: {
+                "Content-Type": "application/json",
+            },
+            body: JSON.stringify(rule),
+        });
+        if (!response.ok) {
+            throw new Error(
+                `failed to update rewrite rule: ${await response.text()}`,
+            );
+        }
+        return await response.json();
+    }
+
+    async deleteRewriteRule(id: string): Promise<void> {
+        const response = await fetch(`${this.url}/rewrites/${id}`, {
+            method: "DELETE",
+        });
+        if (!response.ok) {
+            throw new Error(
+                `failed to delete rewrite rule: ${response.statusText}`,
+            );
+        }
+    }
+
+    async getMockRules(): Promise<Array<MockRule>> {
+        const response = await fetch(`${this.url}/mocks`);
+        if (!response.ok) {
+            throw new Error(
+                `failed to fetch mock rules: ${response.statusText}`,
+            );
+        }
+        const rules = await response.json();
+        this.config.mock_rules = rules;
+        return rules;
+    }
+
+    async addMockRule(rule: MockRule): Promise<MockRule> {
+        const response = await fetch(`${this.url}/mocks`, {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json",
+            },
+            body: JSON.stringify(rule),
+        });
+        if (!response.ok) {
+            throw new Error(`failed to add mock rule: ${await response.text()}`);
+        }
+        return await response.json();
+    }
+
+    async updateMockRule(rule: MockRule): Promise<MockRule> {
+        const response = await fetch(`${this.url}/mocks/${rule.id}`, {
+            method: "PUT",
+            headers: {
+                "Content-Type": "application/json",
+            },
+            body: JSON.stringify(rule),
+        });
+        if (!response.ok) {
+            throw new Error(
+                `failed to update mock rule: ${await response.text()}`,
+            );
+        }
+        return await response.json();
+    }
+
+    async deleteMockRule(id: string): Promise<void> {
+        const response = await fetch(`${this.url}/mocks/${id}`, {
+            method: "DELETE",
+        });
+        if (!response.ok) {
+            throw new Error(
+                `failed to delete mock rule: ${response.statusText}`,
+            );
+        }
+    }
+
+    async getMapRemoteRules(): Promise<Array<MapRemoteRule>> {
+        const response = await fetch(`${this.url}/remotes`);
+        if (!response.ok) {
+            throw new Error(
+                `failed to fetch map remote rules: ${response.statusText}`,
+            );
+        }
+        const rules = await response.json();
+        this.config.map_remote_rules = rules;
+        return rules;
+    }
+
+    async addMapRemoteRule(rule: MapRemoteRule): Promise<MapRemoteRule> {
+        const response = await fetch(`${this.url}/remotes`, {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json",
+            },
+            body: JSON.stringify(rule),
+        });
+        if (!response.ok) {
+            throw new Error(
+                `failed to add map remote rule: ${await response.text()}`,
+            );
+        }
+        return await response.json();
+    }
+
+    async updateMapRemoteRule(rule: MapRemoteRule): Promise<MapRemoteRule> {
+        const response = await fetch(`${this.url}/remotes/${rule.id}`, {
+            method: "PUT",
+            headers: {
+                "Content-Type": "application/json",
+            },
+            body: JSON.stringify(rule),
+        });
+        if (!response.ok) {
+            throw new Error(
+                `failed to update map remote rule: ${await response.text()}`,
+            );
+        }
+        return await response.json();
+    }
+
+    async deleteMapRemoteRule(id: string): Promise<void> {
+        const response = await fetch(`${this.url}/remotes/${id}`, {
+            method: "DELETE",
+        });
+        if (!response.ok) {
+            throw new Error(
+                `failed to delete map remote rule: ${response.statusText}`,
+            );
+        }
+    }
+
+    async getUpstreamProxies(): Promise<Array<UpstreamProxy>> {
+        const response = await fetch(`${this.url}/upstreams`);
+        if (!response.ok) {
+            throw new Error(
+                `failed to fetch upstream proxies: ${response.statusText}`,
+            );
+        }
+        const proxies = await response.json();
+        this.config.upstream_proxies = proxies;
+        return proxies;
+    }
+
+    async addUpstreamProxy(p: UpstreamProxy): Promise<UpstreamProxy> {
+        const response = await fetch(`${this.url}/upstreams`, {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json",
+            },
+            body: JSON.stringify(p),
+        });
+        if (!response.ok) {
+            throw new Error(
+                `failed to add upstream proxy: ${await response.text()}`,
+            );
+        }
+        return await response.json();
+    }
+
+    async updateUpstreamProxy(p: UpstreamProxy): Promise<UpstreamProxy> {
+        const response = await fetch(`${this.url}/upstreams/${p.id}`, {
+            method: "PUT",
+            headers: {
+                "Content-Type": "application/json",
+            },
+            body: JSON.stringify(p),
+        });
+        if (!response.ok) {
+            throw new Error(
+                `failed to update upstream proxy: ${await response.text()}`,
+            );
+        }
+        return await response.json();
+    }
+
+    async deleteUpstreamProxy(id: string): Promise<void> {
+        const response = await fetch(`${this.url}/upstreams/${id}`, {
+            method: "DELETE",
+        });
+        if (!response.ok) {
+            throw new Error(
+                `failed to delete upstream proxy: ${response.statusText}`,
+            );
+        }
+    }
+
+    // caCertURL is where the CA certificate can be downloaded, in PEM (or DER) to install on clients.
+    caCertURL(format: "pem" | "der"): string {
+        return `${this.url}/ca.crt?format=${format}`;
+    }
+
+    async getCA(): Promise<CAInfo | null> {
+        const response = await fetch(`${this.url}/ca`);
+        if (response.status === 503) {
+            return null; // there is no ca
+        }
+        if (!response.ok) {
+            throw new Error(`failed to fetch ca: ${response.statusText}`);
+        }
+        return await response.json();
+    }
+
+    async rotateCA(): Promise<CAInfo> {
+        const response = await fetch(`${this.url}/ca/rotate`, {
+            method: "POST",
+        });
+        if (!response.ok) {
+            throw new Error(`failed to rotate ca: ${await response.text()}`);
+        }
+        return await response.json();
+    }
+
+    async importCA(cert: string, key: string): Promise<CAInfo> {
+        const response = await fetch(`${this.url}/ca/import`, {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json",
+            },
+            body: JSON.stringify({ cert: cert, key: key }),
+        });
+        if (!response.ok) {
+            throw new Error(`failed to import ca: ${await response.text()}`);
+        }
+        return await response.json();
+    }
+
+    async getLeafCertificates(): Promise<Array<LeafCertificate>> {
+        const response = await fetch(`${this.url}/ca/certificates`);
+        if (!response.ok) {
+            throw new Error(
+                `failed to fetch certificates: ${await response.text()}`,
+            );
+        }
+        return await response.json();
+    }
+
+    // purgeLeafCertificates deletes the certificate generated for host, or every one of them if host is
+    // not given.
+    async purgeLeafCertificates(host?: string): Promise<void> {
+        const path = host
+            ? `/ca/certificates/${encodeURIComponent(host)}`
+            : "/ca/certificates";
+        const response = await fetch(`${this.url}${path}`, {
+            method: "DELETE",
+        });
+        if (!response.ok) {
+            throw new Error(
+                `failed to purge certificates: ${await response.text()}`,
+            );
+        }
+    }
+
+    async getPinnedHosts(): Promise<Array<PinnedHost>> {
+        const response = await fetch(`${this.url}/mitm/pinned`);
+        if (!response.ok) {
+            throw new Error(
+                `failed to fetch pinned hosts: ${response.statusText}`,
+            );
+        }
+        return await response.json();
+    }
+
+    // forgetPinnedHost makes host MITM'd again, or every pinned host if host is not given.
+    async forgetPinnedHost(host?: string): Promise<void> {
+        const path = host
+            ? `/mitm/pinned/${encodeURIComponent(host)}`
+            : "/mitm/pinned";
+        const response = await fetch(`${this.url}${path}`, {
+            method: "DELETE",
+        });
+        if (!response.ok) {
+            throw new Error(
+                `failed to forget pinned host: ${response.statusText}`,
+            );
+        }
+    }
+
     manageRequests(uCB: () => void) {
         // get requests from the server first
         this.updateCB = uCB;
@@ -164,6 +581,17 @@ export class Proxy {
         this.clientWS.cancelRequest(id);
     }
 
+    updateResponse(newrequest: Request): void {
+        const reqIndex = this.requests.findIndex((r) => r.id == newrequest.id);
+        if (reqIndex === -1) {
+            console.warn(`Request with ID ${newrequest.id} not found.`);
+            return;
+        }
+        this.requests[reqIndex].response = newrequest.response;
+        this.clientWS.updateResponse(newrequest);
+        this.updateCB!();
+    }
+
     updateRequest(newrequest: Request): void {
         const reqIndex = this.requests.findIndex((r) => r.id == newrequest.id);
         if (reqIndex === -1) {
@@ -1,4 +1,10 @@
-import { Request } from "@/types";
+import {
+    AppliedRewrite,
+    Request,
+    SSEEvent,
+    TLSInfo,
+    WebSocketFrame,
+} from "@/types";
 import { Timing } from "@/timing";
 
 interface IDMessage {
@@ -75,6 +81,14 @@ export class ClientWS {
 
                 break;
             }
+            case "REJECTED": {
+                // a client connection rejected before anything was read from it (by the client
+                // allow/deny lists or the connection limits)
+                const data = rawdata as Request;
+                data.state = "Rejected";
+                requests = [data, ...requests];
+                break;
+            }
             case "STATE": {
                 const data = rawdata as {
                     id: string;
@@ -116,6 +130,8 @@ export class ClientWS {
                     bodyID: string;
                     bodyLength: number;
                     bytesTransferred: number;
+                    rewrites: Array<AppliedRewrite> | null;
+                    clientTLS: TLSInfo | null;
                 };
                 const requestIndex = requests.findIndex(
                     (r) => r.id === data.id,
@@ -123,12 +139,19 @@ export class ClientWS {
                 if (requestIndex !== -1) {
                     const request = requests[requestIndex];
                     request.state = "Processing";
+                    request.clientTLS = data.clientTLS;
                     request.method = data.method;
                     request.path = data.path;
                     request.query = data.query;
                     request.headers = data.headers;
                     request.bodyLength = data.bodyLength;
                     request.bytesTransferred = data.bytesTransferred;
+                    request.rewrites = data.rewrites;
+                    request.mocked = data.mocked;
+                    request.upstreamHost = data.upstreamHost;
+                    request.upstreamSecure = data.upstreamSecure;
+                    request.mapRemoteRule = data.mapRemoteRule;
+                    request.upstreamProxy = data.upstreamProxy;
                     requests[requestIndex] = request;
                 } else {
                     console.warn(`Request with ID ${data.id} not found.`);
@@ -157,17 +180,71 @@ export class ClientWS {
                     headers: Record<string, Array<string>>;
                     bodyID: string;
                     bodyLength: number;
+                    rewrites: Array<AppliedRewrite> | null;
+                    mocked: boolean;
+                    upstreamHost: string;
+                    upstreamSecure: boolean;
+                    mapRemoteRule: string;
+                    upstreamProxy: string;
+                    upstreamTLS: TLSInfo | null;
                 };
                 const requestIndex = requests.findIndex(
                     (r) => r.id === data.id,
                 );
                 if (requestIndex !== -1) {
                     const request = requests[requestIndex];
+                    request.upstreamTLS = data.upstreamTLS;
                     request.response = {
                         statusCode: data.statusCode,
                         headers: data.headers,
                         bodyLength: data.bodyLength,
                     };
+                    request.rewrites = data.rewrites;
+                    requests[requestIndex] = request;
+                } else {
+                    console.warn(`Request with ID ${data.id} not found.`);
+                }
+                break;
+            }
+            case "WEBSOCKET-OPEN": {
+                const data = rawdata as IDMessage;
+                const requestIndex = requests.findIndex(
+                    (r) => r.id === data.id,
+                );
+                if (requestIndex !== -1) {
+                    const request = requests[requestIndex];
+                    request.websocketFrames = [];
+                    requests[requestIndex] = request;
+                } else {
+                    console.warn(`Request with ID ${data.id} not found.`);
+                }
+                break;
+            }
+            case "WEBSOCKET-FRAME": {
+                const data = rawdata as WebSocketFrame;
+                const requestIndex = requests.findIndex(
+                    (r) => r.id === data.id,
+                );
+                if (requestIndex !== -1) {
+                    const request = requests[requestIndex];
+                    request.websocketFrames = [
+                        ...(request.websocketFrames || []),
+                        data,
+                    ];
+                    requests[requestIndex] = request;
+                } else {
+                    console.warn(`Request with ID ${data.id} not found.`);
+                }
+                break;
+            }
+            case "SSE-EVENT": {
+                const data = rawdata as SSEEvent;
+                const requestIndex = requests.findIndex(
+                    (r) => r.id === data.id,
+                );
+                if (requestIndex !== -1) {
+                    const request = requests[requestIndex];
+                    request.sseEvents = [...(request.sseEvents || []), data];
                     requests[requestIndex] = request;
                 } else {
                     console.warn(`Request with ID ${data.id} not found.`);
@@ -199,13 +276,47 @@ export class ClientWS {
                 break;
             }
             case "APPROVAL-WAIT": {
-                const data = rawdata as { id: string };
+                const data = rawdata as {
+                    id: string;
+                    deadline?: number;
+                    timeoutAction: string;
+                };
                 const requestIndex = requests.findIndex(
                     (r) => r.id === data.id,
                 );
                 if (requestIndex !== -1) {
                     const request = requests[requestIndex];
                     request.state = "Waiting Approval";
+                    request.approvalDeadline = data.deadline;
+                    request.approvalTimeoutAction = data.timeoutAction;
+                    requests[requestIndex] = request;
+                } else {
+                    console.warn(`Request with ID ${data.id} not found.`);
+                }
+                break;
+            }
+            case "RESPONSE-APPROVAL-WAIT": {
+                const data = rawdata as {
+                    id: string;
+                    statusCode: number;
+                    headers: Record<string, Array<string>>;
+                    bodyLength: number;
+                    deadline?: number;
+                    timeoutAction: string;
+                };
+                const requestIndex = requests.findIndex(
+                    (r) => r.id === data.id,
+                );
+                if (requestIndex !== -1) {
+                    const request = requests[requestIndex];
+                    request.state = "Waiting Response Approval";
+                    request.approvalDeadline = data.deadline;
+                    request.approvalTimeoutAction = data.timeoutAction;
+                    request.response = {
+                        statusCode: data.statusCode,
+                        headers: data.headers,
+                        bodyLength: data.bodyLength,
+                    };
                     requests[requestIndex] = request;
                 } else {
                     console.warn(`Request with ID ${data.id} not found.`);
@@ -240,6 +351,26 @@ export class ClientWS {
                 }
                 break;
             }
+            case "APPROVAL-TIMEOUT": {
+                const data = rawdata as { id: string; action: string };
+                const requestIndex = requests.findIndex(
+                    (r) => r.id === data.id,
+                );
+                if (requestIndex !== -1) {
+                    const request = requests[requestIndex];
+                    request.state =
+                        data.action === "approve"
+                            ? "Processing"
+                            : data.action === "respond"
+                              ? "Approval Timeout"
+                              : "Canceled";
+                    request.approvalDeadline = undefined;
+                    requests[requestIndex] = request;
+                } else {
+                    console.warn(`Request with ID ${data.id} not found.`);
+                }
+                break;
+            }
             case "DONE": {
                 const data = rawdata as {
                     id: string;
@@ -289,6 +420,18 @@ export class ClientWS {
         this.ws.send(`APPROVAL-CANCEL ${JSON.stringify(data)}`);
     }
 
+    updateResponse(request: Request): void {
+        if (this.ws == null || !this.isOpen()) {
+            console.error("WebSocket is not initialized or not open");
+            return;
+        }
+        const data = {
+            id: request.id,
+            response: request.response,
+        };
+        this.ws.send(`UPDATE-RESPONSE ${JSON.stringify(data)}`);
+    }
+
     updateRequest(request: Request): void {
         if (this.ws == null || !this.isOpen()) {
             console.error("WebSocket is not initialized or not open");
@@ -0,0 +1,162 @@
+import { useEffect, useState } from "react";
+import { Proxy } from "@/api/api";
+import { InterceptAction, InterceptRule } from "@/types";
+
+function emptyRule(): InterceptRule {
+    return {
+        id: "",
+        disabled: false,
+        host: "",
+        path: "",
+        method: "",
+        client_application: "",
+        client_ip: "",
+        action: "intercept",
+    };
+}
+
+// ruleFields are the text fields of a rule, with their placeholders.
+const ruleFields: Array<[keyof InterceptRule, string]> = [
+    ["host", "host (*.example.com)"],
+    ["path", "path regex (^/api/)"],
+    ["method", "method"],
+    ["client_application", "client application"],
+    ["client_ip", "client ip or cidr"],
+];
+
+// InterceptRulesView manages the intercept rules of the proxy. onRulesChange is called with the rules
+// every time they are loaded, so config saved afterwards does not put back stale rules.
+export function InterceptRulesView(props: {
+    proxy: Proxy;
+    onRulesChange(rules: Array<InterceptRule>): void;
+}) {
+    const [rules, setRules] = useState<Array<InterceptRule>>([]);
+    const [newRule, setNewRule] = useState<InterceptRule>(emptyRule());
+    const [newRuleKey, setNewRuleKey] = useState(0); // changed to clear the inputs of the new rule
+    const [error, setError] = useState<string | null>(null);
+
+    const reload = async () => {
+        const rules = await props.proxy.getRules();
+        setRules(rules);
+        props.onRulesChange(rules);
+    };
+
+    useEffect(() => {
+        reload();
+        // eslint-disable-next-line react-hooks/exhaustive-deps
+    }, [props.proxy]);
+
+    const run = async (f: () => Promise<unknown>) => {
+        try {
+            await f();
+            setError(null);
+        } catch (e) {
+            setError((e as Error).message);
+        }
+        await reload();
+    };
+
+    return (
+        <div className="flex flex-col mt-4 gap-2">
+            <div className="flex flex-col">
+                <label className="font-semibold">Intercept Rules</label>
+                <p className="text-sm text-gray-600">
+                    The first matching rule decides whether a request is
+                    intercepted (paused for approval), approved or canceled.
+                    Requests no rule matches are intercepted only if approval is
+                    required.
+                </p>
+            </div>
+            {rules.map((rule) => (
+                <RuleRow
+                    key={rule.id}
+                    rule={rule}
+                    onChange={(r) => run(() => props.proxy.updateRule(r))}
+                    onDelete={() => run(() => props.proxy.deleteRule(rule.id))}
+                />
+            ))}
+            <RuleRow
+                key={newRuleKey}
+                rule={newRule}
+                onChange={setNewRule}
+                onAdd={() =>
+                    run(async () => {
+                        await props.proxy.addRule(newRule);
+                        setNewRule(emptyRule());
+                        setNewRuleKey(newRuleKey + 1);
+                    })
+                }
+            />
+            {error && <p className="text-sm text-red-600">{error}</p>}
+        </div>
+    );
+}
+
+function RuleRow(props: {
+    rule: InterceptRule;
+    onChange(rule: InterceptRule): void;
+    onDelete?(): void;
+    onAdd?(): void;
+}) {
+    const rule = props.rule;
+    return (
+        <div className="flex flex-row flex-wrap gap-1 items-center text-sm">
+            {props.onDelete && (
+                <input
+                    type="checkbox"
+                    className="accent-black w-4 h-4"
+                    title="enabled"
+                    checked={!rule.disabled}
+                    onChange={(e) =>
+                        props.onChange({ ...rule, disabled: !e.target.checked })
+                    }
+                />
+            )}
+            {ruleFields.map(([field, placeholder]) => (
+                <input
+                    key={field}
+                    className="border border-gray-400 rounded px-1 w-32"
+                    placeholder={placeholder}
+                    defaultValue={rule[field] as string}
+                    onBlur={(e) => {
+                        if (e.target.value !== rule[field]) {
+                            props.onChange({ ...rule, [field]: e.target.value });
+                        }
+                    }}
+                />
+            ))}
+            <select
+                className="border border-gray-400 rounded px-1"
+                value={rule.action}
+                onChange={(e) =>
+                    props.onChange({
+                        ...rule,
+                        action: e.target.value as InterceptAction,
+                    })
+                }
+            >
+                <option value="intercept">intercept</option>
+                <option value="approve">approve</option>
+                <option value="cancel">cancel</option>
+            </select>
+            {props.onDelete && (
+                <button
+                    className="text-white px-2 rounded"
+                    style={{ backgroundColor: "#22355c" }}
+                    onClick={props.onDelete}
+                >
+                    delete
+                </button>
+            )}
+            {props.onAdd && (
+                <button
+                    className="text-white px-2 rounded"
+                    style={{ backgroundColor: "#5383e6" }}
+                    onClick={props.onAdd}
+                >
+                    add
+                </button>
+            )}
+        </div>
+    );
+}
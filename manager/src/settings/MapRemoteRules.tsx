@@ -0,0 +1,189 @@
+import { useEffect, useState } from "react";
+import { Proxy } from "@/api/api";
+import { MapRemoteRule } from "@/types";
+
+function emptyRule(): MapRemoteRule {
+    return {
+        id: "",
+        name: "",
+        disabled: false,
+        host: "",
+        path: "",
+        to_host: "",
+        to_port: 0,
+        to_scheme: "",
+        preserve_host: false,
+    };
+}
+
+// ruleFields are the text fields of a rule, with their placeholders.
+const ruleFields: Array<[keyof MapRemoteRule, string]> = [
+    ["name", "name"],
+    ["host", "host (*.example.com)"],
+    ["path", "path (regex)"],
+    ["to_host", "to host"],
+];
+
+// MapRemoteRulesView manages the map remote rules of the proxy. onRulesChange is called with the rules every time
+// they are loaded, so config saved afterwards does not put back stale rules.
+export function MapRemoteRulesView(props: {
+    proxy: Proxy;
+    onRulesChange(rules: Array<MapRemoteRule>): void;
+}) {
+    const [rules, setRules] = useState<Array<MapRemoteRule>>([]);
+    const [newRule, setNewRule] = useState<MapRemoteRule>(emptyRule());
+    const [newRuleKey, setNewRuleKey] = useState(0); // changed to clear the inputs of the new rule
+    const [error, setError] = useState<string | null>(null);
+
+    const reload = async () => {
+        const rules = await props.proxy.getMapRemoteRules();
+        setRules(rules);
+        props.onRulesChange(rules);
+    };
+
+    useEffect(() => {
+        reload();
+        // eslint-disable-next-line react-hooks/exhaustive-deps
+    }, [props.proxy]);
+
+    const run = async (f: () => Promise<unknown>) => {
+        try {
+            await f();
+            setError(null);
+        } catch (e) {
+            setError((e as Error).message);
+        }
+        await reload();
+    };
+
+    return (
+        <div className="flex flex-col mt-4 gap-2">
+            <div className="flex flex-col">
+                <label className="font-semibold">Map Remote Rules</label>
+                <p className="text-sm text-gray-600">
+                    Requests a rule matches are sent to a different host,
+                    port or scheme than the one the client sent them to.
+                    Where each request was sent is recorded with it.
+                </p>
+            </div>
+            {rules.map((rule) => (
+                <RuleRow
+                    key={rule.id}
+                    rule={rule}
+                    onChange={(r) => run(() => props.proxy.updateMapRemoteRule(r))}
+                    onDelete={() =>
+                        run(() => props.proxy.deleteMapRemoteRule(rule.id))
+                    }
+                />
+            ))}
+            <RuleRow
+                key={newRuleKey}
+                rule={newRule}
+                onChange={setNewRule}
+                onAdd={() =>
+                    run(async () => {
+                        await props.proxy.addMapRemoteRule(newRule);
+                        setNewRule(emptyRule());
+                        setNewRuleKey(newRuleKey + 1);
+                    })
+                }
+            />
+            {error && <p className="text-sm text-red-600">{error}</p>}
+        </div>
+    );
+}
+
+function RuleRow(props: {
+    rule: MapRemoteRule;
+    onChange(rule: MapRemoteRule): void;
+    onDelete?(): void;
+    onAdd?(): void;
+}) {
+    const rule = props.rule;
+    return (
+        <div className="flex flex-row flex-wrap gap-1 items-center text-sm">
+            {props.onDelete && (
+                <input
+                    type="checkbox"
+                    className="accent-black w-4 h-4"
+                    title="enabled"
+                    checked={!rule.disabled}
+                    onChange={(e) =>
+                        props.onChange({ ...rule, disabled: !e.target.checked })
+                    }
+                />
+            )}
+            {ruleFields.map(([field, placeholder]) => (
+                <input
+                    key={field}
+                    className="border border-gray-400 rounded px-1 w-28"
+                    placeholder={placeholder}
+                    defaultValue={rule[field] as string}
+                    onBlur={(e) => {
+                        if (e.target.value !== rule[field]) {
+                            props.onChange({ ...rule, [field]: e.target.value });
+                        }
+                    }}
+                />
+            ))}
+            <input
+                type="number"
+                className="border border-gray-400 rounded px-1 w-20"
+                placeholder="to port"
+                defaultValue={rule.to_port || ""}
+                onBlur={(e) => {
+                    const port = parseInt(e.target.value) || 0;
+                    if (port !== rule.to_port) {
+                        props.onChange({ ...rule, to_port: port });
+                    }
+                }}
+            />
+            <select
+                className="border border-gray-400 rounded px-1"
+                value={rule.to_scheme}
+                onChange={(e) =>
+                    props.onChange({
+                        ...rule,
+                        to_scheme: e.target.value as MapRemoteRule["to_scheme"],
+                    })
+                }
+            >
+                <option value="">same scheme</option>
+                <option value="http">http</option>
+                <option value="https">https</option>
+            </select>
+            <label className="flex flex-row items-center gap-1">
+                <input
+                    type="checkbox"
+                    className="accent-black w-4 h-4"
+                    checked={rule.preserve_host}
+                    onChange={(e) =>
+                        props.onChange({
+                            ...rule,
+                            preserve_host: e.target.checked,
+                        })
+                    }
+                />
+                preserve host
+            </label>
+            {props.onDelete && (
+                <button
+                    className="text-white px-2 rounded"
+                    style={{ backgroundColor: "#22355c" }}
+                    onClick={props.onDelete}
+                >
+                    delete
+                </button>
+            )}
+            {props.onAdd && (
+                <button
+                    className="text-white px-2 rounded"
+                    style={{ backgroundColor: "#5383e6" }}
+                    onClick={props.onAdd}
+                >
+                    add
+                </button>
+            )}
+        </div>
+    );
+}
@@ -0,0 +1,179 @@
+import { useEffect, useState } from "react";
+import { Proxy } from "@/api/api";
+import { MockRule } from "@/types";
+
+function emptyRule(): MockRule {
+    return {
+        id: "",
+        name: "",
+        disabled: false,
+        host: "",
+        path: "",
+        method: "",
+        file: "",
+        directory: "",
+        status_code: 0,
+        headers: null,
+        body: "",
+        template: false,
+    };
+}
+
+// ruleFields are the text fields of a rule, with their placeholders.
+const ruleFields: Array<[keyof MockRule, string]> = [
+    ["name", "name"],
+    ["host", "host (*.example.com)"],
+    ["path", "path (regex)"],
+    ["method", "method"],
+    ["file", "file"],
+    ["directory", "directory"],
+    ["body", "body"],
+];
+
+// MockRulesView manages the mock rules of the proxy. onRulesChange is called with the rules every time
+// they are loaded, so config saved afterwards does not put back stale rules.
+export function MockRulesView(props: {
+    proxy: Proxy;
+    onRulesChange(rules: Array<MockRule>): void;
+}) {
+    const [rules, setRules] = useState<Array<MockRule>>([]);
+    const [newRule, setNewRule] = useState<MockRule>(emptyRule());
+    const [newRuleKey, setNewRuleKey] = useState(0); // changed to clear the inputs of the new rule
+    const [error, setError] = useState<string | null>(null);
+
+    const reload = async () => {
+        const rules = await props.proxy.getMockRules();
+        setRules(rules);
+        props.onRulesChange(rules);
+    };
+
+    useEffect(() => {
+        reload();
+        // eslint-disable-next-line react-hooks/exhaustive-deps
+    }, [props.proxy]);
+
+    const run = async (f: () => Promise<unknown>) => {
+        try {
+            await f();
+            setError(null);
+        } catch (e) {
+            setError((e as Error).message);
+        }
+        await reload();
+    };
+
+    return (
+        <div className="flex flex-col mt-4 gap-2">
+            <div className="flex flex-col">
+                <label className="font-semibold">Mock Rules</label>
+                <p className="text-sm text-gray-600">
+                    Requests a rule matches are answered with a local file,
+                    a file from a directory (by path) or an inline body,
+                    without the host being contacted. Mocked requests are
+                    still recorded, marked as mocked.
+                </p>
+            </div>
+            {rules.map((rule) => (
+                <RuleRow
+                    key={rule.id}
+                    rule={rule}
+                    onChange={(r) => run(() => props.proxy.updateMockRule(r))}
+                    onDelete={() =>
+                        run(() => props.proxy.deleteMockRule(rule.id))
+                    }
+                />
+            ))}
+            <RuleRow
+                key={newRuleKey}
+                rule={newRule}
+                onChange={setNewRule}
+                onAdd={() =>
+                    run(async () => {
+                        await props.proxy.addMockRule(newRule);
+                        setNewRule(emptyRule());
+                        setNewRuleKey(newRuleKey + 1);
+                    })
+                }
+            />
+            {error && <p className="text-sm text-red-600">{error}</p>}
+        </div>
+    );
+}
+
+function RuleRow(props: {
+    rule: MockRule;
+    onChange(rule: MockRule): void;
+    onDelete?(): void;
+    onAdd?(): void;
+}) {
+    const rule = props.rule;
+    return (
+        <div className="flex flex-row flex-wrap gap-1 items-center text-sm">
+            {props.onDelete && (
+                <input
+                    type="checkbox"
+                    className="accent-black w-4 h-4"
+                    title="enabled"
+                    checked={!rule.disabled}
+                    onChange={(e) =>
+                        props.onChange({ ...rule, disabled: !e.target.checked })
+                    }
+                />
+            )}
+            {ruleFields.map(([field, placeholder]) => (
+                <input
+                    key={field}
+                    className="border border-gray-400 rounded px-1 w-28"
+                    placeholder={placeholder}
+                    defaultValue={rule[field] as string}
+                    onBlur={(e) => {
+                        if (e.target.value !== rule[field]) {
+                            props.onChange({ ...rule, [field]: e.target.value });
+                        }
+                    }}
+                />
+            ))}
+            <input
+                type="number"
+                className="border border-gray-400 rounded px-1 w-16"
+                placeholder="status"
+                defaultValue={rule.status_code || ""}
+                onBlur={(e) => {
+                    const code = parseInt(e.target.value) || 0;
+                    if (code !== rule.status_code) {
+                        props.onChange({ ...rule, status_code: code });
+                    }
+                }}
+            />
+            <label className="flex flex-row items-center gap-1">
+                <input
+                    type="checkbox"
+                    className="accent-black w-4 h-4"
+                    checked={rule.template}
+                    onChange={(e) =>
+                        props.onChange({ ...rule, template: e.target.checked })
+                    }
+                />
+                template
+            </label>
+            {props.onDelete && (
+                <button
+                    className="text-white px-2 rounded"
+                    style={{ backgroundColor: "#22355c" }}
+                    onClick={props.onDelete}
+                >
+                    delete
+                </button>
+            )}
+            {props.onAdd && (
+                <button
+                    className="text-white px-2 rounded"
+                    style={{ backgroundColor: "#5383e6" }}
+                    onClick={props.onAdd}
+                >
+                    add
+                </button>
+            )}
+        </div>
+    );
+}
@@ -0,0 +1,83 @@
+import { useEffect, useState } from "react";
+import { Proxy } from "@/api/api";
+import { PinnedHost } from "@/types";
+
+// PinnedHostsView lists the hosts tunneled instead of MITM'd for a client because it rejected their
+// certificate repeatedly (e.g. an app that pins it), and forgets them so they are MITM'd again.
+export function PinnedHostsView(props: { proxy: Proxy }) {
+    const [hosts, setHosts] = useState<Array<PinnedHost>>([]);
+    const [error, setError] = useState<string | null>(null);
+
+    const refresh = () => {
+        props.proxy
+            .getPinnedHosts()
+            .then((h) => {
+                setHosts(h);
+                setError(null);
+            })
+            .catch((e) => setError((e as Error).message));
+    };
+    useEffect(refresh, [props.proxy]);
+
+    const forget = async (host?: string) => {
+        try {
+            await props.proxy.forgetPinnedHost(host);
+            refresh();
+        } catch (e) {
+            setError((e as Error).message);
+        }
+    };
+
+    return (
+        <div className="flex flex-col mt-4 gap-2">
+            <div className="flex flex-col">
+                <label className="font-semibold">Pinned Hosts</label>
+                <p className="text-sm text-gray-600">
+                    A client rejected the certificate generated for these hosts
+                    several times in a row, so its connections to them are
+                    tunneled instead of MITM'd for a day.
+                </p>
+            </div>
+            <div className="flex flex-row gap-2 text-sm">
+                <button
+                    className="text-white px-2 rounded"
+                    style={{ backgroundColor: "#5383e6" }}
+                    onClick={refresh}
+                >
+                    refresh
+                </button>
+                <button
+                    className="text-white px-2 rounded"
+                    style={{ backgroundColor: "#5383e6" }}
+                    onClick={() => forget()}
+                >
+                    forget all
+                </button>
+            </div>
+            {hosts.length === 0 && (
+                <p className="text-sm">No host is pinned.</p>
+            )}
+            {hosts.map((h) => (
+                <div
+                    key={`${h.client} ${h.host}`}
+                    className="flex flex-row gap-2 text-sm font-[monospace]"
+                >
+                    <span className="flex-1 break-all" title={h.error}>
+                        {h.host}
+                    </span>
+                    <span className="break-all">{h.client}</span>
+                    <span title={`since ${new Date(h.since).toLocaleString()}`}>
+                        until {new Date(h.until).toLocaleString()}
+                    </span>
+                    <button
+                        className="text-red-600"
+                        onClick={() => forget(h.host)}
+                    >
+                        forget
+                    </button>
+                </div>
+            ))}
+            {error && <p className="text-sm text-red-600">{error}</p>}
+        </div>
+    );
+}
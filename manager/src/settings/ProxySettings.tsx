@@ -1,6 +1,13 @@
 import { useEffect, useState } from "react";
 import { Proxy } from "@/api/api";
-import { CheckField, InputField } from "./SettingsFields";
+import { CheckField, InputField, SelectField } from "./SettingsFields";
+import { CertificateAuthorityView } from "./CertificateAuthority";
+import { InterceptRulesView } from "./InterceptRules";
+import { MapRemoteRulesView } from "./MapRemoteRules";
+import { MockRulesView } from "./MockRules";
+import { PinnedHostsView } from "./PinnedHosts";
+import { RewriteRulesView } from "./RewriteRules";
+import { UpstreamProxiesView } from "./UpstreamProxies";
 import { Config } from "@/types";
 
 export function ProxySettingsView(props: { proxy: Proxy }) {
@@ -30,6 +37,59 @@ export function ProxySettingsView(props: { proxy: Proxy }) {
                 traffic.
             </CheckField>
 
+            <CheckField
+                name="Mirror Certificates"
+                defaultChecked={proxyConfig.mirror_certificates}
+                onChange={(v: boolean) => {
+                    proxyConfig.mirror_certificates = v;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                Mirror Certificates set on means that the proxy fetches the
+                certificate of a host before generating one for it, and copies
+                its subject and names (including wildcards and IP addresses).
+                Certificates generated before are kept until they are purged.
+            </CheckField>
+
+            <InputField
+                name="MITM Include"
+                defaultValue={(proxyConfig.mitm_include ?? []).join(", ")}
+                type="text"
+                onChange={(v: string) => {
+                    const globs = v
+                        .split(",")
+                        .map((g) => g.trim())
+                        .filter((g) => g !== "");
+                    proxyConfig.mitm_include = globs.length > 0 ? globs : null;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                Comma-separated globs of the hosts MITM applies to (e.g.
+                *.example.com). Every host if there is none.
+            </InputField>
+
+            <InputField
+                name="MITM Exclude"
+                defaultValue={(proxyConfig.mitm_exclude ?? []).join(", ")}
+                type="text"
+                onChange={(v: string) => {
+                    const globs = v
+                        .split(",")
+                        .map((g) => g.trim())
+                        .filter((g) => g !== "");
+                    proxyConfig.mitm_exclude = globs.length > 0 ? globs : null;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                Comma-separated globs of the hosts never MITM'd, e.g. apps that
+                pin their certificates. They are tunneled instead.
+            </InputField>
+
+            <PinnedHostsView proxy={props.proxy} />
+
             <CheckField
                 name="Real IP Header"
                 defaultChecked={proxyConfig.real_ip_header}
@@ -59,6 +119,51 @@ export function ProxySettingsView(props: { proxy: Proxy }) {
                 not be valid.
             </InputField>
 
+            <SelectField
+                name="CA Key Type"
+                value={proxyConfig.ca_key_type || "ecdsa"}
+                options={["ecdsa", "rsa"]}
+                onChange={(v: string) => {
+                    proxyConfig.ca_key_type = v;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                The key type of the CA the proxy generates (on first run or
+                when it is rotated).
+            </SelectField>
+
+            <InputField
+                name="CA Validity"
+                defaultValue={proxyConfig.ca_validity}
+                type="number"
+                onChange={(v: string) => {
+                    proxyConfig.ca_validity = parseInt(v) || 0;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                How long, in days, the CA the proxy generates is valid. It is
+                3650 days if it is 0.
+            </InputField>
+
+            <InputField
+                name="Certificate Cache Size"
+                defaultValue={proxyConfig.certificate_cache_size}
+                type="number"
+                onChange={(v: string) => {
+                    proxyConfig.certificate_cache_size = parseInt(v) || 0;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                How many certificates of hosts are kept in memory. The least
+                recently used ones are evicted (they are still stored on disk).
+                It is 1000 if it is 0.
+            </InputField>
+
+            <CertificateAuthorityView proxy={props.proxy} />
+
             <InputField
                 name="Perform Delay"
                 defaultValue={proxyConfig.perform_delay}
@@ -115,6 +220,276 @@ export function ProxySettingsView(props: { proxy: Proxy }) {
                 security purposes.
             </CheckField>
 
+            <CheckField
+                name="Require Response Approval"
+                defaultChecked={proxyConfig.require_response_approval}
+                onChange={(v: boolean) => {
+                    proxyConfig.require_response_approval = v;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                Require response approval makes the proxy wait for the client to
+                approve each response before forwarding it. The status code,
+                headers and body of the response can be edited while it waits.
+            </CheckField>
+
+            <InputField
+                name="Approval Timeout"
+                defaultValue={proxyConfig.approval_timeout}
+                type="number"
+                onChange={(v: string) => {
+                    proxyConfig.approval_timeout = parseInt(v);
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                The time in seconds a request waits for approval before the
+                approval timeout action is taken. If it is 0, it waits until it
+                is approved or canceled.
+            </InputField>
+
+            <SelectField
+                name="Approval Timeout Action"
+                value={proxyConfig.approval_timeout_action || "cancel"}
+                options={["cancel", "approve", "respond"]}
+                onChange={(v: string) => {
+                    proxyConfig.approval_timeout_action = v;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                What happens to a request that was not approved in time, or
+                when no client is left to approve it. Respond answers the
+                client with a 504 Gateway Timeout.
+            </SelectField>
+
+            <InterceptRulesView
+                proxy={props.proxy}
+                onRulesChange={(rules) => {
+                    proxyConfig.intercept_rules = rules;
+                }}
+            />
+
+            <RewriteRulesView
+                proxy={props.proxy}
+                onRulesChange={(rules) => {
+                    proxyConfig.rewrite_rules = rules;
+                }}
+            />
+
+            <MockRulesView
+                proxy={props.proxy}
+                onRulesChange={(rules) => {
+                    proxyConfig.mock_rules = rules;
+                }}
+            />
+
+            <MapRemoteRulesView
+                proxy={props.proxy}
+                onRulesChange={(rules) => {
+                    proxyConfig.map_remote_rules = rules;
+                }}
+            />
+
+            <UpstreamProxiesView
+                proxy={props.proxy}
+                onProxiesChange={(proxies) => {
+                    proxyConfig.upstream_proxies = proxies;
+                }}
+            />
+
+            <InputField
+                name="Proxy Listen Addresses"
+                defaultValue={(proxyConfig.proxy_listen ?? []).join(", ")}
+                type="text"
+                onChange={(v: string) => {
+                    const addrs = v
+                        .split(",")
+                        .map((a) => a.trim())
+                        .filter((a) => a !== "");
+                    proxyConfig.proxy_listen = addrs.length > 0 ? addrs : null;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                Comma-separated addresses the proxy listens on: host:port
+                ([::1]:8000 for IPv6) or unix:/path/to/socket. It listens on
+                :8000 if there is none. Changes take effect right away.
+            </InputField>
+
+            <InputField
+                name="SOCKS Port"
+                defaultValue={proxyConfig.socks_port}
+                type="number"
+                onChange={(v: string) => {
+                    proxyConfig.socks_port = parseInt(v) || 0;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                The port of the SOCKS5/SOCKS4a listener. HTTP and TLS streams
+                tunneled through it are captured like proxy requests. There is
+                no SOCKS listener if it is 0.
+            </InputField>
+
+            <InputField
+                name="Transparent Port"
+                defaultValue={proxyConfig.transparent_port}
+                type="number"
+                onChange={(v: string) => {
+                    proxyConfig.transparent_port = parseInt(v) || 0;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                The port of the listener for connections redirected by
+                iptables (Linux only), for apps that ignore proxy settings.
+                There is no transparent listener if it is 0.
+            </InputField>
+
+            <CheckField
+                name="Proxy Authentication"
+                defaultChecked={proxyConfig.proxy_auth}
+                onChange={(v: boolean) => {
+                    proxyConfig.proxy_auth = v;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                Require clients of the proxy and SOCKS listeners to
+                authenticate as one of the proxy users. Clients that do not are
+                answered with 407 Proxy Authentication Required.
+            </CheckField>
+
+            <InputField
+                name="Proxy Users"
+                defaultValue={(proxyConfig.proxy_users ?? [])
+                    .map((u) => `${u.username}:${u.password}`)
+                    .join(", ")}
+                type="text"
+                onChange={(v: string) => {
+                    const previous = proxyConfig.proxy_users ?? [];
+                    const users = v
+                        .split(",")
+                        .map((entry) => entry.trim())
+                        .filter((entry) => entry !== "")
+                        .map((entry) => {
+                            const i = entry.indexOf(":");
+                            const username = i < 0 ? entry : entry.slice(0, i);
+                            const password = i < 0 ? "" : entry.slice(i + 1);
+                            // tokens are only set in the config file, keep them
+                            const token =
+                                previous.find((u) => u.username === username)
+                                    ?.token ?? "";
+                            return { username, password, token };
+                        });
+                    proxyConfig.proxy_users = users.length > 0 ? users : null;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                Comma-separated username:password pairs of the users allowed to
+                use the proxy. Bearer tokens are set in the config file
+                (proxy_users[].token).
+            </InputField>
+
+            <InputField
+                name="Allowed Clients"
+                defaultValue={(proxyConfig.client_allow ?? []).join(", ")}
+                type="text"
+                onChange={(v: string) => {
+                    const entries = v
+                        .split(",")
+                        .map((e) => e.trim())
+                        .filter((e) => e !== "");
+                    proxyConfig.client_allow =
+                        entries.length > 0 ? entries : null;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                Comma-separated IP addresses and CIDR ranges of the clients
+                allowed to connect. Every client that is not denied is allowed
+                if there is none.
+            </InputField>
+
+            <InputField
+                name="Denied Clients"
+                defaultValue={(proxyConfig.client_deny ?? []).join(", ")}
+                type="text"
+                onChange={(v: string) => {
+                    const entries = v
+                        .split(",")
+                        .map((e) => e.trim())
+                        .filter((e) => e !== "");
+                    proxyConfig.client_deny =
+                        entries.length > 0 ? entries : null;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                Comma-separated IP addresses and CIDR ranges of the clients
+                that are never allowed to connect. Their connections are
+                rejected.
+            </InputField>
+
+            <InputField
+                name="Max Connections"
+                defaultValue={proxyConfig.max_conns}
+                type="number"
+                onChange={(v: string) => {
+                    proxyConfig.max_conns = parseInt(v) || 0;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                The maximum number of client connections served at the same
+                time. There is no limit if it is 0.
+            </InputField>
+
+            <InputField
+                name="Max Connections Per Client"
+                defaultValue={proxyConfig.max_conns_per_client}
+                type="number"
+                onChange={(v: string) => {
+                    proxyConfig.max_conns_per_client = parseInt(v) || 0;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                The maximum number of connections served at the same time from
+                the same client IP. There is no limit if it is 0.
+            </InputField>
+
+            <InputField
+                name="Client Idle Timeout"
+                defaultValue={proxyConfig.client_idle_timeout}
+                type="number"
+                onChange={(v: string) => {
+                    proxyConfig.client_idle_timeout = parseInt(v) || 0;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                The time in seconds a new connection may stay idle before it
+                sends its first request. It is 30 seconds if it is 0.
+            </InputField>
+
+            <InputField
+                name="Request Read Timeout"
+                defaultValue={proxyConfig.request_read_timeout}
+                type="number"
+                onChange={(v: string) => {
+                    proxyConfig.request_read_timeout = parseInt(v) || 0;
+                    props.proxy!.setConfig(proxyConfig);
+                    setProxyConfig({ ...proxyConfig });
+                }}
+            >
+                The time in seconds a client has to send the head of a request.
+                It is 30 seconds if it is 0.
+            </InputField>
+
             <CheckField
                 name="Client Process Info"
                 defaultChecked={proxyConfig.get_client_process_info}
@@ -0,0 +1,190 @@
+import { useEffect, useState } from "react";
+import { Proxy } from "@/api/api";
+import { RewriteRule, RewriteStage, RewriteTarget } from "@/types";
+
+function emptyRule(): RewriteRule {
+    return {
+        id: "",
+        name: "",
+        disabled: false,
+        stage: "request",
+        host: "",
+        target: "header_value",
+        header: "",
+        match: "",
+        replace: "",
+        regex: false,
+    };
+}
+
+// ruleFields are the text fields of a rule, with their placeholders.
+const ruleFields: Array<[keyof RewriteRule, string]> = [
+    ["name", "name"],
+    ["host", "host (*.example.com)"],
+    ["header", "header (header_value)"],
+    ["match", "match"],
+    ["replace", "replace"],
+];
+
+// RewriteRulesView manages the rewrite rules of the proxy. onRulesChange is called with the rules every
+// time they are loaded, so config saved afterwards does not put back stale rules.
+export function RewriteRulesView(props: {
+    proxy: Proxy;
+    onRulesChange(rules: Array<RewriteRule>): void;
+}) {
+    const [rules, setRules] = useState<Array<RewriteRule>>([]);
+    const [newRule, setNewRule] = useState<RewriteRule>(emptyRule());
+    const [newRuleKey, setNewRuleKey] = useState(0); // changed to clear the inputs of the new rule
+    const [error, setError] = useState<string | null>(null);
+
+    const reload = async () => {
+        const rules = await props.proxy.getRewriteRules();
+        setRules(rules);
+        props.onRulesChange(rules);
+    };
+
+    useEffect(() => {
+        reload();
+        // eslint-disable-next-line react-hooks/exhaustive-deps
+    }, [props.proxy]);
+
+    const run = async (f: () => Promise<unknown>) => {
+        try {
+            await f();
+            setError(null);
+        } catch (e) {
+            setError((e as Error).message);
+        }
+        await reload();
+    };
+
+    return (
+        <div className="flex flex-col mt-4 gap-2">
+            <div className="flex flex-col">
+                <label className="font-semibold">Rewrite Rules</label>
+                <p className="text-sm text-gray-600">
+                    Match-and-replace rules applied, in order, to requests
+                    before they are sent and to responses before they are
+                    forwarded. The rules applied are recorded with each request.
+                </p>
+            </div>
+            {rules.map((rule) => (
+                <RuleRow
+                    key={rule.id}
+                    rule={rule}
+                    onChange={(r) => run(() => props.proxy.updateRewriteRule(r))}
+                    onDelete={() =>
+                        run(() => props.proxy.deleteRewriteRule(rule.id))
+                    }
+                />
+            ))}
+            <RuleRow
+                key={newRuleKey}
+                rule={newRule}
+                onChange={setNewRule}
+                onAdd={() =>
+                    run(async () => {
+                        await props.proxy.addRewriteRule(newRule);
+                        setNewRule(emptyRule());
+                        setNewRuleKey(newRuleKey + 1);
+                    })
+                }
+            />
+            {error && <p className="text-sm text-red-600">{error}</p>}
+        </div>
+    );
+}
+
+function RuleRow(props: {
+    rule: RewriteRule;
+    onChange(rule: RewriteRule): void;
+    onDelete?(): void;
+    onAdd?(): void;
+}) {
+    const rule = props.rule;
+    return (
+        <div className="flex flex-row flex-wrap gap-1 items-center text-sm">
+            {props.onDelete && (
+                <input
+                    type="checkbox"
+                    className="accent-black w-4 h-4"
+                    title="enabled"
+                    checked={!rule.disabled}
+                    onChange={(e) =>
+                        props.onChange({ ...rule, disabled: !e.target.checked })
+                    }
+                />
+            )}
+            <select
+                className="border border-gray-400 rounded px-1"
+                value={rule.stage}
+                onChange={(e) =>
+                    props.onChange({
+                        ...rule,
+                        stage: e.target.value as RewriteStage,
+                    })
+                }
+            >
+                <option value="request">request</option>
+                <option value="response">response</option>
+            </select>
+            <select
+                className="border border-gray-400 rounded px-1"
+                value={rule.target}
+                onChange={(e) =>
+                    props.onChange({
+                        ...rule,
+                        target: e.target.value as RewriteTarget,
+                    })
+                }
+            >
+                <option value="url">url</option>
+                <option value="header_name">header name</option>
+                <option value="header_value">header value</option>
+                <option value="body">body</option>
+            </select>
+            {ruleFields.map(([field, placeholder]) => (
+                <input
+                    key={field}
+                    className="border border-gray-400 rounded px-1 w-28"
+                    placeholder={placeholder}
+                    defaultValue={rule[field] as string}
+                    onBlur={(e) => {
+                        if (e.target.value !== rule[field]) {
+                            props.onChange({ ...rule, [field]: e.target.value });
+                        }
+                    }}
+                />
+            ))}
+            <label className="flex flex-row items-center gap-1">
+                <input
+                    type="checkbox"
+                    className="accent-black w-4 h-4"
+                    checked={rule.regex}
+                    onChange={(e) =>
+                        props.onChange({ ...rule, regex: e.target.checked })
+                    }
+                />
+                regex
+            </label>
+            {props.onDelete && (
+                <button
+                    className="text-white px-2 rounded"
+                    style={{ backgroundColor: "#22355c" }}
+                    onClick={props.onDelete}
+                >
+                    delete
+                </button>
+            )}
+            {props.onAdd && (
+                <button
+                    className="text-white px-2 rounded"
+                    style={{ backgroundColor: "#5383e6" }}
+                    onClick={props.onAdd}
+                >
+                    add
+                </button>
+            )}
+        </div>
+    );
+}
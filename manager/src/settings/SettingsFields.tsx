@@ -42,3 +42,31 @@ export function InputField(props: {
         </div>
     );
 }
+
+export function SelectField(props: {
+    name: string;
+    value: string;
+    options: Array<string>;
+    onChange(v: string): void;
+    children: string;
+}) {
+    return (
+        <div className="flex justify-between items-start mt-4 gap-4">
+            <div className="flex flex-col">
+                <label className="font-semibold">{props.name}</label>
+                <p className="text-sm text-gray-600">{props.children}</p>
+            </div>
+            <select
+                value={props.value}
+                className="border border-gray-400 rounded py-1 w-24 ml-auto mr-2 min-w-fit text-md text-center"
+                onChange={(e) => props.onChange(e.target.value)}
+            >
+                {props.options.map((option) => (
+                    <option key={option} value={option}>
+                        {option}
+                    </option>
+                ))}
+            </select>
+        </div>
+    );
+}
@@ -0,0 +1,182 @@
+import { useEffect, useState } from "react";
+import { Proxy } from "@/api/api";
+import { UpstreamProxy } from "@/types";
+
+function emptyProxy(): UpstreamProxy {
+    return {
+        id: "",
+        name: "",
+        disabled: false,
+        url: "",
+        hosts: null,
+        bypass: null,
+    };
+}
+
+// splitList splits a comma-separated list, null if it is empty.
+function splitList(s: string): Array<string> | null {
+    const list = s
+        .split(",")
+        .map((v) => v.trim())
+        .filter((v) => v !== "");
+    return list.length > 0 ? list : null;
+}
+
+// UpstreamProxiesView manages the upstream proxies of the proxy. onProxiesChange is called with the proxies
+// every time they are loaded, so config saved afterwards does not put back stale proxies.
+export function UpstreamProxiesView(props: {
+    proxy: Proxy;
+    onProxiesChange(proxies: Array<UpstreamProxy>): void;
+}) {
+    const [proxies, setProxies] = useState<Array<UpstreamProxy>>([]);
+    const [newProxy, setNewProxy] = useState<UpstreamProxy>(emptyProxy());
+    const [newProxyKey, setNewProxyKey] = useState(0); // changed to clear the inputs of the new proxy
+    const [error, setError] = useState<string | null>(null);
+
+    const reload = async () => {
+        const proxies = await props.proxy.getUpstreamProxies();
+        setProxies(proxies);
+        props.onProxiesChange(proxies);
+    };
+
+    useEffect(() => {
+        reload();
+        // eslint-disable-next-line react-hooks/exhaustive-deps
+    }, [props.proxy]);
+
+    const run = async (f: () => Promise<unknown>) => {
+        try {
+            await f();
+            setError(null);
+        } catch (e) {
+            setError((e as Error).message);
+        }
+        await reload();
+    };
+
+    return (
+        <div className="flex flex-col mt-4 gap-2">
+            <div className="flex flex-col">
+                <label className="font-semibold">Upstream Proxies</label>
+                <p className="text-sm text-gray-600">
+                    Traffic is sent through the first proxy that applies to
+                    its host (http://, https:// or socks5://, with
+                    user:password@ if it requires credentials) instead of
+                    directly. Hosts and bypass entries are comma-separated.
+                </p>
+            </div>
+            {proxies.map((p) => (
+                <ProxyRow
+                    key={p.id}
+                    upstream={p}
+                    onChange={(u) =>
+                        run(() => props.proxy.updateUpstreamProxy(u))
+                    }
+                    onDelete={() =>
+                        run(() => props.proxy.deleteUpstreamProxy(p.id))
+                    }
+                />
+            ))}
+            <ProxyRow
+                key={newProxyKey}
+                upstream={newProxy}
+                onChange={setNewProxy}
+                onAdd={() =>
+                    run(async () => {
+                        await props.proxy.addUpstreamProxy(newProxy);
+                        setNewProxy(emptyProxy());
+                        setNewProxyKey(newProxyKey + 1);
+                    })
+                }
+            />
+            {error && <p className="text-sm text-red-600">{error}</p>}
+        </div>
+    );
+}
+
+function ProxyRow(props: {
+    upstream: UpstreamProxy;
+    onChange(upstream: UpstreamProxy): void;
+    onDelete?(): void;
+    onAdd?(): void;
+}) {
+    const upstream = props.upstream;
+    return (
+        <div className="flex flex-row flex-wrap gap-1 items-center text-sm">
+            {props.onDelete && (
+                <input
+                    type="checkbox"
+                    className="accent-black w-4 h-4"
+                    title="enabled"
+                    checked={!upstream.disabled}
+                    onChange={(e) =>
+                        props.onChange({
+                            ...upstream,
+                            disabled: !e.target.checked,
+                        })
+                    }
+                />
+            )}
+            <input
+                className="border border-gray-400 rounded px-1 w-28"
+                placeholder="name"
+                defaultValue={upstream.name}
+                onBlur={(e) => {
+                    if (e.target.value !== upstream.name) {
+                        props.onChange({ ...upstream, name: e.target.value });
+                    }
+                }}
+            />
+            <input
+                className="border border-gray-400 rounded px-1 w-56"
+                placeholder="url (http://proxy.corp:3128)"
+                defaultValue={upstream.url}
+                onBlur={(e) => {
+                    if (e.target.value !== upstream.url) {
+                        props.onChange({ ...upstream, url: e.target.value });
+                    }
+                }}
+            />
+            <input
+                className="border border-gray-400 rounded px-1 w-40"
+                placeholder="hosts (every host)"
+                defaultValue={(upstream.hosts ?? []).join(", ")}
+                onBlur={(e) => {
+                    const hosts = splitList(e.target.value);
+                    if (hosts?.join() !== upstream.hosts?.join()) {
+                        props.onChange({ ...upstream, hosts: hosts });
+                    }
+                }}
+            />
+            <input
+                className="border border-gray-400 rounded px-1 w-40"
+                placeholder="bypass (<local>, 10.0.0.0/8)"
+                defaultValue={(upstream.bypass ?? []).join(", ")}
+                onBlur={(e) => {
+                    const bypass = splitList(e.target.value);
+                    if (bypass?.join() !== upstream.bypass?.join()) {
+                        props.onChange({ ...upstream, bypass: bypass });
+                    }
+                }}
+            />
+            {props.onDelete && (
+                <button
+                    className="text-white px-2 rounded"
+                    style={{ backgroundColor: "#22355c" }}
+                    onClick={props.onDelete}
+                >
+                    delete
+                </button>
+            )}
+            {props.onAdd && (
+                <button
+                    className="text-white px-2 rounded"
+                    style={{ backgroundColor: "#5383e6" }}
+                    onClick={props.onAdd}
+                >
+                    add
+                </button>
+            )}
+        </div>
+    );
+}
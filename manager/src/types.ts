@@ -8,6 +8,20 @@ export interface Config {
     // CertificateLifetime is the lifetime of the certificate in hours. It is possible
     // to set it to less than 0 in which any new certificates generated will not be valid.
     certificate_lifetime: number;
+    // ca_key_type ("ecdsa" or "rsa") and ca_validity (in days) are used when the proxy generates its CA, on
+    // first run or when it is rotated.
+    ca_key_type: string;
+    ca_validity: number;
+    // certificate_cache_size is how many certificates of hosts are kept in memory (1000 if 0), the least
+    // recently used ones are evicted. They are all stored on disk.
+    certificate_cache_size: number;
+    // mirror_certificates makes the certificates generated for hosts copy the subject and names of the ones
+    // the hosts present.
+    mirror_certificates: boolean;
+    // mitm_include and mitm_exclude are globs of the hosts MITM applies to: only the hosts matching
+    // mitm_include (every host if it is empty), except the ones matching mitm_exclude.
+    mitm_include: Array<string> | null;
+    mitm_exclude: Array<string> | null;
     // MITM determines who is responsible for the TLS connection. If true, the responsibility
     // is on the proxy. If false, the responsibility is on the client.
     //
@@ -34,6 +48,66 @@ export interface Config {
     // require_approval is a boolean that determines whether the proxy should require approval for each request.
     require_approval: boolean;
 
+    // require_response_approval is a boolean that determines whether the proxy should require approval for each
+    // response before forwarding it to the client. The response can be edited while it waits.
+    require_response_approval: boolean;
+
+    // intercept_rules decide, in order, whether a request is intercepted (paused for approval), approved
+    // or canceled. Requests that no rule matches are intercepted only if require_approval is set.
+    intercept_rules: Array<InterceptRule> | null;
+
+    // approval_timeout is the time in seconds a request (or response) waits for approval before
+    // approval_timeout_action is taken. If it is 0, it waits until it is approved or canceled.
+    approval_timeout: number;
+
+    // approval_timeout_action is what happens to a request that was not approved in time: "approve",
+    // "cancel" or "respond" (with a 504 Gateway Timeout).
+    approval_timeout_action: string;
+
+    // rewrite_rules are match-and-replace rules applied, in order, to every request before it is sent to
+    // the host and to every response before it is forwarded to the client.
+    rewrite_rules: Array<RewriteRule> | null;
+
+    // mock_rules answer, in order, the requests they match with a response built from a local file, a
+    // directory or an inline template, without the host being dialed.
+    mock_rules: Array<MockRule> | null;
+
+    // map_remote_rules send, in order, the requests they match to a different host, port or scheme than
+    // the one the client sent them to.
+    map_remote_rules: Array<MapRemoteRule> | null;
+
+    // upstream_proxies are the proxies traffic is sent through instead of directly. Traffic to a host
+    // goes through the first proxy that applies to it.
+    upstream_proxies: Array<UpstreamProxy> | null;
+
+    // proxy_listen are the addresses the proxy listens on: host:port ([::1]:8000 for IPv6) or
+    // unix:/path/to/socket. If it is empty, it listens on :8000. Changes take effect right away.
+    proxy_listen: Array<string> | null;
+    // control_listen is the address the control server listens on, :8001 if it is empty.
+    control_listen: string;
+    // socks_port and transparent_port are the ports of the SOCKS and transparent listeners, 0 if there is
+    // none.
+    socks_port: number;
+    transparent_port: number;
+
+    // proxy_auth determines whether clients of the HTTP proxy and SOCKS listeners must authenticate as
+    // one of proxy_users (Basic or Bearer credentials, or a SOCKS5 username and password).
+    proxy_auth: boolean;
+    proxy_users: Array<ProxyUser> | null;
+
+    // client_allow and client_deny are the IP addresses and CIDR ranges of the clients allowed and denied
+    // to connect. Everyone not denied is allowed if client_allow is empty.
+    client_allow: Array<string> | null;
+    client_deny: Array<string> | null;
+    // max_conns and max_conns_per_client limit the client connections served at the same time, in total
+    // and per client IP. 0 means no limit.
+    max_conns: number;
+    max_conns_per_client: number;
+    // client_idle_timeout is the time in seconds a new connection may stay idle before its first request,
+    // and request_read_timeout the time a client has to send a request head. 0 means 30 seconds.
+    client_idle_timeout: number;
+    request_read_timeout: number;
+
     // get_client_process_info is a boolean that determines whether the proxy should provide information
     // about the client process. Getting this information can take a significant amount of time.
     get_client_process_info: boolean;
@@ -43,6 +117,144 @@ export interface Config {
     timeline_based_state_updates: boolean;
 }
 
+export type InterceptAction = "intercept" | "approve" | "cancel";
+
+// InterceptRule matches requests on every field that is set (unset fields match anything).
+export interface InterceptRule {
+    id: string;
+    disabled: boolean;
+    host: string; // glob, e.g. *.example.com (matched with the port only if it has one)
+    path: string; // regular expression
+    method: string;
+    client_application: string; // glob
+    client_ip: string; // IP address or CIDR range
+    action: InterceptAction;
+}
+
+export type RewriteStage = "request" | "response";
+export type RewriteTarget = "url" | "header_name" | "header_value" | "body";
+
+// RewriteRule replaces what matches match with replace in the target of every request or response (by
+// stage) it applies to.
+export interface RewriteRule {
+    id: string;
+    name: string;
+    disabled: boolean;
+    stage: RewriteStage;
+    host: string; // glob, every host if empty
+    target: RewriteTarget;
+    header: string; // header_value only: the header it applies to (set to replace if match is empty)
+    match: string;
+    replace: string;
+    regex: boolean;
+}
+
+// AppliedRewrite is a rewrite rule applied to a request or its response.
+export interface AppliedRewrite {
+    ruleID: string;
+    name: string;
+    stage: RewriteStage;
+    target: RewriteTarget;
+    count: number; // number of replacements made
+}
+
+// MockRule answers the requests it matches with the file, the file under directory the path maps to, or the
+// inline status_code, headers and body (at most one of file, directory and body is set).
+export interface MockRule {
+    id: string;
+    name: string;
+    disabled: boolean;
+    host: string; // glob
+    path: string; // regular expression, stripped from the start of the path for a directory
+    method: string;
+    file: string;
+    directory: string;
+    status_code: number; // 200 if 0
+    headers: Record<string, Array<string>> | null;
+    body: string;
+    template: boolean; // body is a Go text/template, e.g. {{.Path}} or {{index .Query "id"}}
+}
+
+// MapRemoteRule sends the requests it matches to to_host, to_port and to_scheme (each kept as it was if
+// unset) instead of where the client sent them.
+export interface MapRemoteRule {
+    id: string;
+    name: string;
+    disabled: boolean;
+    host: string; // glob
+    path: string; // regular expression, every path if empty
+    to_host: string; // without a port
+    to_port: number;
+    to_scheme: "" | "http" | "https";
+    preserve_host: boolean; // leave the Host header as the client sent it
+}
+
+// UpstreamProxy is a proxy traffic to the hosts it applies to is sent through.
+export interface UpstreamProxy {
+    id: string;
+    name: string;
+    disabled: boolean;
+    url: string; // http://, https:// or socks5://, with credentials if needed (user:password@)
+    hosts: Array<string> | null; // globs, every host if empty
+    bypass: Array<string> | null; // globs, IP addresses, CIDR ranges or <local>
+}
+
+// TLSInfo is what was negotiated in a TLS handshake.
+export interface TLSInfo {
+    version: string; // e.g. TLS 1.3
+    cipherSuite: string;
+    alpn: string; // the negotiated protocol, if any
+    serverName: string; // the server name indication
+    resumed: boolean;
+    chain?: Array<TLSCertificate>; // presented by the host, leaf first
+}
+
+// TLSCertificate describes a certificate of a chain.
+export interface TLSCertificate {
+    subject: string;
+    issuer: string;
+    serialNumber: string; // hex
+    notBefore: number; // unix milli
+    notAfter: number; // unix milli
+    dnsNames?: Array<string>;
+    ipAddresses?: Array<string>;
+    fingerprint: string; // sha-256, hex
+    pem: string;
+}
+
+// PinnedHost is a host tunneled instead of MITM'd for a client because the client rejected its certificate.
+export interface PinnedHost {
+    client: string; // the application or the IP address of the client
+    host: string; // host:port
+    since: number; // unix milli
+    until: number; // unix milli, when the host is MITM'd again for the client
+    error: string; // how the client aborted the last handshake
+}
+
+// CAInfo describes the CA the certificates of MITM'd hosts are signed with.
+export interface CAInfo {
+    subject: string;
+    notBefore: number; // unix milli
+    notAfter: number; // unix milli
+    keyType: string;
+    fingerprint: string; // sha-256, hex
+}
+
+// LeafCertificate is a certificate generated for a host with the CA.
+export interface LeafCertificate {
+    host: string; // hostname:port
+    notAfter: number; // unix milli
+    cached: boolean; // in memory
+    stored: boolean; // on disk
+}
+
+// ProxyUser is a user allowed to use the proxy, with a password (Basic) and/or a token (Bearer).
+export interface ProxyUser {
+    username: string;
+    password: string;
+    token: string;
+}
+
 export interface Request {
     id: string;
     starred: boolean;
@@ -53,7 +265,15 @@ export interface Request {
     clientAuthorization: string;
     clientAuthorizationUser?: string;
     clientAuthorizationPassword?: string;
+    // clientUser is the proxy user the client authenticated as, if proxy authentication is enforced.
+    clientUser?: string;
     host: string;
+    // inbound is how the client reached the proxy: "http" (an HTTP proxy request), "socks5" or "socks4"
+    // (through the SOCKS listener) or "transparent" (redirected to the transparent listener).
+    inbound?: string;
+    // mitmBypass is why the request was tunneled although MITM is enabled: "excluded" (by mitm_include and
+    // mitm_exclude) or "pinned" (a client rejected the certificate of the host before).
+    mitmBypass?: string;
 
     method?: string;
     path?: string;
@@ -71,7 +291,34 @@ export interface Request {
 
     bytesTransferred?: number;
 
+    // websocketFrames are the frames sent over the connection after it was upgraded to WebSocket. They are
+    // undefined until loaded (or until the connection is upgraded while live).
+    websocketFrames?: Array<WebSocketFrame>;
+    // sseEvents are the events of a text/event-stream response. They are undefined until loaded (or until
+    // the first event arrives while live).
+    sseEvents?: Array<SSEEvent>;
+
     state: string;
+    // approvalDeadline is when (unix milli) the approval the request is waiting for times out, and
+    // approvalTimeoutAction what happens then. The deadline is undefined if the approval never times out.
+    approvalDeadline?: number;
+    approvalTimeoutAction?: string;
+
+    // rewrites are the rewrite rules applied to the request and its response.
+    rewrites?: Array<AppliedRewrite> | null;
+    // mocked is whether the response was built by a mock rule instead of being sent by the host.
+    mocked?: boolean;
+    // upstreamHost (host:port) and upstreamSecure are where the request was sent, which differs from host
+    // and secure if the map remote rule mapRemoteRule redirected it.
+    upstreamHost?: string;
+    upstreamSecure?: boolean;
+    mapRemoteRule?: string;
+    // upstreamProxy is the upstream proxy the request went through, if any.
+    upstreamProxy?: string;
+    // clientTLS and upstreamTLS are what was negotiated in the TLS handshakes with the client and with the
+    // host, if there were any.
+    clientTLS?: TLSInfo | null;
+    upstreamTLS?: TLSInfo | null;
 
     timing?: Timing;
     timing_total?: number;
@@ -79,6 +326,28 @@ export interface Request {
     error?: string;
 }
 
+export interface WebSocketFrame {
+    id: string; // the id of the request that upgraded the connection
+    direction: "client-to-server" | "server-to-client";
+    opcode: number;
+    opcodeName: string;
+    fin: boolean;
+    compressed: boolean;
+    payload: string; // base64
+    length: number;
+    truncated: boolean;
+    datetime: number;
+}
+
+export interface SSEEvent {
+    id: string; // the id of the request the event was sent in response to
+    event: string;
+    data: string;
+    lastEventID: string;
+    retry: number; // -1 if the event did not set one
+    datetime: number;
+}
+
 export interface RequestsViewConfig {
     hideDate: boolean;
     hideHostCollapsed: boolean;
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/cap/proxy/config"
+	"github.com/tiredkangaroo/cap/proxy/rules"
+)
+
+var (
+	ErrClientDenied       = errors.New("client is not allowed to connect")
+	ErrTooManyConns       = errors.New("too many connections")
+	ErrTooManyClientConns = errors.New("too many connections from client")
+)
+
+// connLimiter counts the client connections being served, in total and by client IP.
+type connLimiter struct {
+	mu    sync.Mutex
+	total uint
+	byIP  map[string]uint
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{byIP: make(map[string]uint)}
+}
+
+// acquire counts a new connection from ip, unless it would be over the limits of cfg. The connection must be
+// released once it is closed.
+func (l *connLimiter) acquire(ip string, cfg *config.Config) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cfg.MaxConns != 0 && l.total >= cfg.MaxConns {
+		return fmt.Errorf("%w (max %d)", ErrTooManyConns, cfg.MaxConns)
+	}
+	if ip != "" && cfg.MaxConnsPerClient != 0 && l.byIP[ip] >= cfg.MaxConnsPerClient {
+		return fmt.Errorf("%w (max %d)", ErrTooManyClientConns, cfg.MaxConnsPerClient)
+	}
+	l.total++
+	if ip != "" {
+		l.byIP[ip]++
+	}
+	return nil
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if ip == "" {
+		return
+	}
+	if l.byIP[ip]--; l.byIP[ip] == 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+// admitted returns serve with the connections it is given checked against the client allow and deny lists and
+// the connection limits first. The connections that are not admitted are rejected instead of served.
+func (c *ProxyHandler) admitted(inbound string, serve func(net.Conn)) func(net.Conn) {
+	return func(conn net.Conn) {
+		ip := connClientIP(conn)
+		err := checkClientIP(ip, config.DefaultConfig)
+		if err == nil {
+			err = c.conns.acquire(ip, config.DefaultConfig)
+		}
+		if err != nil {
+			c.reject(conn, inbound, err)
+			return
+		}
+		defer c.conns.release(ip)
+		serve(conn)
+	}
+}
+
+// connClientIP returns the IP address of the client of conn, "" for a client of a Unix domain socket.
+func connClientIP(conn net.Conn) string {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	return addr.IP.String()
+}
+
+// checkClientIP reports whether a client with ip may connect according to the allow and deny lists of cfg.
+func checkClientIP(ip string, cfg *config.Config) error {
+	if ip == "" {
+		return nil
+	}
+	for _, entry := range cfg.ClientDeny {
+		if rules.MatchIP(entry, ip) {
+			return fmt.Errorf("%w: denied by %s", ErrClientDenied, entry)
+		}
+	}
+	if len(cfg.ClientAllow) == 0 {
+		return nil
+	}
+	for _, entry := range cfg.ClientAllow {
+		if rules.MatchIP(entry, ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: not in the allow list", ErrClientDenied)
+}
+
+// reject closes a connection that was not admitted. It is recorded as a rejected request, without a host since
+// nothing was read from the client.
+func (c *ProxyHandler) reject(conn net.Conn, inbound string, err error) {
+	conn.Close()
+	slog.Warn("rejected connection", "err", err.Error(), "client", conn.RemoteAddr().String(), "inbound", inbound)
+
+	r := newRequest(c.m, NewCustomConn(conn), newID())
+	if inbound == InboundHTTP && config.DefaultConfig.ReverseProxy.Enabled() {
+		inbound = InboundReverse
+	}
+	r.Inbound = inbound
+	r.Datetime = time.Now()
+	r.Rejected = true
+	r.ClientIP = connClientIP(conn)
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		r.ClientPort = fmt.Sprint(addr.Port)
+	}
+	if r.ClientIP == "" || ipIsLocalhost(r.ClientIP) {
+		r.ClientIP = ThisDevice
+	}
+	c.m.SendRejected(r, err)
+}
@@ -0,0 +1,88 @@
+// Package auth checks the credentials clients send to the proxy (proxy authentication) against the users
+// allowed to use it.
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrNoCredentials      = errors.New("proxy authentication required")
+	ErrInvalidCredentials = errors.New("invalid proxy credentials")
+	ErrInvalidUser        = errors.New("proxy user must have a username and a password or a token")
+)
+
+// Realm is the realm of the challenges sent to clients that did not authenticate.
+const Realm = "cap"
+
+// User is a user allowed to use the proxy. It authenticates with Basic credentials (its username and
+// password) or with a Bearer token.
+type User struct {
+	Username string `json:"username"`
+	// Password is the password of the user for Basic authentication. The user cannot authenticate with Basic
+	// credentials if it is empty.
+	Password string `json:"password"`
+	// Token is the token of the user for Bearer authentication. The user cannot authenticate with a token if
+	// it is empty.
+	Token string `json:"token"`
+}
+
+// Validate reports whether the user is well formed.
+func (u *User) Validate() error {
+	if u.Username == "" || (u.Password == "" && u.Token == "") {
+		return ErrInvalidUser
+	}
+	return nil
+}
+
+// Challenges returns the values of the Proxy-Authenticate header sent to a client that did not authenticate.
+func Challenges() []string {
+	return []string{`Basic realm="` + Realm + `"`, `Bearer realm="` + Realm + `"`}
+}
+
+// Authenticate returns the name of the user the credentials of a Proxy-Authorization header (Basic or
+// Bearer) belong to.
+func Authenticate(users []User, authorization string) (string, error) {
+	scheme, credentials, _ := strings.Cut(strings.TrimSpace(authorization), " ")
+	credentials = strings.TrimSpace(credentials)
+	switch {
+	case authorization == "":
+		return "", ErrNoCredentials
+	case strings.EqualFold(scheme, "Basic"):
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return "", ErrInvalidCredentials
+		}
+		username, password, _ := strings.Cut(string(decoded), ":")
+		return Check(users, username, password)
+	case strings.EqualFold(scheme, "Bearer"):
+		for _, u := range users {
+			if u.Token != "" && equal(u.Token, credentials) {
+				return u.Username, nil
+			}
+		}
+	}
+	return "", ErrInvalidCredentials
+}
+
+// Check returns the name of the user with the username and password. A token is accepted as the password of
+// its user too, for clients that can only send a username and a password (such as SOCKS5 clients).
+func Check(users []User, username, password string) (string, error) {
+	for _, u := range users {
+		if u.Username != username {
+			continue
+		}
+		if (u.Password != "" && equal(u.Password, password)) || (u.Token != "" && equal(u.Token, password)) {
+			return u.Username, nil
+		}
+	}
+	return "", ErrInvalidCredentials
+}
+
+// equal compares secrets in constant time.
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
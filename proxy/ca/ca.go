@@ -0,0 +1,220 @@
+// Package ca generates, loads and saves the certificate authority the proxy signs the certificates of MITM'd
+// hosts with.
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ErrInvalidKeyType = errors.New("ca key type must be ecdsa or rsa")
+	ErrNoPEM          = errors.New("no pem block found")
+	ErrNotCA          = errors.New("certificate is not a ca certificate")
+	ErrKeyMismatch    = errors.New("private key does not match the certificate")
+	ErrUnsupportedKey = errors.New("unsupported private key type")
+)
+
+// Key types of generated CAs.
+const (
+	KeyTypeECDSA = "ecdsa" // P-256
+	KeyTypeRSA   = "rsa"   // 4096 bits
+)
+
+// CommonName is the common name of generated CAs.
+const CommonName = "CAP"
+
+// CA is a certificate authority: its certificate and private key.
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+
+	// CertPEM and KeyPEM are the certificate and the key (PKCS #8) encoded in PEM, as they are saved.
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// Generate generates a new CA with a key of keyType (KeyTypeECDSA if it is empty), valid for validity from now.
+func Generate(keyType string, validity time.Duration) (*CA, error) {
+	var key crypto.Signer
+	var err error
+	switch keyType {
+	case KeyTypeECDSA, "":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeRSA:
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidKeyType, keyType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+
+	sn, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial number: %w", err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: sn,
+		Subject: pkix.Name{
+			CommonName:   CommonName,
+			Organization: []string{CommonName},
+		},
+		NotBefore:             now.Add(-time.Hour), // tolerate clients whose clock is behind
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshal key: %w", err)
+	}
+	return Parse(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	)
+}
+
+// Parse parses a CA from its PEM encoded certificate and private key (PKCS #8, PKCS #1 or SEC 1). The key
+// must be the key of the certificate, and the certificate must be allowed to sign certificates.
+func Parse(certPEM, keyPEM []byte) (*CA, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("parse cert: %w", ErrNoPEM)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse cert: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, ErrNotCA
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("parse key: %w", ErrNoPEM)
+	}
+	key, err := parseKey(keyBlock)
+	if err != nil {
+		return nil, fmt.Errorf("parse key: %w", err)
+	}
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return nil, ErrKeyMismatch
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshal key: %w", err)
+	}
+	return &CA{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+func parseKey(block *pem.Block) (crypto.Signer, error) {
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+	return signer, nil
+}
+
+// Load loads a CA from the PEM encoded certificate and key files.
+func Load(certFile, keyFile string) (*CA, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("read cert: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+	return Parse(certPEM, keyPEM)
+}
+
+// Save saves the certificate and the key of the CA to the files, creating their directories if needed. The
+// key file is only readable by its owner.
+func (ca *CA) Save(certFile, keyFile string) error {
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return fmt.Errorf("create directory: %w", err)
+		}
+	}
+	// the key is written first: a certificate without its key is useless, a key without its certificate is
+	// replaced the next time
+	if err := writeFile(keyFile, ca.KeyPEM, 0600); err != nil {
+		return fmt.Errorf("write key: %w", err)
+	}
+	if err := writeFile(certFile, ca.CertPEM, 0644); err != nil {
+		return fmt.Errorf("write cert: %w", err)
+	}
+	return nil
+}
+
+// writeFile replaces the file with data atomically, so a CA is never left half written.
+func writeFile(name string, data []byte, perm os.FileMode) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil { // in case the temporary file already existed
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the CA certificate, in hex.
+func (ca *CA) Fingerprint() string {
+	sum := sha256.Sum256(ca.Cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// KeyType returns the type of the key of the CA: KeyTypeECDSA, KeyTypeRSA, or the name of another type.
+func (ca *CA) KeyType() string {
+	switch ca.Key.(type) {
+	case *ecdsa.PrivateKey:
+		return KeyTypeECDSA
+	case *rsa.PrivateKey:
+		return KeyTypeRSA
+	default:
+		return fmt.Sprintf("%T", ca.Key)
+	}
+}
@@ -0,0 +1,122 @@
+package certificate
+
+import (
+	"container/list"
+	"crypto/tls"
+	"sync"
+)
+
+// leafCache keeps the most recently used certificates of hosts in memory. Once it holds more than its capacity
+// (config.Config.CertificateCacheSize), the least recently used ones are evicted.
+type leafCache struct {
+	mu    sync.Mutex
+	order *list.List               // of *leafEntry, most recently used first
+	hosts map[string]*list.Element // by host
+}
+
+type leafEntry struct {
+	host string
+	cert tls.Certificate
+}
+
+func newLeafCache() *leafCache {
+	return &leafCache{
+		order: list.New(),
+		hosts: make(map[string]*list.Element),
+	}
+}
+
+// get returns the certificate of host, if it is cached, and marks it as used.
+func (l *leafCache) get(host string) (tls.Certificate, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.hosts[host]
+	if !ok {
+		return tls.Certificate{}, false
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(*leafEntry).cert, true
+}
+
+// add caches the certificate of host, evicting the least recently used certificates over capacity.
+func (l *leafCache) add(host string, cert tls.Certificate, capacity int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.hosts[host]; ok {
+		e.Value.(*leafEntry).cert = cert
+		l.order.MoveToFront(e)
+	} else {
+		l.hosts[host] = l.order.PushFront(&leafEntry{host: host, cert: cert})
+	}
+	for l.order.Len() > capacity {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.hosts, oldest.Value.(*leafEntry).host)
+	}
+}
+
+// remove forgets the certificate of host.
+func (l *leafCache) remove(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.hosts[host]; ok {
+		l.order.Remove(e)
+		delete(l.hosts, host)
+	}
+}
+
+// purge forgets every certificate.
+func (l *leafCache) purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.order.Init()
+	clear(l.hosts)
+}
+
+// entries returns the cached certificates, most recently used first.
+func (l *leafCache) entries() []leafEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]leafEntry, 0, l.order.Len())
+	for e := l.order.Front(); e != nil; e = e.Next() {
+		entries = append(entries, *e.Value.(*leafEntry))
+	}
+	return entries
+}
+
+// hostLocks lock hosts one by one, so a certificate is generated (and stored) once for concurrent handshakes
+// with the same host. The zero value is ready to use.
+type hostLocks struct {
+	mu    sync.Mutex
+	hosts map[string]*hostLock
+}
+
+type hostLock struct {
+	mu      sync.Mutex
+	waiters int // holding or waiting for mu
+}
+
+// lock locks host, and returns the func that unlocks it.
+func (h *hostLocks) lock(host string) (unlock func()) {
+	h.mu.Lock()
+	if h.hosts == nil {
+		h.hosts = make(map[string]*hostLock)
+	}
+	l, ok := h.hosts[host]
+	if !ok {
+		l = new(hostLock)
+		h.hosts[host] = l
+	}
+	l.waiters++
+	h.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		h.mu.Lock()
+		if l.waiters--; l.waiters == 0 {
+			delete(h.hosts, host)
+		}
+		h.mu.Unlock()
+	}
+}
@@ -6,101 +6,234 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"math/big"
 	"net"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/tiredkangaroo/cap/proxy/ca"
 	"github.com/tiredkangaroo/cap/proxy/config"
 )
 
+// ErrNoCA is returned when a certificate for a host is needed but there is no CA to sign it with.
+var ErrNoCA = errors.New("no ca to sign certificates with")
+
 // Certificates is a struct that provides services for making TLS connections.
 type Certificates struct {
-	// caCert is the CA certificate used to sign the certificates for the hosts.
-	caCert *x509.Certificate
-	// caKey is the CA private key used to sign the certificates for the hosts.
-	caKey any
-
-	// cache is a map of hostnames to TLS certificates. A sync.Map is used over
-	// a regular map plus a lock because it is more performant for the specific
-	// use case of this proxy and reduces lock contention.
-	//
-	// From the docs of sync.Map: "The Map type is optimized for two common use cases:
-	// (1) when the entry for a given key is only ever written once but read many times,
-	// as in caches that only grow [...]."
-	cache sync.Map
+	// certFile and keyFile are where the CA certificate and key are kept.
+	certFile, keyFile string
+
+	// mu guards ca, cache and store, which are replaced together when the CA changes (or
+	// MirrorCertificates does, see current).
+	mu sync.RWMutex
+	// ca is the CA used to sign the certificates for the hosts. It is nil if it could not be loaded.
+	ca *ca.CA
+
+	// cache keeps the most recently used certificates for the hosts in memory, and store keeps every one of
+	// them on disk (in the leaves directory next to the CA) so they are not generated again after a restart.
+	// They are kept by hostname: a certificate is valid for every port of its host.
+	cache *leafCache
+	store leafStore
+	// generating locks the hosts whose certificate is being generated.
+	generating hostLocks
 
 	sysCertPool *x509.CertPool
 }
 
-// Init initializes the Certificates struct by reading the CA certificate from the
-// environment variable PROXY_CACERT and the CA private key from the environment
-// variable PROXY_CAKEY. It parses the certificate and key and stores them in
-// the caCert and caKey fields respectively.
+// Init initializes the Certificates struct by loading the CA certificate from the file in the environment
+// variable PROXY_CACERT and the CA private key from the file in the environment variable PROXY_CAKEY
+// (certs/ca.crt and certs/ca.key in dirname by default). If neither file exists, a new CA is generated and
+// saved to them.
 func (c *Certificates) Init(dirname string) error {
-	proxyCACert := os.Getenv("PROXY_CACERT")
-	proxyCAKey := os.Getenv("PROXY_CAKEY")
+	c.certFile = os.Getenv("PROXY_CACERT")
+	c.keyFile = os.Getenv("PROXY_CAKEY")
 
 	// default values for the CA certificate and key will be used when the user can manually drop in proxy cacert and cakey
 	// files
-	if proxyCACert == "" {
-		proxyCACert = fmt.Sprintf("%s/certs/ca.crt", dirname)
+	if c.certFile == "" {
+		c.certFile = fmt.Sprintf("%s/certs/ca.crt", dirname)
 		slog.Warn("PROXY_CACERT environment variable is not set, using default: certs/ca.crt")
 	}
-	if proxyCAKey == "" {
-		proxyCAKey = fmt.Sprintf("%s/certs/ca.key", dirname)
+	if c.keyFile == "" {
+		c.keyFile = fmt.Sprintf("%s/certs/ca.key", dirname)
 		slog.Warn("PROXY_CAKEY environment variable is not set, using default: certs/ca.key")
 	}
-	rawproxyCACert, err := os.ReadFile(proxyCACert)
+
+	var err error
+	c.sysCertPool, err = x509.SystemCertPool()
 	if err != nil {
-		return fmt.Errorf("proxy cacert readfile: %w", err)
+		return fmt.Errorf("get system cert pool (cannot make HTTPS connections): %w", err)
+	}
+
+	authority, err := ca.Load(c.certFile, c.keyFile)
+	if err != nil && notExist(c.certFile) && notExist(c.keyFile) {
+		// first run: nothing to lose by making a CA
+		authority, err = c.generate()
+		if err == nil {
+			slog.Info("generated a new CA, trust its certificate on clients to use mitm", "cert", c.certFile,
+				"fingerprint", authority.Fingerprint())
+		}
 	}
-	rawproxyCAKey, err := os.ReadFile(proxyCAKey)
 	if err != nil {
-		return fmt.Errorf("proxy cakey readfile: %w", err)
+		return fmt.Errorf("load ca: %w", err)
 	}
+	c.setCA(authority)
+	return nil
+}
 
-	certBlock, _ := pem.Decode(rawproxyCACert)
-	keyBlock, _ := pem.Decode(rawproxyCAKey)
+func notExist(name string) bool {
+	_, err := os.Stat(name)
+	return errors.Is(err, fs.ErrNotExist)
+}
 
-	c.caCert, err = x509.ParseCertificate(certBlock.Bytes)
+// generate generates a CA as configured and saves it.
+func (c *Certificates) generate() (*ca.CA, error) {
+	authority, err := ca.Generate(config.DefaultConfig.CAKeyType, config.DefaultConfig.CAValidityDuration())
 	if err != nil {
-		return fmt.Errorf("parse cert: %w", err)
+		return nil, fmt.Errorf("generate ca: %w", err)
+	}
+	if err := authority.Save(c.certFile, c.keyFile); err != nil {
+		return nil, fmt.Errorf("save ca: %w", err)
 	}
+	return authority, nil
+}
+
+// setCA makes the certificates for the hosts signed by authority from now on. The certificates signed by
+// the previous CA are forgotten, and the ones authority signed before are loaded from the disk.
+func (c *Certificates) setCA(authority *ca.CA) {
+	cache, store := c.loadLeaves(authority, config.DefaultConfig.MirrorCertificates)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ca, c.cache, c.store = authority, cache, store
+}
+
+// current returns the CA and the certificates generated for the hosts with it, as MirrorCertificates is set
+// now. When the setting changes, the certificates generated with the other one are set aside (they stay
+// stored, to be used again if it changes back) and the ones generated with this one are loaded.
+func (c *Certificates) current() (*ca.CA, *leafCache, leafStore) {
+	mirrored := config.DefaultConfig.MirrorCertificates
+	c.mu.RLock()
+	authority, cache, store := c.ca, c.cache, c.store
+	c.mu.RUnlock()
+	if authority == nil || store.mirrored == mirrored {
+		return authority, cache, store
+	}
+
+	cache, store = c.loadLeaves(authority, mirrored)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ca == authority && c.store.mirrored != mirrored { // not replaced in the meantime
+		c.cache, c.store = cache, store
+	}
+	return c.ca, c.cache, c.store
+}
 
-	c.caKey, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+// loadLeaves returns a cache of the certificates authority signed, mirrored or not, and where they are stored.
+func (c *Certificates) loadLeaves(authority *ca.CA, mirrored bool) (*leafCache, leafStore) {
+	cache := newLeafCache()
+	store := leafStore{dir: storeDir(c.storeRoot(), authority.Fingerprint(), mirrored), mirrored: mirrored}
+	loadStore(cache, store)
+	return cache, store
+}
+
+// storeRoot returns the directory the certificates for the hosts are stored in, by CA.
+func (c *Certificates) storeRoot() string {
+	return filepath.Join(filepath.Dir(c.certFile), "leaves")
+}
+
+// loadStore caches the most recently stored certificates of store, as many as the cache can hold. Expired
+// certificates are deleted.
+func loadStore(cache *leafCache, store leafStore) {
+	hosts, err := store.hosts()
 	if err != nil {
-		return fmt.Errorf("parse key: %w", err)
+		slog.Warn("failed to list stored certificates", "err", err.Error())
+		return
+	}
+	capacity := config.DefaultConfig.CertificateCacheCapacity()
+	hosts = hosts[:min(len(hosts), capacity)]
+	for i := len(hosts) - 1; i >= 0; i-- { // oldest first, so the most recent ones end up most recently used
+		cert, err := store.load(hosts[i])
+		if err != nil || !fresh(cert) {
+			store.remove(hosts[i])
+			continue
+		}
+		cache.add(hosts[i], cert, capacity)
 	}
+	if len(hosts) > 0 {
+		slog.Info("loaded stored certificates", "count", len(hosts), "dir", store.dir)
+	}
+}
 
-	c.sysCertPool, err = x509.SystemCertPool()
+// fresh reports whether a certificate is far enough from expiring to be used.
+func fresh(cert tls.Certificate) bool {
+	return time.Until(cert.Leaf.NotAfter) >= time.Minute
+}
+
+// CA returns the CA, nil if there is none (MITM is not possible then).
+func (c *Certificates) CA() *ca.CA {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ca
+}
+
+// Rotate replaces the CA with a newly generated one, as configured. Clients have to trust the new CA
+// certificate for MITM to keep working.
+func (c *Certificates) Rotate() (*ca.CA, error) {
+	authority, err := c.generate()
 	if err != nil {
-		return fmt.Errorf("get system cert pool (cannot make HTTPS connections): %w", err)
+		return nil, err
 	}
+	c.setCA(authority)
+	return authority, nil
+}
 
-	return nil
+// Import replaces the CA with the one with the PEM encoded certificate and key, e.g. a CA the clients already
+// trust.
+func (c *Certificates) Import(certPEM, keyPEM []byte) (*ca.CA, error) {
+	authority, err := ca.Parse(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if err := authority.Save(c.certFile, c.keyFile); err != nil {
+		return nil, fmt.Errorf("save ca: %w", err)
+	}
+	c.setCA(authority)
+	return authority, nil
 }
 
-// getTLSCert generates a new TLS certificate for the given host. It first checks if
-// the certificate is already in the cache. If it is, it returns the cached
+// getTLSCert generates a new TLS certificate for the hostname of the given host (host:port). It first
+// checks if the certificate is already in the cache. If it is, it returns the cached
 // certificate. If it is not, it generates a new certificate and stores it in the
 // cache.
 //
+// If MirrorCertificates is enabled, the certificate the host presents is fetched with dial and the
+// generated certificate has its subject and names (so it covers the same hosts, wildcards included).
+//
 // The certificate is valid for the lifetime specified in the config (CertificateLifetime).
-func (c *Certificates) getTLSCert(host string) (tls.Certificate, error) {
-	// check if the certificate is already in the cache
-	cachedCertificate, ok := c.cache.Load(host)
-	if ok {
-		if time.Until(cachedCertificate.(tls.Certificate).Leaf.NotAfter) < time.Minute {
-			c.cache.Delete(host) // delete the certificate if it is expired or about to expire
-		} else {
-			return cachedCertificate.(tls.Certificate), nil
-		}
+func (c *Certificates) getTLSCert(hostport string, dial Dialer) (tls.Certificate, error) {
+	host := splitHost(hostport)
+	authority, cache, store := c.current()
+	if authority == nil {
+		return tls.Certificate{}, ErrNoCA
+	}
+	capacity := config.DefaultConfig.CertificateCacheCapacity()
+
+	if cert, ok := lookup(cache, store, host, capacity); ok {
+		return cert, nil
+	}
+	// the handshakes with host that wait here use the certificate generated by the first one
+	unlock := c.generating.lock(host)
+	defer unlock()
+	if cert, ok := lookup(cache, store, host, capacity); ok {
+		return cert, nil
 	}
 
 	// generate a new private key for the new certificate
@@ -115,23 +248,26 @@ func (c *Certificates) getTLSCert(host string) (tls.Certificate, error) {
 		return tls.Certificate{}, fmt.Errorf("an error occured while attempting to generate a certificate serial number: %s", err.Error())
 	}
 
-	// create cert config
-	config := &x509.Certificate{
-		SerialNumber: sn,
-		Subject: pkix.Name{
-			Country:      []string{"US"},
-			Organization: []string{"N/A"},
-		},
-		DNSNames:              []string{host},
-		NotBefore:             time.Now().Add(-(time.Hour * 7200)),
-		NotAfter:              time.Now().Add(time.Hour * time.Duration(config.DefaultConfig.CertificateLifetime)),
-		KeyUsage:              x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
-		BasicConstraintsValid: true,
+	// fetch the certificate of the host to mirror
+	var upstream *x509.Certificate
+	if store.mirrored && dial != nil {
+		upstream, err = fetchUpstreamCert(dial, hostport)
+		if err != nil {
+			slog.Warn("failed to fetch the certificate of the host to mirror", "host", hostport, "err", err.Error())
+		}
 	}
 
+	// create cert config
+	template := leafTemplate(host, upstream)
+	template.SerialNumber = sn
+	template.NotBefore = time.Now().Add(-(time.Hour * 7200))
+	template.NotAfter = time.Now().Add(time.Hour * time.Duration(config.DefaultConfig.CertificateLifetime))
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	template.BasicConstraintsValid = true
+
 	// create certificate
-	cert, err := x509.CreateCertificate(rand.Reader, config, c.caCert, &pk.PublicKey, c.caKey)
+	cert, err := x509.CreateCertificate(rand.Reader, template, authority.Cert, &pk.PublicKey, authority.Key)
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("creating the x509 certificate: %w", err)
 	}
@@ -158,14 +294,123 @@ func (c *Certificates) getTLSCert(host string) (tls.Certificate, error) {
 		return tls.Certificate{}, fmt.Errorf("create x509 key pair: %w", err)
 	}
 
-	// store the certificate in the cache
-	c.cache.Store(host, tlscert)
+	// store the certificate in the cache, and on disk
+	cache.add(host, tlscert, capacity)
+	if err := store.save(host, pemCert, pemKey); err != nil {
+		slog.Warn("failed to store certificate", "host", host, "err", err.Error())
+	}
 	return tlscert, nil
 }
 
-// TLSConn creates a new TLS connection using the given config and connection signed for the specified host.
-func (c *Certificates) TLSConn(conn net.Conn, host string) (*tls.Conn, error) {
-	cert, err := c.getTLSCert(host)
+// lookup returns the certificate of host if it is in the cache, or was stored before it was evicted, and is
+// still fresh. A certificate that is expired or about to expire is deleted.
+func lookup(cache *leafCache, store leafStore, host string, capacity int) (tls.Certificate, bool) {
+	cert, ok := cache.get(host)
+	if !ok {
+		cert, ok = tryLoad(store, host)
+		if ok {
+			cache.add(host, cert, capacity)
+		}
+	}
+	if !ok {
+		return tls.Certificate{}, false
+	}
+	if !fresh(cert) {
+		cache.remove(host)
+		store.remove(host)
+		return tls.Certificate{}, false
+	}
+	return cert, true
+}
+
+// tryLoad loads the stored certificate of host, if there is one.
+func tryLoad(store leafStore, host string) (tls.Certificate, bool) {
+	if store.dir == "" {
+		return tls.Certificate{}, false
+	}
+	cert, err := store.load(host)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("failed to load stored certificate", "host", host, "err", err.Error())
+		}
+		return tls.Certificate{}, false
+	}
+	return cert, true
+}
+
+// Leaf describes a certificate generated for a host.
+type Leaf struct {
+	Host     string
+	NotAfter time.Time
+	Cached   bool // in memory
+	Stored   bool // on disk
+}
+
+// Leaves returns the certificates generated for hosts with the current CA: the cached ones, most recently used
+// first, then the ones that are only stored.
+func (c *Certificates) Leaves() ([]Leaf, error) {
+	authority, cache, store := c.current()
+	if authority == nil {
+		return nil, ErrNoCA
+	}
+
+	stored, err := store.hosts()
+	if err != nil {
+		return nil, fmt.Errorf("list stored certificates: %w", err)
+	}
+	isStored := make(map[string]bool, len(stored))
+	for _, host := range stored {
+		isStored[host] = true
+	}
+
+	var leaves []Leaf
+	seen := make(map[string]bool)
+	for _, e := range cache.entries() {
+		seen[e.host] = true
+		leaves = append(leaves, Leaf{Host: e.host, NotAfter: e.cert.Leaf.NotAfter, Cached: true, Stored: isStored[e.host]})
+	}
+	for _, host := range stored {
+		if seen[host] {
+			continue
+		}
+		cert, err := store.load(host)
+		if err != nil {
+			continue
+		}
+		leaves = append(leaves, Leaf{Host: host, NotAfter: cert.Leaf.NotAfter, Stored: true})
+	}
+	return leaves, nil
+}
+
+// Purge deletes the certificate generated for host, from memory and from the disk, so a new one is generated
+// the next time it is needed. If host is empty, every certificate is deleted, including the ones signed by
+// previous CAs.
+func (c *Certificates) Purge(host string) error {
+	authority, cache, store := c.current()
+	if authority == nil {
+		return ErrNoCA
+	}
+
+	if host != "" {
+		cache.remove(host)
+		// the certificate generated with the other MirrorCertificates setting too
+		other := leafStore{dir: storeDir(c.storeRoot(), authority.Fingerprint(), !store.mirrored)}
+		if err := other.remove(host); err != nil {
+			return err
+		}
+		return store.remove(host)
+	}
+	cache.purge()
+	if err := os.RemoveAll(c.storeRoot()); err != nil {
+		return fmt.Errorf("delete stored certificates: %w", err)
+	}
+	return nil
+}
+
+// TLSConn creates a new TLS connection using the given config and connection signed for the specified host
+// (host:port). dial is used to fetch the certificate of the host if it is mirrored.
+func (c *Certificates) TLSConn(conn net.Conn, host string, dial Dialer) (*tls.Conn, error) {
+	cert, err := c.getTLSCert(host, dial)
 	if err != nil {
 		return nil, err
 	}
@@ -176,6 +421,7 @@ func (c *Certificates) TLSConn(conn net.Conn, host string) (*tls.Conn, error) {
 		MinVersion:               tls.VersionTLS10,
 		MaxVersion:               tls.VersionTLS13,
 		Certificates:             []tls.Certificate{cert},
+		NextProtos:               config.DefaultConfig.NextProtos(),
 	}
 	return tls.Server(conn, tlsConfig), nil
 }
@@ -0,0 +1,83 @@
+package certificate
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// mirrorTimeout is how long fetching the certificate of a host to mirror may take.
+const mirrorTimeout = 5 * time.Second
+
+// Dialer dials a host (host:port), the way the proxy would to send it requests (e.g. through an upstream proxy).
+type Dialer func(host string) (net.Conn, error)
+
+// splitHost returns the hostname of host (host:port, or a hostname alone), without the brackets of an IPv6
+// address.
+func splitHost(host string) string {
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	return strings.Trim(hostname, "[]")
+}
+
+// leafTemplate returns the template of a certificate for hostname. It has the names of upstream (the
+// certificate the host itself presents) if there is one, and always covers hostname: an IP address is put
+// in the IP addresses of the certificate, anything else in its DNS names.
+func leafTemplate(hostname string, upstream *x509.Certificate) *x509.Certificate {
+	template := &x509.Certificate{
+		Subject: pkix.Name{
+			Country:      []string{"US"},
+			Organization: []string{"N/A"},
+			CommonName:   hostname,
+		},
+	}
+	if upstream != nil {
+		template.Subject = upstream.Subject
+		template.DNSNames = upstream.DNSNames
+		template.IPAddresses = upstream.IPAddresses
+		template.URIs = upstream.URIs
+		template.EmailAddresses = upstream.EmailAddresses
+	}
+
+	// a mirrored certificate may not cover hostname, e.g. if the host is reached by another of its names
+	if template.VerifyHostname(hostname) != nil {
+		if ip := net.ParseIP(hostname); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, hostname)
+		}
+	}
+	return template
+}
+
+// fetchUpstreamCert returns the certificate host (host:port) presents, dialed with dial. It is not verified:
+// only its names are used, the client verifies the certificate it is given against the CA.
+func fetchUpstreamCert(dial Dialer, host string) (*x509.Certificate, error) {
+	conn, err := dial(host)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(mirrorTimeout))
+
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if hostname := splitHost(host); net.ParseIP(hostname) == nil {
+		cfg.ServerName = hostname
+	}
+	tlsconn := tls.Client(conn, cfg)
+	if err := tlsconn.Handshake(); err != nil {
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+	certs := tlsconn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("host presented no certificate")
+	}
+	return certs[0], nil
+}
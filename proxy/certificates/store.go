@@ -0,0 +1,128 @@
+package certificate
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// leafStore keeps the certificates of hosts (with their keys) on disk, so they survive restarts. Each CA has
+// its own directory, named after its fingerprint, so a certificate is only ever used with the CA that signed
+// it.
+type leafStore struct {
+	dir      string // the directory of the CA, "" if certificates are not stored
+	mirrored bool   // whether the certificates are mirrored (see storeDir)
+}
+
+// storeDir returns the directory the certificates signed by the CA with fingerprint are stored in, under root.
+// Mirrored certificates (see config.Config.MirrorCertificates) are stored apart from the others, so turning
+// mirroring on or off never serves a certificate made the other way.
+func storeDir(root, fingerprint string, mirrored bool) string {
+	if mirrored {
+		return filepath.Join(root, fingerprint[:16]+"-mirrored")
+	}
+	return filepath.Join(root, fingerprint[:16])
+}
+
+// path returns the file of the certificate of host. Hosts are escaped to be valid file names everywhere (IPv6
+// addresses have colons).
+func (s leafStore) path(host string) string {
+	return filepath.Join(s.dir, strings.ReplaceAll(url.PathEscape(host), ":", "%3A")+".pem")
+}
+
+// load loads the certificate of host.
+func (s leafStore) load(host string) (tls.Certificate, error) {
+	data, err := os.ReadFile(s.path(host))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("parse stored certificate of %s: %w", host, err)
+	}
+	return cert, nil
+}
+
+// save stores the certificate of host, in PEM (the certificate followed by its key).
+func (s leafStore) save(host string, certPEM, keyPEM []byte) error {
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("create certificate store: %w", err)
+	}
+	// written to a temporary file first so a certificate is never loaded half written
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("store certificate of %s: %w", host, err)
+	}
+	_, err = tmp.Write(append(append([]byte{}, certPEM...), keyPEM...))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path(host))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("store certificate of %s: %w", host, err)
+	}
+	return nil
+}
+
+// remove deletes the stored certificate of host, if there is one.
+func (s leafStore) remove(host string) error {
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.Remove(s.path(host)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// hosts returns the hosts with a stored certificate, most recently stored first.
+func (s leafStore) hosts() ([]string, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	type stored struct {
+		host    string
+		modTime int64
+	}
+	var files []stored
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".pem")
+		if !ok || e.IsDir() {
+			continue
+		}
+		host, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, stored{host, info.ModTime().UnixNano()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime > files[j].modTime })
+	hosts := make([]string, len(files))
+	for i, f := range files {
+		hosts[i] = f.host
+	}
+	return hosts, nil
+}
@@ -3,18 +3,21 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/url"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	nethttp "net/http"
 
+	"github.com/tiredkangaroo/cap/proxy/config"
 	"github.com/tiredkangaroo/cap/proxy/http"
+	"github.com/tiredkangaroo/cap/proxy/pool"
 	"github.com/tiredkangaroo/cap/proxy/timing"
 	"github.com/tiredkangaroo/websocket"
 )
@@ -23,8 +26,11 @@ import (
 // NOTE: consider using a method where messsage sending doesn't block for too long
 
 type Manager struct {
-	db      *Database
-	wsConns []*websocket.Conn
+	db        *Database
+	wsConns   []*websocket.Conn
+	wsConnsMu sync.Mutex
+	pool      *pool.Pool // idle connections to hosts
+	pinned    *pinnedHosts
 
 	approvalWaiters     map[string]*Request
 	approvalWaitersRWMu sync.RWMutex
@@ -42,10 +48,32 @@ func (c *Manager) AcceptWS(w nethttp.ResponseWriter, r *nethttp.Request) (*webso
 	if err != nil {
 		return nil, err
 	}
+	c.wsConnsMu.Lock()
 	c.wsConns = append(c.wsConns, conn)
+	c.wsConnsMu.Unlock()
 	return conn, nil
 }
 
+// RemoveWS closes a websocket connection and stops sending messages to it. Once the last one is gone, every
+// request waiting for approval is released (see waitApproval).
+func (c *Manager) RemoveWS(conn *websocket.Conn) {
+	conn.Close()
+	c.wsConnsMu.Lock()
+	c.wsConns = slices.DeleteFunc(c.wsConns, func(wc *websocket.Conn) bool { return wc == conn })
+	left := len(c.wsConns)
+	c.wsConnsMu.Unlock()
+
+	if left == 0 {
+		c.releaseApprovalWaiters()
+	}
+}
+
+func (c *Manager) wsConnCount() int {
+	c.wsConnsMu.Lock()
+	defer c.wsConnsMu.Unlock()
+	return len(c.wsConns)
+}
+
 func (c *Manager) setStateFunc(req *Request) func(state string) {
 	return func(state string) {
 		c.writeJSON("STATE", map[string]any{
@@ -58,13 +86,17 @@ func (c *Manager) setStateFunc(req *Request) func(state string) {
 func (c *Manager) SendNew(req *Request) {
 	c.writeJSON("NEW", map[string]any{
 		"id":                  req.ID,
+		"connectionID":        req.ConnectionID,
 		"datetime":            req.Datetime.UnixMilli(),
 		"host":                req.Host,
+		"inbound":             req.Inbound,
 		"secure":              req.Secure,
 		"clientIP":            req.ClientIP,
 		"clientAuthorization": req.ClientAuthorization,
+		"clientUser":          req.ClientUser,
 		"clientProcessID":     req.ClientProcessID,
 		"clientApplication":   req.ClientApplication,
+		"mitmBypass":          req.MITMBypass,
 	})
 }
 
@@ -74,6 +106,22 @@ func (c *Manager) SendTunnel(req *Request) {
 	})
 }
 
+// SendWebSocketOpen announces that the connection of the request was upgraded to WebSocket. Its frames
+// follow as WEBSOCKET-FRAME messages until the DONE (or ERROR) message of the request.
+func (c *Manager) SendWebSocketOpen(req *Request) {
+	c.writeJSON("WEBSOCKET-OPEN", IDMessage{
+		ID: req.ID,
+	})
+}
+
+func (c *Manager) SendWebSocketFrame(frame *WebSocketFrame) {
+	c.writeJSON("WEBSOCKET-FRAME", frame)
+}
+
+func (c *Manager) SendSSEEvent(event *SSEEvent) {
+	c.writeJSON("SSE-EVENT", event)
+}
+
 func (c *Manager) SendRequest(req *Request) {
 	c.writeJSON("REQUEST", map[string]any{
 		"id":               req.ID,
@@ -83,6 +131,9 @@ func (c *Manager) SendRequest(req *Request) {
 		"headers":          req.req.Header,
 		"bodyLength":       req.req.ContentLength,
 		"bytesTransferred": req.BytesTransferred(),
+		"proto":            req.Proto,
+		"rewrites":         req.Rewrites,
+		"clientTLS":        req.ClientTLS,
 	})
 }
 
@@ -92,6 +143,15 @@ func (c *Manager) SendResponse(req *Request) {
 		"statusCode": req.resp.StatusCode,
 		"headers":    req.resp.Header,
 		"bodyLength": req.resp.ContentLength,
+		"proto":      req.UpstreamProto,
+		"rewrites":   req.Rewrites,
+		"mocked":     req.Mocked,
+
+		"upstreamHost":   req.UpstreamHost,
+		"upstreamSecure": req.UpstreamSecure,
+		"mapRemoteRule":  req.MapRemoteRuleID,
+		"upstreamProxy":  req.UpstreamProxy,
+		"upstreamTLS":    req.UpstreamTLS,
 	})
 }
 
@@ -121,37 +181,164 @@ func (c *Manager) SendError(req *Request, err error) {
 	})
 }
 
-// RecieveApproval waits for an approval request from the client. It blocks until the client approves or cancels the request.
-// If the client approves, it returns true, otherwise it returns false.
-func (c *Manager) RecieveApproval(req *Request) (approved bool) {
+// SendRejected saves a rejected client connection and lets live websocket connections know about it.
+func (c *Manager) SendRejected(req *Request, err error) {
+	if e := c.db.SaveRequest(req, err); e != nil {
+		slog.Error("saving rejected connection to database", "err", e.Error(), "request_id", req.ID)
+	}
+	c.writeJSON("REJECTED", map[string]any{
+		"id":                  req.ID,
+		"connectionID":        req.ConnectionID,
+		"datetime":            req.Datetime.UnixMilli(),
+		"host":                req.Host,
+		"inbound":             req.Inbound,
+		"secure":              req.Secure,
+		"clientIP":            req.ClientIP,
+		"clientAuthorization": req.ClientAuthorization,
+		"clientApplication":   req.ClientApplication,
+		"error":               err.Error(),
+	})
+}
+
+// SendCanceled lets live websocket connections know the request was canceled without waiting for approval
+// (by an intercept rule).
+func (c *Manager) SendCanceled(req *Request) {
+	c.writeJSON("APPROVAL-CANCELED", IDMessage{
+		ID: req.ID,
+	})
+}
+
+// Approval is the outcome of waiting for approval.
+type Approval int
+
+const (
+	ApprovalCanceled Approval = iota
+	ApprovalApproved
+	// ApprovalRespond is the outcome of a request that was not approved in time, when the client is to be
+	// answered with an error response instead (see config.ApprovalTimeoutRespond).
+	ApprovalRespond
+)
+
+// RecieveApproval waits for an approval request from the client. It blocks until the client approves or cancels the
+// request, or until the approval times out.
+func (c *Manager) RecieveApproval(req *Request) Approval {
 	req.timing.Substart(timing.SubtimeWaitApproval)
 	defer req.timing.Substop()
-	ctx, cancel := context.WithCancel(context.Background())
+	req.reqPreview = previewBody(req.req.Body)
+	return c.waitApproval(req, "APPROVAL-WAIT", map[string]any{
+		"id": req.ID,
+	})
+}
+
+// RecieveResponseApproval waits for an approval to forward the response of the request to the client. The response
+// can be edited (UPDATE-RESPONSE) while waiting.
+func (c *Manager) RecieveResponseApproval(req *Request) Approval {
+	req.timing.Substart(timing.SubtimeWaitResponseApproval)
+	defer req.timing.Substop()
+	req.respPreview = previewBody(req.resp.Body)
+	return c.waitApproval(req, "RESPONSE-APPROVAL-WAIT", map[string]any{
+		"id":         req.ID,
+		"statusCode": req.resp.StatusCode,
+		"headers":    req.resp.Header,
+		"bodyLength": req.resp.ContentLength,
+	})
+}
+
+// maxPreviewBodySize is the largest body shown while its exchange waits for approval.
+const maxPreviewBodySize = 16 << 20
+
+// previewBody reads body in full and returns it, to be shown while its exchange waits for approval (the
+// control server never reads a body the exchange will send itself). It returns nil if the body is too large
+// or its length is unknown, as it may be a stream that never ends.
+func previewBody(body *http.Body) []byte {
+	if body == nil || body.ContentLength() < 0 || body.ContentLength() > maxPreviewBodySize {
+		return nil
+	}
+	data, err := io.ReadAll(body) // the next read of the body replays it from the start
+	if err != nil {
+		slog.Error("failed to read body to preview", "err", err.Error())
+		return nil
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	return data
+}
+
+// waitApproval sends the wait action with data to live websocket connections and blocks until the client approves
+// or cancels the request (APPROVAL-APPROVE or APPROVAL-CANCEL). If the approval times out, or if there is no live
+// websocket connection left to approve it, the configured timeout action is taken instead (APPROVAL-TIMEOUT).
+func (c *Manager) waitApproval(req *Request, waitAction string, data map[string]any) Approval {
+	result := make(chan Approval, 1)
+	req.approveResponseFunc = func(approval Approval) {
+		result <- approval
+	}
 
 	c.approvalWaitersRWMu.Lock()
 	c.approvalWaiters[req.ID] = req
 	c.approvalWaitersRWMu.Unlock()
 
-	req.approveResponseFunc = func(approval bool) {
-		defer cancel()
-		approved = approval
-		if approved {
-			c.writeJSON("APPROVAL-RECIEVED", IDMessage{
-				ID: req.ID,
-			})
-		} else {
-			c.writeJSON("APPROVAL-CANCELED", IDMessage{
-				ID: req.ID,
-			})
-		}
+	var expired <-chan time.Time
+	if timeout := config.DefaultConfig.ApprovalTimeoutDuration(); timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+		data["timeout"] = timeout.Milliseconds()
+		data["deadline"] = time.Now().Add(timeout).UnixMilli() // unix milli for js
 	}
+	data["timeoutAction"] = config.DefaultConfig.ApprovalTimeoutDefaultAction()
+	c.writeJSON(waitAction, data)
 
-	c.writeJSON("APPROVAL-WAIT", IDMessage{
-		ID: req.ID,
+	if c.wsConnCount() == 0 {
+		c.expireApproval(req.ID) // nobody is there to approve it
+	}
+
+	select {
+	case approval := <-result:
+		return approval
+	case <-expired:
+		c.expireApproval(req.ID)
+		return <-result // the client may have approved or canceled it just in time
+	}
+}
+
+// expireApproval takes the timeout action on the request with the id if it is still waiting for approval.
+func (c *Manager) expireApproval(id string) {
+	c.approvalWaitersRWMu.Lock()
+	req, ok := c.approvalWaiters[id]
+	delete(c.approvalWaiters, id)
+	c.approvalWaitersRWMu.Unlock()
+	if !ok {
+		return // already approved or canceled
+	}
+
+	action := config.DefaultConfig.ApprovalTimeoutDefaultAction()
+	c.writeJSON("APPROVAL-TIMEOUT", map[string]any{
+		"id":     id,
+		"action": action,
 	})
+	switch action {
+	case config.ApprovalTimeoutApprove:
+		req.approveResponseFunc(ApprovalApproved)
+	case config.ApprovalTimeoutRespond:
+		req.approveResponseFunc(ApprovalRespond)
+	default:
+		req.approveResponseFunc(ApprovalCanceled)
+	}
+}
+
+// releaseApprovalWaiters takes the timeout action on every request waiting for approval.
+func (c *Manager) releaseApprovalWaiters() {
+	c.approvalWaitersRWMu.RLock()
+	ids := make([]string, 0, len(c.approvalWaiters))
+	for id := range c.approvalWaiters {
+		ids = append(ids, id)
+	}
+	c.approvalWaitersRWMu.RUnlock()
 
-	<-ctx.Done()
-	return approved
+	for _, id := range ids {
+		c.expireApproval(id)
+	}
 }
 
 func (c *Manager) HandleMessage(msg *websocket.Message) {
@@ -173,6 +360,8 @@ func (c *Manager) HandleMessage(msg *websocket.Message) {
 		c.handleApprovalCancel(data)
 	case "UPDATE-REQUEST":
 		c.handleUpdateRequest(data)
+	case "UPDATE-RESPONSE":
+		c.handleUpdateResponse(data)
 	}
 }
 
@@ -182,7 +371,10 @@ func (c *Manager) handleApprovalApprove(data []byte) {
 		// handle error: request not found
 		return
 	}
-	req.approveResponseFunc(true)
+	c.writeJSON("APPROVAL-RECIEVED", IDMessage{
+		ID: req.ID,
+	})
+	req.approveResponseFunc(ApprovalApproved)
 }
 
 func (c *Manager) handleApprovalCancel(data []byte) {
@@ -191,11 +383,13 @@ func (c *Manager) handleApprovalCancel(data []byte) {
 		// handle error: request not found
 		return
 	}
-	req.approveResponseFunc(false)
+	c.writeJSON("APPROVAL-CANCELED", IDMessage{
+		ID: req.ID,
+	})
+	req.approveResponseFunc(ApprovalCanceled)
 }
 
 func (c *Manager) handleUpdateRequest(data []byte) {
-	fmt.Println("166", string(data))
 	type updatedMessageType struct {
 		IDMessage
 		Request struct {
@@ -217,8 +411,8 @@ func (c *Manager) handleUpdateRequest(data []byte) {
 	c.approvalWaitersRWMu.RLock()
 	defer c.approvalWaitersRWMu.RUnlock()
 	req, ok := c.approvalWaiters[updatedMessage.ID]
-	if !ok {
-		// handle error: request not found
+	if !ok || req.resp != nil {
+		// the request is not waiting for approval, or it is waiting for response approval (it was sent already)
 		return
 	}
 	// if req.req.Body != nil {
@@ -226,25 +420,10 @@ func (c *Manager) handleUpdateRequest(data []byte) {
 	// }
 
 	req.Secure = updatedMessage.Request.Secure
-
-	fmt.Println("old method", req.req.Method.String())
-	fmt.Println("new method", updatedMessage.Request.Method)
 	req.req.Method = http.MethodFromString(updatedMessage.Request.Method)
-
-	fmt.Println("old host", req.req.Host)
-	fmt.Println("new host", updatedMessage.Request.Host)
-	req.req.Host = updatedMessage.Request.Host //
-
-	fmt.Println("old path", req.req.Path)
-	fmt.Println("new path", updatedMessage.Request.Path)
+	req.req.Host = updatedMessage.Request.Host
 	req.req.Path = updatedMessage.Request.Path
-
-	fmt.Println("old query", req.req.Query)
-	fmt.Println("new query", updatedMessage.Request.Query)
 	req.req.Query = updatedMessage.Request.Query
-
-	fmt.Println("old headers", req.req.Header)
-	fmt.Println("new headers", updatedMessage.Request.Headers)
 	req.req.Header = updatedMessage.Request.Headers // possible nil pointer dereference if headers are not set
 
 	if updatedMessage.Request.Body != "" {
@@ -252,11 +431,56 @@ func (c *Manager) handleUpdateRequest(data []byte) {
 			req.req.Body.CloseBody()
 		}
 		req.req.ContentLength = int64(len(updatedMessage.Request.Body)) // change content length to reflect the length of the new body
+		req.req.Header.Del("Transfer-Encoding")                         // the new body is sent with a Content-Length, not chunked
 		req.req.Header.Set("Content-Length", fmt.Sprintf("%d", req.req.ContentLength))
 		req.req.Body = http.NewBody(bufio.NewReader(strings.NewReader(updatedMessage.Request.Body)), int64(len(updatedMessage.Request.Body)))
 	}
 }
 
+// handleUpdateResponse edits the response of a request waiting for response approval.
+func (c *Manager) handleUpdateResponse(data []byte) {
+	type updatedMessageType struct {
+		IDMessage
+		Response struct {
+			StatusCode int         `json:"statusCode"`
+			Headers    http.Header `json:"headers"`
+			Body       *string     `json:"tempBody"`
+		} `json:"response"`
+	}
+	updatedMessage, err := expectJSON[updatedMessageType](data)
+	if err != nil {
+		slog.Error("invalid update response message", "err", err.Error())
+		return
+	}
+
+	c.approvalWaitersRWMu.RLock()
+	defer c.approvalWaitersRWMu.RUnlock()
+	req, ok := c.approvalWaiters[updatedMessage.ID]
+	if !ok || req.resp == nil {
+		// the request is not waiting for response approval
+		return
+	}
+
+	if updatedMessage.Response.StatusCode != 0 {
+		req.resp.StatusCode = updatedMessage.Response.StatusCode
+	}
+	if updatedMessage.Response.Headers != nil {
+		req.resp.Header = updatedMessage.Response.Headers
+	}
+	if body := updatedMessage.Response.Body; body != nil {
+		// the host's body is not forwarded, unless it was already read in full the host connection cannot
+		// be reused (see releaseHostConn)
+		req.resp.Body.Truncate()
+		req.resp.Body.CloseBody()
+		req.resp.ContentLength = int64(len(*body))
+		req.resp.CloseDelimited = false
+		req.resp.Header.Del("Transfer-Encoding") // the new body is sent with a Content-Length, not chunked
+		req.resp.Header.Set("Content-Length", fmt.Sprintf("%d", req.resp.ContentLength))
+		req.resp.Body = http.NewBody(bufio.NewReader(strings.NewReader(*body)), req.resp.ContentLength)
+	}
+	c.SendResponse(req)
+}
+
 // getApprovalWaitingRequestFromIDMessage retrieves the request associated with the given ID message with the map
 // for approval waiters. It returns the request and a boolean indicating success. It will delete the request from the map
 // if it is found.
@@ -287,7 +511,10 @@ func (c *Manager) writeJSON(action string, data any) {
 
 func (c *Manager) workOnJSONMessageTextQueue() {
 	for data := range c.jsonMessageTextQueue {
-		for _, conn := range c.wsConns {
+		c.wsConnsMu.Lock()
+		conns := slices.Clone(c.wsConns)
+		c.wsConnsMu.Unlock()
+		for _, conn := range conns {
 			conn.Write(&websocket.Message{
 				Type: websocket.MessageText,
 				Data: data,
@@ -309,6 +536,8 @@ func expectJSON[T any](data []byte) (T, error) {
 func NewManager(db *Database) *Manager {
 	m := &Manager{
 		db:                   db,
+		pool:                 pool.New(),
+		pinned:               newPinnedHosts(),
 		wsConns:              make([]*websocket.Conn, 0, 8),
 		approvalWaiters:      make(map[string]*Request, 24),
 		jsonMessageTextQueue: make(chan []byte, 250),
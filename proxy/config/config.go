@@ -2,18 +2,34 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
+
+	"github.com/tiredkangaroo/cap/proxy/auth"
+	"github.com/tiredkangaroo/cap/proxy/mock"
+	"github.com/tiredkangaroo/cap/proxy/remote"
+	"github.com/tiredkangaroo/cap/proxy/rewrite"
+	"github.com/tiredkangaroo/cap/proxy/rules"
+	"github.com/tiredkangaroo/cap/proxy/upstream"
 )
 
 var DefaultConfig = &Config{}
 
-const proxy_config_file = "PROXY_CONFIG_FILE"
+const (
+	proxy_config_file = "PROXY_CONFIG_FILE"
+	proxy_listen      = "PROXY_LISTEN"
+	control_listen    = "CONTROL_LISTEN"
+)
 
 // Config is the configuration for the proxy.
 type Config struct {
@@ -25,6 +41,19 @@ type Config struct {
 	// CertificateLifetime is the lifetime of the certificate in hours. It is possible
 	// to set it to less than 0 in which any new certificates generated will NEVER be valid.
 	CertificateLifetime int `json:"certificate_lifetime"`
+	// CAKeyType is the type of the key of the CA the proxy generates, on first run (when there is no CA) or
+	// when it is rotated: "ecdsa" (P-256) or "rsa" (4096 bits). If it is empty, "ecdsa" is used.
+	CAKeyType string `json:"ca_key_type"`
+	// CAValidity is how long, in days, the CA the proxy generates is valid. If it is 0, it is valid for 3650
+	// days (~10 years).
+	CAValidity uint `json:"ca_validity"`
+	// CertificateCacheSize is the maximum number of certificates of hosts kept in memory. The least recently
+	// used ones are evicted first (they are still stored on disk, next to the CA). If it is 0, 1000 are kept.
+	CertificateCacheSize uint `json:"certificate_cache_size"`
+	// MirrorCertificates makes the certificates generated for hosts mirror the ones the hosts present: the
+	// proxy fetches the certificate of a host first and copies its subject and names (DNS names, wildcards
+	// and IP addresses). If fetching it fails, the certificate only has the name the host was reached by.
+	MirrorCertificates bool `json:"mirror_certificates"`
 	// MITM determines who is responsible for the TLS connection. If true, the responsibility
 	// is on the proxy. If false, the responsibility is on the client.
 	//
@@ -32,6 +61,11 @@ type Config struct {
 	// it is more resource intensive to generate and store the certificates for each host, perform a
 	// TLS handshake as well as to decrypt the traffic, reencrypt it, move requests and responses.
 	MITM bool `json:"mitm"`
+	// MITMInclude and MITMExclude are globs (see rules.MatchHost) of the hosts MITM applies to: if MITMInclude
+	// is not empty, only the hosts matching it are MITM'd, and the hosts matching MITMExclude never are (e.g.
+	// apps that pin their certificates). The connections to the other hosts are tunneled.
+	MITMInclude []string `json:"mitm_include"`
+	MITMExclude []string `json:"mitm_exclude"`
 	// PerformDelay is the delay in milliseconds before the proxy performs the request. It must be a positive
 	// integer. This can be useful for testing purposes, such as simulating network latency, slowing down
 	// actions performed, or other debugging purposes.
@@ -45,6 +79,46 @@ type Config struct {
 	// or for security purposes, such as ensuring that the request is safe to perform.
 	RequireApproval bool `json:"require_approval"`
 
+	// RequireResponseApproval is a boolean that determines whether the proxy should require approval to forward
+	// responses to the client. If true, the proxy will wait for an approval after reading the response head from
+	// the host, during which the response can be edited. Canceling it closes the client connection.
+	//
+	// This is useful for testing how clients handle responses the host does not normally send, such as errors.
+	RequireResponseApproval bool `json:"require_response_approval"`
+
+	// InterceptRules decide, in order, whether a request is intercepted (paused for approval), approved or
+	// canceled. The first rule that matches a request wins. Requests that no rule matches are intercepted
+	// only if RequireApproval is true. Rules that approve a request also skip RequireResponseApproval.
+	InterceptRules []rules.Rule `json:"intercept_rules"`
+
+	// ApprovalTimeout is the time in seconds a request (or response) waits for approval before the
+	// ApprovalTimeoutAction is taken. If it is 0, it waits until it is approved or canceled. The action is also
+	// taken once no client is connected to the control server to approve it.
+	ApprovalTimeout uint `json:"approval_timeout"`
+	// ApprovalTimeoutAction is what happens to a request (or response) that was not approved in time:
+	// ApprovalTimeoutApprove, ApprovalTimeoutCancel or ApprovalTimeoutRespond. If it is empty, it is canceled.
+	ApprovalTimeoutAction string `json:"approval_timeout_action"`
+
+	// RewriteRules are match-and-replace rules applied, in order, to every request before it is sent to the
+	// host and to every response before it is forwarded to the client. The rules applied to a request are
+	// recorded with it.
+	RewriteRules []rewrite.Rule `json:"rewrite_rules"`
+
+	// MockRules answer, in order, the requests they match with a response built from a local file, a
+	// directory or an inline template, without the host being dialed (Map Local). The first rule that matches
+	// a request wins. Mocked requests are still intercepted, rewritten and recorded, marked as mocked.
+	MockRules []mock.Rule `json:"mock_rules"`
+
+	// MapRemoteRules send, in order, the requests they match to a different host, port or scheme than the
+	// one the client sent them to (Map Remote). The first rule that matches a request wins. Where a request
+	// was sent is recorded with it.
+	MapRemoteRules []remote.Rule `json:"map_remote_rules"`
+
+	// UpstreamProxies are the proxies traffic is sent through instead of directly (proxy chaining), e.g. when
+	// a network requires all egress to go through a corporate proxy. Traffic to a host goes through the first
+	// proxy that applies to it, both for requests and for tunnels. It is sent directly if none does.
+	UpstreamProxies []upstream.Proxy `json:"upstream_proxies"`
+
 	ProvideRequestBody  bool `json:"provide_request_body"`
 	ProvideResponseBody bool `json:"provide_response_body"`
 
@@ -60,6 +134,261 @@ type Config struct {
 	// based on timeline events. If true, the proxy will send updates to the client whenever a major or minor timeline event
 	// occurs.
 	TimelineBasedStateUpdates bool `json:"timeline_based_state_updates"`
+
+	// DisableKeepAlive is a boolean that determines whether client connections are closed after a single
+	// request. If false, clients can send more requests over the same connection (and over the same TLS
+	// session for MITM'd connections), and each request is captured as its own exchange.
+	DisableKeepAlive bool `json:"disable_keep_alive"`
+	// KeepAliveTimeout is the time in seconds a persistent client connection may stay idle between requests
+	// before the proxy closes it. If it is 0, a timeout of 60 seconds is used.
+	KeepAliveTimeout uint `json:"keep_alive_timeout"`
+
+	// DisableUpstreamPooling is a boolean that determines whether connections to hosts are closed after a single
+	// request. If false, idle connections are kept per host (and TLS config) and reused by later requests.
+	DisableUpstreamPooling bool `json:"disable_upstream_pooling"`
+	// MaxIdleUpstreamConns is the maximum number of idle connections kept per host. If it is 0, 4 are kept.
+	MaxIdleUpstreamConns uint `json:"max_idle_upstream_conns"`
+	// UpstreamIdleTimeout is the time in seconds an idle connection to a host is kept before it is closed. If
+	// it is 0, a timeout of 90 seconds is used.
+	UpstreamIdleTimeout uint `json:"upstream_idle_timeout"`
+
+	// DisableHTTP2 is a boolean that determines whether the proxy offers HTTP/2 (via ALPN) to clients of MITM'd
+	// connections and to hosts. If false, HTTP/2 is used on either side whenever the other end supports it, and
+	// each HTTP/2 stream is captured as its own request.
+	DisableHTTP2 bool `json:"disable_http2"`
+
+	// ProxyListen are the addresses the proxy listens on: host:port ([::1]:8000 for IPv6, :8000 for every
+	// interface) or unix:/path/to/socket for a Unix domain socket. If it is empty, it listens on :8000. It can
+	// be overridden with the PROXY_LISTEN environment variable (comma-separated) or the --listen flag.
+	//
+	// The addresses of every listener (ProxyListen, ControlListen, SOCKSPort and TransparentPort) take effect
+	// as soon as the config is changed, without restarting the proxy.
+	ProxyListen []string `json:"proxy_listen"`
+	// ControlListen is the address the control server listens on, in the same form as ProxyListen. If it is
+	// empty, it listens on :8001. It can be overridden with the CONTROL_LISTEN environment variable or the
+	// --control-listen flag.
+	ControlListen string `json:"control_listen"`
+
+	// SOCKSPort is the port of the SOCKS listener, which accepts SOCKS5 and SOCKS4a connections alongside the
+	// HTTP proxy listener. The streams tunneled through it are sniffed: HTTP and TLS (MITM'd like a CONNECT
+	// request) are captured as requests, anything else is tunneled as is. If it is 0, there is no SOCKS
+	// listener.
+	SOCKSPort uint16 `json:"socks_port"`
+	// TransparentPort is the port of the transparent listener, which accepts connections redirected to it by
+	// iptables (REDIRECT or TPROXY, on Linux only) for clients that ignore proxy settings. Their streams are
+	// served like those of the SOCKS listener, to the destination the client originally connected to. If it is
+	// 0, there is no transparent listener.
+	TransparentPort uint16 `json:"transparent_port"`
+
+	// ProxyAuth is a boolean that determines whether clients of the HTTP proxy and SOCKS listeners must
+	// authenticate as one of the ProxyUsers: with Basic or Bearer credentials in a Proxy-Authorization header
+	// (a 407 Proxy Authentication Required response challenges those that do not), or with a SOCKS5
+	// username and password. The name of the user is recorded with each request instead of its credentials.
+	// Clients of the transparent listener and of a reverse proxy cannot authenticate, they are always allowed.
+	ProxyAuth bool `json:"proxy_auth"`
+	// ProxyUsers are the users allowed to use the proxy when ProxyAuth is true.
+	ProxyUsers []auth.User `json:"proxy_users"`
+
+	// ClientAllow and ClientDeny are the IP addresses and CIDR ranges of the clients allowed and denied to
+	// connect to the proxy (through any of its listeners). A client in ClientDeny is always rejected, and if
+	// ClientAllow is not empty, a client that is not in it is rejected too. Clients of Unix domain sockets
+	// are always allowed.
+	ClientAllow []string `json:"client_allow"`
+	ClientDeny  []string `json:"client_deny"`
+	// MaxConns is the maximum number of client connections served at the same time, and MaxConnsPerClient the
+	// maximum number from the same client IP. Connections over either limit are rejected. There is no limit
+	// if it is 0.
+	MaxConns          uint `json:"max_conns"`
+	MaxConnsPerClient uint `json:"max_conns_per_client"`
+
+	// ClientIdleTimeout is the time in seconds a new client connection may stay idle before it sends its
+	// first request. If it is 0, a timeout of 30 seconds is used. (KeepAliveTimeout applies to the requests
+	// after the first one.)
+	ClientIdleTimeout uint `json:"client_idle_timeout"`
+	// RequestReadTimeout is the time in seconds a client has to send the head (request line and headers) of a
+	// request once it started sending it. If it is 0, a timeout of 30 seconds is used.
+	RequestReadTimeout uint `json:"request_read_timeout"`
+
+	// ReverseProxy runs the proxy as a reverse proxy in front of a single backend instead of as a forward
+	// proxy: the proxy listener takes origin-form requests, as if it was the backend, and sends every one of
+	// them to the backend. It is set from the command line (--reverse, --cert, --key and --preserve-host) and
+	// never saved, so a proxy started without --reverse is a forward proxy again.
+	ReverseProxy ReverseProxy `json:"-"`
+}
+
+// ErrInvalidReverseTarget is returned for a reverse proxy target that is not an http:// or https:// URL.
+var ErrInvalidReverseTarget = errors.New("reverse proxy target must be an http:// or https:// url with a host (and no query)")
+
+// ReverseProxy is the configuration of reverse proxy mode.
+type ReverseProxy struct {
+	// Target is the URL of the backend, e.g. http://localhost:3000. Its path, if any, is prefixed to the path
+	// of every request (e.g. /users is sent to http://localhost:3000/api as /api/users). Reverse proxy mode is
+	// disabled if it is empty.
+	Target string
+	// CertFile and KeyFile are the PEM encoded certificate and key TLS is terminated with. Clients speak plain
+	// HTTP to the proxy if they are empty.
+	CertFile string
+	KeyFile  string
+	// PreserveHost keeps the Host header clients send instead of setting it to the host of the backend.
+	PreserveHost bool
+}
+
+// Enabled reports whether the proxy runs as a reverse proxy.
+func (r ReverseProxy) Enabled() bool {
+	return r.Target != ""
+}
+
+// Backend returns the host (host:port) of the backend and whether it is spoken to over TLS.
+func (r ReverseProxy) Backend() (string, bool, error) {
+	u, err := url.Parse(r.Target)
+	if err != nil {
+		return "", false, fmt.Errorf("%w: %w", ErrInvalidReverseTarget, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", false, ErrInvalidReverseTarget
+	}
+	secure := u.Scheme == "https"
+	if u.Port() != "" {
+		return u.Host, secure, nil
+	}
+	if secure {
+		return net.JoinHostPort(u.Hostname(), "443"), true, nil
+	}
+	return net.JoinHostPort(u.Hostname(), "80"), false, nil
+}
+
+// BasePath returns the path of the backend URL without its trailing slash, or "" if it has none.
+func (r ReverseProxy) BasePath() string {
+	u, err := url.Parse(r.Target)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+const (
+	// ApprovalTimeoutApprove performs the request (or forwards the response) as if it was approved.
+	ApprovalTimeoutApprove = "approve"
+	// ApprovalTimeoutCancel cancels the request (or response) as if it was canceled.
+	ApprovalTimeoutCancel = "cancel"
+	// ApprovalTimeoutRespond responds to the client with a 504 Gateway Timeout instead.
+	ApprovalTimeoutRespond = "respond"
+)
+
+// ProxyListenAddresses returns the addresses the proxy listens on.
+func (c *Config) ProxyListenAddresses() []string {
+	if len(c.ProxyListen) == 0 {
+		return []string{":8000"}
+	}
+	return c.ProxyListen
+}
+
+// ControlListenAddress returns the address the control server listens on.
+func (c *Config) ControlListenAddress() string {
+	if c.ControlListen == "" {
+		return ":8001"
+	}
+	return c.ControlListen
+}
+
+// ApprovalTimeoutDuration returns how long a request waits for approval, 0 if it waits indefinitely.
+func (c *Config) ApprovalTimeoutDuration() time.Duration {
+	return time.Duration(c.ApprovalTimeout) * time.Second
+}
+
+// ApprovalTimeoutDefaultAction returns the action taken on a request that was not approved in time.
+func (c *Config) ApprovalTimeoutDefaultAction() string {
+	switch c.ApprovalTimeoutAction {
+	case ApprovalTimeoutApprove, ApprovalTimeoutRespond:
+		return c.ApprovalTimeoutAction
+	default:
+		return ApprovalTimeoutCancel
+	}
+}
+
+// NextProtos returns the ALPN protocols the proxy offers on TLS connections, in order of preference.
+func (c *Config) NextProtos() []string {
+	if c.DisableHTTP2 {
+		return []string{"http/1.1"}
+	}
+	return []string{"h2", "http/1.1"}
+}
+
+// KeepAliveDuration returns the idle timeout for persistent client connections.
+func (c *Config) KeepAliveDuration() time.Duration {
+	if c.KeepAliveTimeout == 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(c.KeepAliveTimeout) * time.Second
+}
+
+// CAValidityDuration returns how long a generated CA is valid.
+func (c *Config) CAValidityDuration() time.Duration {
+	if c.CAValidity == 0 {
+		return 3650 * 24 * time.Hour
+	}
+	return time.Duration(c.CAValidity) * 24 * time.Hour
+}
+
+// MITMHost reports whether the connections to host (host:port) are MITM'd when MITM is enabled, according to
+// MITMInclude and MITMExclude.
+func (c *Config) MITMHost(host string) bool {
+	included := len(c.MITMInclude) == 0
+	for _, glob := range c.MITMInclude {
+		if rules.MatchHost(glob, host) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, glob := range c.MITMExclude {
+		if rules.MatchHost(glob, host) {
+			return false
+		}
+	}
+	return true
+}
+
+// CertificateCacheCapacity returns the maximum number of certificates of hosts kept in memory.
+func (c *Config) CertificateCacheCapacity() int {
+	if c.CertificateCacheSize == 0 {
+		return 1000
+	}
+	return int(c.CertificateCacheSize)
+}
+
+// ClientIdleDuration returns the time a new client connection may stay idle before its first request.
+func (c *Config) ClientIdleDuration() time.Duration {
+	if c.ClientIdleTimeout == 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.ClientIdleTimeout) * time.Second
+}
+
+// RequestReadDuration returns the time a client has to send the head of a request.
+func (c *Config) RequestReadDuration() time.Duration {
+	if c.RequestReadTimeout == 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.RequestReadTimeout) * time.Second
+}
+
+// MaxIdleUpstreamConnsPerHost returns the maximum number of idle connections kept per host.
+func (c *Config) MaxIdleUpstreamConnsPerHost() int {
+	if c.MaxIdleUpstreamConns == 0 {
+		return 4
+	}
+	return int(c.MaxIdleUpstreamConns)
+}
+
+// UpstreamIdleDuration returns how long an idle connection to a host is kept.
+func (c *Config) UpstreamIdleDuration() time.Duration {
+	if c.UpstreamIdleTimeout == 0 {
+		return 90 * time.Second
+	}
+	return time.Duration(c.UpstreamIdleTimeout) * time.Second
 }
 
 func init() {
@@ -92,10 +421,27 @@ func init() {
 	if err := setConfigFromFile(file, DefaultConfig); err != nil {
 		slog.Error("setting config from file specified", "specified_file", proxy_config_file, "err", err.Error())
 	}
+	if v := os.Getenv(proxy_listen); v != "" {
+		DefaultConfig.ProxyListen = SplitAddresses(v)
+	}
+	if v := os.Getenv(control_listen); v != "" {
+		DefaultConfig.ControlListen = v
+	}
 
 	saveConfigFile(file, DefaultConfig)
 }
 
+// SplitAddresses splits a comma-separated list of listen addresses.
+func SplitAddresses(s string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
 func setConfigFromFile(file *os.File, config *Config) error {
 	rf, err := io.ReadAll(file)
 	if err != nil {
@@ -0,0 +1,42 @@
+package config
+
+import "sync"
+
+// rulesMu guards the rule lists of DefaultConfig (e.g. InterceptRules): the control server changes them while
+// requests are matched against them.
+var rulesMu sync.RWMutex
+
+// Rules returns the rule list at list, a field of DefaultConfig. A list is never modified once it is stored,
+// so the one returned can be used after the call.
+func Rules[R any](list *[]R) []R {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	return *list
+}
+
+// UpdateRules replaces the rule list at list, a field of DefaultConfig, with the one update returns from it,
+// unless it returns an error. update must not modify the list it is given.
+func UpdateRules[R any](list *[]R, update func([]R) ([]R, error)) error {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	rs, err := update(*list)
+	if err != nil {
+		return err
+	}
+	*list = rs
+	return nil
+}
+
+// Replace replaces DefaultConfig with c.
+func Replace(c Config) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	*DefaultConfig = c
+}
+
+// Current returns a copy of DefaultConfig, whose rule lists are not changed while it is copied.
+func Current() Config {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	return *DefaultConfig
+}
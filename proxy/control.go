@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -9,9 +11,17 @@ import (
 
 	nethttp "net/http"
 	_ "net/http/pprof"
+	"slices"
 	"strconv"
+	"sync"
 
+	"github.com/tiredkangaroo/cap/proxy/ca"
 	"github.com/tiredkangaroo/cap/proxy/config"
+	"github.com/tiredkangaroo/cap/proxy/mock"
+	"github.com/tiredkangaroo/cap/proxy/remote"
+	"github.com/tiredkangaroo/cap/proxy/rewrite"
+	"github.com/tiredkangaroo/cap/proxy/rules"
+	"github.com/tiredkangaroo/cap/proxy/upstream"
 	"github.com/tiredkangaroo/websocket"
 )
 
@@ -19,6 +29,7 @@ import (
 
 func startControlServer(m *Manager, ph *ProxyHandler) {
 	mux := nethttp.NewServeMux()
+	cs := &controlServer{handler: mux}
 
 	if config.DefaultConfig.Debug {
 		slog.Info("debug mode enabled")
@@ -35,7 +46,7 @@ func startControlServer(m *Manager, ph *ProxyHandler) {
 	mux.HandleFunc("GET /config", func(w nethttp.ResponseWriter, r *nethttp.Request) {
 		setCORSHeaders(w)
 
-		data, err := json.Marshal(config.DefaultConfig)
+		data, err := json.Marshal(config.Current())
 		if err != nil {
 			w.WriteHeader(500)
 			w.Write([]byte("failed to marshal config"))
@@ -67,11 +78,47 @@ func startControlServer(m *Manager, ph *ProxyHandler) {
 			return
 		}
 
-		*config.DefaultConfig = newConfig
+		// the rules are checked (and given IDs) as when they are set from their own endpoints
+		if errs := prepareRuleLists(&newConfig); len(errs) > 0 {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			w.Write([]byte(errs[0].Error()))
+			return
+		}
+
+		// rebind the listeners whose addresses changed, before the config that has them is used
+		if err := ph.Listen(&newConfig); err != nil {
+			ph.Listen(config.DefaultConfig) // put back the listeners that already changed
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err := cs.Listen(newConfig.ControlListenAddress()); err != nil {
+			ph.Listen(config.DefaultConfig)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		newConfig.ReverseProxy = config.DefaultConfig.ReverseProxy // only set from the command line
+		config.Replace(newConfig)
 		w.WriteHeader(nethttp.StatusOK)
 		w.Write([]byte("config updated"))
 	})
 
+	handleRuleList(mux, "/rules", &config.DefaultConfig.InterceptRules, (*rules.Rule).Validate,
+		func(r *rules.Rule) *string { return &r.ID })
+	handleRuleList(mux, "/rewrites", &config.DefaultConfig.RewriteRules, (*rewrite.Rule).Validate,
+		func(r *rewrite.Rule) *string { return &r.ID })
+	handleRuleList(mux, "/mocks", &config.DefaultConfig.MockRules, (*mock.Rule).Validate,
+		func(r *mock.Rule) *string { return &r.ID })
+	handleRuleList(mux, "/remotes", &config.DefaultConfig.MapRemoteRules, (*remote.Rule).Validate,
+		func(r *remote.Rule) *string { return &r.ID })
+	handleRuleList(mux, "/upstreams", &config.DefaultConfig.UpstreamProxies, (*upstream.Proxy).Validate,
+		func(p *upstream.Proxy) *string { return &p.ID })
+
+	handleCA(mux, ph)
+	handlePinnedHosts(mux, m)
+
 	mux.HandleFunc("GET /requestsWS", func(w nethttp.ResponseWriter, r *nethttp.Request) {
 		var conn *websocket.Conn
 		var err error
@@ -88,6 +135,7 @@ func startControlServer(m *Manager, ph *ProxyHandler) {
 				msg, err := conn.Read()
 				if err != nil {
 					slog.Error("failed to read from websocket", "err", err.Error())
+					m.RemoveWS(conn)
 					return
 				}
 				m.HandleMessage(msg)
@@ -103,6 +151,15 @@ func startControlServer(m *Manager, ph *ProxyHandler) {
 			return
 		}
 
+		// a request waiting for approval has not been saved yet
+		m.approvalWaitersRWMu.RLock()
+		waiter, ok := m.approvalWaiters[id]
+		m.approvalWaitersRWMu.RUnlock()
+		if ok {
+			writePreview(w, waiter.reqPreview)
+			return
+		}
+
 		hijacker := w.(nethttp.Hijacker)
 		conn, _, err := hijacker.Hijack()
 		if err != nil {
@@ -116,22 +173,6 @@ func startControlServer(m *Manager, ph *ProxyHandler) {
 		conn.Write([]byte("Content-Type: text/plain\r\n"))
 		writeRawCORSHeaders(conn)
 
-		if waiter, ok := m.approvalWaiters[id]; ok {
-			if waiter.req != nil && waiter.req.Body != nil { // jic to avoid npd panics but the second clause shoud always be true if the first one is
-				conn.Write(fmt.Appendf([]byte{}, "Content-Length: %d\r\n\r\n", waiter.req.Body.ContentLength()))
-				if _, err := waiter.req.Body.WriteTo(conn); err != nil {
-					slog.Error("failed to write request body", "id", id, "err", err.Error())
-					conn.Write([]byte("failed to write request body"))
-				} else {
-					slog.Info("wrote request body", "id", id)
-				}
-				return
-			} else {
-				conn.Write([]byte("req body unavailable"))
-				return
-			}
-		}
-
 		err = m.db.WriteRequestBody(id, NewNoOpCloser(conn))
 		if err != nil {
 			slog.Error("failed to write request body", "id", id, "err", err.Error())
@@ -147,6 +188,15 @@ func startControlServer(m *Manager, ph *ProxyHandler) {
 			return
 		}
 
+		// a response waiting for approval has not been saved yet
+		m.approvalWaitersRWMu.RLock()
+		waiter, ok := m.approvalWaiters[id]
+		m.approvalWaitersRWMu.RUnlock()
+		if ok && waiter.resp != nil {
+			writePreview(w, waiter.respPreview)
+			return
+		}
+
 		hijacker := w.(nethttp.Hijacker)
 		conn, _, err := hijacker.Hijack()
 		if err != nil {
@@ -159,11 +209,10 @@ func startControlServer(m *Manager, ph *ProxyHandler) {
 		conn.Write([]byte("HTTP/1.1 200 OK\r\n"))
 		conn.Write([]byte("Content-Type: text/plain\r\n"))
 		writeRawCORSHeaders(conn)
+
 		err = m.db.WriteResponseBody(id, NewNoOpCloser(conn))
 		if err != nil {
-			w.WriteHeader(nethttp.StatusInternalServerError)
-			w.Write([]byte("failed to write request body"))
-			slog.Error("failed to write request body", "id", id, "err", err.Error())
+			slog.Error("failed to write response body", "id", id, "err", err.Error())
 			return
 		}
 	})
@@ -195,6 +244,60 @@ func startControlServer(m *Manager, ph *ProxyHandler) {
 		w.Write(data)
 	})
 
+	mux.HandleFunc("GET /request/{id}/frames", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+		id := r.PathValue("id")
+		if id == "" {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			w.Write([]byte("missing id parameter"))
+			return
+		}
+		frames, err := m.db.GetWebSocketFrames(id)
+		if err != nil {
+			w.WriteHeader(nethttp.StatusInternalServerError)
+			w.Write([]byte("failed to get websocket frames"))
+			slog.Error("failed to get websocket frames", "id", id, "err", err.Error())
+			return
+		}
+		data, err := json.Marshal(frames)
+		if err != nil {
+			w.WriteHeader(nethttp.StatusInternalServerError)
+			w.Write([]byte("failed to marshal websocket frames"))
+			slog.Error("failed to marshal websocket frames", "id", id, "err", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(nethttp.StatusOK)
+		w.Write(data)
+	})
+
+	mux.HandleFunc("GET /request/{id}/events", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+		id := r.PathValue("id")
+		if id == "" {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			w.Write([]byte("missing id parameter"))
+			return
+		}
+		events, err := m.db.GetSSEEvents(id)
+		if err != nil {
+			w.WriteHeader(nethttp.StatusInternalServerError)
+			w.Write([]byte("failed to get sse events"))
+			slog.Error("failed to get sse events", "id", id, "err", err.Error())
+			return
+		}
+		data, err := json.Marshal(events)
+		if err != nil {
+			w.WriteHeader(nethttp.StatusInternalServerError)
+			w.Write([]byte("failed to marshal sse events"))
+			slog.Error("failed to marshal sse events", "id", id, "err", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(nethttp.StatusOK)
+		w.Write(data)
+	})
+
 	mux.HandleFunc("OPTIONS /", func(w nethttp.ResponseWriter, _ *nethttp.Request) {
 		setCORSHeaders(w)
 		w.WriteHeader(nethttp.StatusNoContent)
@@ -219,11 +322,21 @@ func startControlServer(m *Manager, ph *ProxyHandler) {
 				Type:        FilterTypeString,
 				VerboseName: "Client IP",
 			},
+			FilterField{
+				Name:        "clientUser",
+				Type:        FilterTypeString,
+				VerboseName: "Client User",
+			},
 			FilterField{
 				Name:        "starred",
 				Type:        FilterTypeBool,
 				VerboseName: "Starred Only",
 			},
+			FilterField{
+				Name:        "mocked",
+				Type:        FilterTypeBool,
+				VerboseName: "Mocked Only",
+			},
 		}
 
 		err := m.db.GetFilterUniqueValues(filter)
@@ -307,6 +420,12 @@ func startControlServer(m *Manager, ph *ProxyHandler) {
 				UniqueValues:  nil,
 				SelectedValue: query.Get("clientIP"),
 			},
+			FilterField{
+				Name:          "clientUser",
+				Type:          FilterTypeString,
+				UniqueValues:  nil,
+				SelectedValue: query.Get("clientUser"),
+			},
 		}
 		if query.Get("starred") != "" {
 			starred, err := strconv.ParseBool(query.Get("starred"))
@@ -322,6 +441,20 @@ func startControlServer(m *Manager, ph *ProxyHandler) {
 				SelectedValue: starred,
 			})
 		}
+		if query.Get("mocked") != "" {
+			mocked, err := strconv.ParseBool(query.Get("mocked"))
+			if err != nil {
+				w.WriteHeader(nethttp.StatusBadRequest)
+				w.Write([]byte("invalid mocked parameter"))
+				return
+			}
+			filter = append(filter, FilterField{
+				Name:          "mocked",
+				Type:          FilterTypeBool,
+				UniqueValues:  nil,
+				SelectedValue: mocked,
+			})
+		}
 
 		paginatedRequests, totalRequests, err := m.db.GetRequestsMatchingFilter(filter, offsetInt, limitInt)
 		if err != nil {
@@ -339,18 +472,395 @@ func startControlServer(m *Manager, ph *ProxyHandler) {
 		}))
 	})
 
-	err := nethttp.ListenAndServe(":8001", mux)
-	if err != nil {
+	if err := cs.Listen(config.DefaultConfig.ControlListenAddress()); err != nil {
 		panic(err)
 	}
 }
 
+// controlServer serves the control API on an address that can change while the proxy runs.
+type controlServer struct {
+	handler nethttp.Handler
+
+	mu     sync.Mutex
+	addr   string
+	server *nethttp.Server
+}
+
+// Listen makes the control server listen on addr instead of its current address. The current listener is
+// closed right away, but the requests it is serving (e.g. the one that changed the address) are finished.
+func (s *controlServer) Listen(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.server != nil && addr == s.addr {
+		return nil
+	}
+
+	l, err := listen(addr)
+	if err != nil {
+		return fmt.Errorf("control server listener: %w", err)
+	}
+	server := &nethttp.Server{Handler: s.handler}
+	go func() {
+		if err := server.Serve(l); err != nil && !errors.Is(err, nethttp.ErrServerClosed) {
+			slog.Error("control server", "err", err.Error())
+		}
+	}()
+	slog.Info("listening", "listener", "control", "addr", l.Addr().String())
+
+	if s.server != nil {
+		go s.server.Shutdown(context.Background())
+		slog.Info("stopped listening", "listener", "control", "addr", s.addr)
+	}
+	s.addr, s.server = addr, server
+	return nil
+}
+
+// handleCA registers the endpoints that manage the CA the certificates of MITM'd hosts are signed with:
+//
+//	GET  /ca         describes the CA
+//	GET  /ca.crt     downloads the CA certificate to install on clients, in PEM (or DER with ?format=der)
+//	POST /ca/rotate  replaces the CA with a newly generated one
+//	POST /ca/import  replaces the CA with the one in the body: {"cert": "<PEM>", "key": "<PEM>"}
+//
+//	GET    /ca/certificates         lists the certificates generated for hosts with the CA
+//	DELETE /ca/certificates         deletes every certificate generated for hosts (by any CA)
+//	DELETE /ca/certificates/{host}  deletes the certificate generated for host (hostname:port)
+//
+// The new CA of a rotation or an import is used right away, for the connections MITM'd from then on.
+func handleCA(mux *nethttp.ServeMux, ph *ProxyHandler) {
+	// current returns the CA, or answers that there is none
+	current := func(w nethttp.ResponseWriter) *ca.CA {
+		if ph.certifcates.CA() == nil {
+			w.WriteHeader(nethttp.StatusServiceUnavailable)
+			w.Write([]byte("there is no ca (import one or rotate to generate one)"))
+			return nil
+		}
+		return ph.certifcates.CA()
+	}
+	writeInfo := func(w nethttp.ResponseWriter, authority *ca.CA) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(nethttp.StatusOK)
+		w.Write(marshal(map[string]any{
+			"subject":     authority.Cert.Subject.String(),
+			"notBefore":   authority.Cert.NotBefore.UnixMilli(),
+			"notAfter":    authority.Cert.NotAfter.UnixMilli(),
+			"keyType":     authority.KeyType(),
+			"fingerprint": authority.Fingerprint(),
+		}))
+	}
+
+	mux.HandleFunc("GET /ca", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+
+		if authority := current(w); authority != nil {
+			writeInfo(w, authority)
+		}
+	})
+
+	mux.HandleFunc("GET /ca.crt", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+
+		authority := current(w)
+		if authority == nil {
+			return
+		}
+		switch r.URL.Query().Get("format") {
+		case "", "pem":
+			w.Header().Set("Content-Type", "application/x-pem-file")
+			w.Header().Set("Content-Disposition", `attachment; filename="cap-ca.crt"`)
+			w.WriteHeader(nethttp.StatusOK)
+			w.Write(authority.CertPEM)
+		case "der":
+			w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+			w.Header().Set("Content-Disposition", `attachment; filename="cap-ca.der"`)
+			w.WriteHeader(nethttp.StatusOK)
+			w.Write(authority.Cert.Raw)
+		default:
+			w.WriteHeader(nethttp.StatusBadRequest)
+			w.Write([]byte("format must be pem or der"))
+		}
+	})
+
+	mux.HandleFunc("POST /ca/rotate", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+
+		authority, err := ph.certifcates.Rotate()
+		if err != nil {
+			w.WriteHeader(nethttp.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			slog.Error("failed to rotate ca", "err", err.Error())
+			return
+		}
+		slog.Info("rotated ca", "fingerprint", authority.Fingerprint())
+		writeInfo(w, authority)
+	})
+
+	mux.HandleFunc("POST /ca/import", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+
+		var body struct {
+			Cert string `json:"cert"`
+			Key  string `json:"key"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			w.Write([]byte("failed to decode body"))
+			return
+		}
+		authority, err := ph.certifcates.Import([]byte(body.Cert), []byte(body.Key))
+		if err != nil {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		slog.Info("imported ca", "fingerprint", authority.Fingerprint())
+		writeInfo(w, authority)
+	})
+
+	mux.HandleFunc("GET /ca/certificates", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+
+		if current(w) == nil {
+			return
+		}
+		leaves, err := ph.certifcates.Leaves()
+		if err != nil {
+			w.WriteHeader(nethttp.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			slog.Error("failed to list certificates", "err", err.Error())
+			return
+		}
+		list := make([]map[string]any, 0, len(leaves))
+		for _, leaf := range leaves {
+			list = append(list, map[string]any{
+				"host":     leaf.Host,
+				"notAfter": leaf.NotAfter.UnixMilli(),
+				"cached":   leaf.Cached,
+				"stored":   leaf.Stored,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(nethttp.StatusOK)
+		w.Write(marshal(list))
+	})
+
+	purge := func(w nethttp.ResponseWriter, host string) {
+		if err := ph.certifcates.Purge(host); err != nil {
+			w.WriteHeader(nethttp.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			slog.Error("failed to purge certificates", "host", host, "err", err.Error())
+			return
+		}
+		slog.Info("purged certificates", "host", host)
+		w.WriteHeader(nethttp.StatusNoContent)
+	}
+	mux.HandleFunc("DELETE /ca/certificates", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+		purge(w, "")
+	})
+	mux.HandleFunc("DELETE /ca/certificates/{host}", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+		purge(w, r.PathValue("host"))
+	})
+}
+
+// handlePinnedHosts registers the endpoints that manage the hosts tunneled instead of MITM'd because a client
+// rejected their certificate (see pinnedHosts):
+//
+//	GET    /mitm/pinned         lists the pinned hosts
+//	DELETE /mitm/pinned         forgets every pinned host
+//	DELETE /mitm/pinned/{host}  forgets a pinned host (host:port), so it is MITM'd again
+func handlePinnedHosts(mux *nethttp.ServeMux, m *Manager) {
+	mux.HandleFunc("GET /mitm/pinned", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+
+		pinned := m.pinned.list()
+		list := make([]map[string]any, 0, len(pinned))
+		for _, h := range pinned {
+			list = append(list, map[string]any{
+				"client": h.Client,
+				"host":   h.Host,
+				"since":  h.Since.UnixMilli(),
+				"until":  h.Until.UnixMilli(),
+				"error":  h.Error,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(nethttp.StatusOK)
+		w.Write(marshal(list))
+	})
+
+	mux.HandleFunc("DELETE /mitm/pinned", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+		m.pinned.forget("")
+		w.WriteHeader(nethttp.StatusNoContent)
+	})
+
+	mux.HandleFunc("DELETE /mitm/pinned/{host}", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+		m.pinned.forget(r.PathValue("host"))
+		w.WriteHeader(nethttp.StatusNoContent)
+	})
+}
+
+// handleRuleList registers the endpoints that manage a list of rules kept in the config:
+//
+//	GET    path       lists the rules
+//	POST   path       adds a rule at the end of the list
+//	PUT    path       replaces every rule (e.g. to reorder them)
+//	PUT    path/{id}  replaces a rule
+//	DELETE path/{id}  deletes a rule
+func handleRuleList[R any](mux *nethttp.ServeMux, path string, list *[]R, validate func(*R) error, id func(*R) *string) {
+	errNotFound := errors.New("rule not found")
+	indexOf := func(rs []R, ruleID string) int {
+		return slices.IndexFunc(rs, func(rule R) bool { return *id(&rule) == ruleID })
+	}
+
+	mux.HandleFunc("GET "+path, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+
+		rs := config.Rules(list)
+		if rs == nil {
+			rs = []R{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(nethttp.StatusOK)
+		w.Write(marshal(rs))
+	})
+
+	mux.HandleFunc("POST "+path, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+
+		var rule R
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			w.Write([]byte("failed to decode rule"))
+			return
+		}
+		if err := validate(&rule); err != nil {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		*id(&rule) = newID()
+
+		config.UpdateRules(list, func(rs []R) ([]R, error) {
+			return append(slices.Clone(rs), rule), nil
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(nethttp.StatusCreated)
+		w.Write(marshal(rule))
+	})
+
+	mux.HandleFunc("PUT "+path, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+
+		var rs []R
+		if err := json.NewDecoder(r.Body).Decode(&rs); err != nil {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			w.Write([]byte("failed to decode rules"))
+			return
+		}
+		for i := range rs {
+			if err := validate(&rs[i]); err != nil {
+				w.WriteHeader(nethttp.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("rule %d: %s", i, err.Error())))
+				return
+			}
+			if *id(&rs[i]) == "" {
+				*id(&rs[i]) = newID()
+			}
+		}
+
+		config.UpdateRules(list, func([]R) ([]R, error) { return rs, nil })
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(nethttp.StatusOK)
+		w.Write(marshal(rs))
+	})
+
+	mux.HandleFunc("PUT "+path+"/{id}", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+
+		ruleID := r.PathValue("id")
+		var rule R
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			w.Write([]byte("failed to decode rule"))
+			return
+		}
+		if err := validate(&rule); err != nil {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		*id(&rule) = ruleID
+
+		err := config.UpdateRules(list, func(rs []R) ([]R, error) {
+			i := indexOf(rs, ruleID)
+			if i < 0 {
+				return nil, errNotFound
+			}
+			rs = slices.Clone(rs)
+			rs[i] = rule
+			return rs, nil
+		})
+		if err != nil {
+			w.WriteHeader(nethttp.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(nethttp.StatusOK)
+		w.Write(marshal(rule))
+	})
+
+	mux.HandleFunc("DELETE "+path+"/{id}", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		setCORSHeaders(w)
+
+		ruleID := r.PathValue("id")
+
+		err := config.UpdateRules(list, func(rs []R) ([]R, error) {
+			i := indexOf(rs, ruleID)
+			if i < 0 {
+				return nil, errNotFound
+			}
+			return slices.Delete(slices.Clone(rs), i, i+1), nil
+		})
+		if err != nil {
+			w.WriteHeader(nethttp.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(nethttp.StatusOK)
+		w.Write([]byte("rule deleted"))
+	})
+}
+
+// writePreview writes the preview of a body waiting for approval (see previewBody), or 409 if there is none:
+// the body is still being received, or too large.
+func writePreview(w nethttp.ResponseWriter, preview []byte) {
+	setCORSHeaders(w)
+	if preview == nil {
+		w.WriteHeader(nethttp.StatusConflict)
+		w.Write([]byte("the body is incomplete or too large to be shown before it is approved"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", strconv.Itoa(len(preview)))
+	w.WriteHeader(nethttp.StatusOK)
+	w.Write(preview)
+}
+
 func setCORSHeaders(w nethttp.ResponseWriter) {
 	if !config.DefaultConfig.Debug {
 		return
 	}
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Request-Method", "POST, GET, OPTIONS")
+	w.Header().Set("Access-Control-Request-Method", "POST, GET, PUT, DELETE, OPTIONS")
 	w.Header().Set("Access-Control-Max-Age", "300")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 }
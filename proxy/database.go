@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"log/slog"
 	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/tiredkangaroo/cap/proxy/config"
 	"github.com/tiredkangaroo/cap/proxy/http"
@@ -45,6 +47,8 @@ type FilterField struct {
 type Database struct {
 	b          *sql.DB
 	workerpool *work.WorkerPool
+	// savedCertificates has the fingerprints of the certificates saved to the tlsCertificates table.
+	savedCertificates sync.Map
 }
 
 func (d *Database) Exec(query string, args ...any) (sql.Result, error) {
@@ -133,12 +137,91 @@ func (d *Database) Init(dirname string) error {
 		respBodySize INTEGER NOT NULL,
 
 		timing BLOB NOT NULL,
-		error TEXT
+		error TEXT,
+
+		connectionID TEXT NOT NULL DEFAULT '',
+		upstreamReused BOOLEAN NOT NULL DEFAULT FALSE,
+		proto TEXT NOT NULL DEFAULT '',
+		upstreamProto TEXT NOT NULL DEFAULT '',
+		rewrites BLOB NOT NULL DEFAULT '[]',
+		mocked BOOLEAN NOT NULL DEFAULT FALSE,
+		upstreamHost TEXT NOT NULL DEFAULT '',
+		upstreamSecure BOOLEAN NOT NULL DEFAULT FALSE,
+		mapRemoteRule TEXT NOT NULL DEFAULT '',
+		upstreamProxy TEXT NOT NULL DEFAULT '',
+		inbound TEXT NOT NULL DEFAULT 'http',
+		clientUser TEXT NOT NULL DEFAULT '',
+		rejected BOOLEAN NOT NULL DEFAULT FALSE,
+		mitmBypass TEXT NOT NULL DEFAULT '',
+		clientTLS BLOB NOT NULL DEFAULT 'null',
+		upstreamTLS BLOB NOT NULL DEFAULT 'null'
 	);`
 	_, err = d.Exec(createRequestsTable)
 	if err != nil {
 		return fmt.Errorf("init: failed to create requests table: %w", err)
 	}
+	// columns added after the requests table was first created (databases made by older versions lack them)
+	addedColumns := []struct{ name, decl string }{
+		{"connectionID", "TEXT NOT NULL DEFAULT ''"},
+		{"upstreamReused", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"proto", "TEXT NOT NULL DEFAULT ''"},
+		{"upstreamProto", "TEXT NOT NULL DEFAULT ''"},
+		{"rewrites", "BLOB NOT NULL DEFAULT '[]'"},
+		{"mocked", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"upstreamHost", "TEXT NOT NULL DEFAULT ''"},
+		{"upstreamSecure", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"mapRemoteRule", "TEXT NOT NULL DEFAULT ''"},
+		{"upstreamProxy", "TEXT NOT NULL DEFAULT ''"},
+		{"inbound", "TEXT NOT NULL DEFAULT 'http'"},
+		{"clientUser", "TEXT NOT NULL DEFAULT ''"},
+		{"rejected", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"mitmBypass", "TEXT NOT NULL DEFAULT ''"},
+		{"clientTLS", "BLOB NOT NULL DEFAULT 'null'"},
+		{"upstreamTLS", "BLOB NOT NULL DEFAULT 'null'"},
+	}
+	for _, column := range addedColumns {
+		if err := d.addColumn("requests", column.name, column.decl); err != nil {
+			return fmt.Errorf("init: %w", err)
+		}
+	}
+	framesTable := `CREATE TABLE IF NOT EXISTS websocketFrames (
+		requestID TEXT NOT NULL,
+		direction TEXT NOT NULL,
+		opcode INTEGER NOT NULL,
+		fin BOOLEAN NOT NULL,
+		compressed BOOLEAN NOT NULL,
+		payload BLOB NOT NULL,
+		length INTEGER NOT NULL,
+		truncated BOOLEAN NOT NULL,
+		datetime TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS websocketFramesRequestID ON websocketFrames (requestID);`
+	_, err = d.Exec(framesTable)
+	if err != nil {
+		return fmt.Errorf("init: failed to create websocket frames table: %w", err)
+	}
+	eventsTable := `CREATE TABLE IF NOT EXISTS sseEvents (
+		requestID TEXT NOT NULL,
+		type TEXT NOT NULL,
+		data TEXT NOT NULL,
+		lastEventID TEXT NOT NULL,
+		retry INTEGER NOT NULL,
+		datetime TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS sseEventsRequestID ON sseEvents (requestID);`
+	_, err = d.Exec(eventsTable)
+	if err != nil {
+		return fmt.Errorf("init: failed to create sse events table: %w", err)
+	}
+	// the certificates of the chains hosts present, saved once however many requests they were presented for
+	certificatesTable := `CREATE TABLE IF NOT EXISTS tlsCertificates (
+		fingerprint TEXT PRIMARY KEY,
+		certificate BLOB NOT NULL
+	);`
+	_, err = d.Exec(certificatesTable)
+	if err != nil {
+		return fmt.Errorf("init: failed to create tls certificates table: %w", err)
+	}
 	bodyTable := `CREATE TABLE IF NOT EXISTS bodies (
 		id TEXT PRIMARY KEY,
 		body BLOB NOT NULL
@@ -151,6 +234,62 @@ func (d *Database) Init(dirname string) error {
 	return nil
 }
 
+// addColumn adds a column to a table created by an older version of cap. It is a no-op if the
+// table already has the column.
+func (d *Database) addColumn(table, column, definition string) error {
+	var count int
+	err := d.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?;`, table, column).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("add column %s.%s: %w", table, column, err)
+	}
+	if count > 0 {
+		return nil
+	}
+	if _, err := d.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s;`, table, column, definition)); err != nil {
+		return fmt.Errorf("add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// requestColumns are the columns selected for a request, in the order scanSingleRequest scans them.
+const requestColumns = `
+		id,
+		starred,
+		secure,
+		datetime,
+		host,
+		clientIP,
+		clientAuthorization,
+		clientApplication,
+		reqMethod,
+		reqPath,
+		reqQuery,
+		reqHeaders,
+		reqBodyID,
+		reqBodySize,
+		respStatusCode,
+		respHeaders,
+		respBodyID,
+		respBodySize,
+		timing,
+		error,
+		connectionID,
+		upstreamReused,
+		proto,
+		upstreamProto,
+		rewrites,
+		mocked,
+		upstreamHost,
+		upstreamSecure,
+		mapRemoteRule,
+		upstreamProxy,
+		inbound,
+		clientUser,
+		rejected,
+		mitmBypass,
+		clientTLS,
+		upstreamTLS`
+
 func (d *Database) scanSingleRequest(row interface {
 	Scan(dest ...any) error
 }) (*Request, error) {
@@ -158,7 +297,7 @@ func (d *Database) scanSingleRequest(row interface {
 		req:  http.NewRequest(),
 		resp: http.NewResponse(),
 	}
-	var reqQueryRaw, reqHeadersRaw, respHeadersRaw, timingDataRaw []byte
+	var reqQueryRaw, reqHeadersRaw, respHeadersRaw, timingDataRaw, rewritesRaw, clientTLSRaw, upstreamTLSRaw []byte
 	var errorText sql.NullString
 	err := row.Scan(
 		&req.ID,
@@ -181,6 +320,22 @@ func (d *Database) scanSingleRequest(row interface {
 		&req.resp.ContentLength,
 		&timingDataRaw,
 		&errorText,
+		&req.ConnectionID,
+		&req.UpstreamReused,
+		&req.Proto,
+		&req.UpstreamProto,
+		&rewritesRaw,
+		&req.Mocked,
+		&req.UpstreamHost,
+		&req.UpstreamSecure,
+		&req.MapRemoteRuleID,
+		&req.UpstreamProxy,
+		&req.Inbound,
+		&req.ClientUser,
+		&req.Rejected,
+		&req.MITMBypass,
+		&clientTLSRaw,
+		&upstreamTLSRaw,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("scan single request: %w", err)
@@ -198,6 +353,15 @@ func (d *Database) scanSingleRequest(row interface {
 	if err := json.Unmarshal(timingDataRaw, &req.timing); err != nil {
 		return nil, fmt.Errorf("scan single request: unmarshal timing data: %w", err)
 	}
+	if err := json.Unmarshal(rewritesRaw, &req.Rewrites); err != nil {
+		return nil, fmt.Errorf("scan single request: unmarshal rewrites: %w", err)
+	}
+	if err := json.Unmarshal(clientTLSRaw, &req.ClientTLS); err != nil {
+		return nil, fmt.Errorf("scan single request: unmarshal client tls: %w", err)
+	}
+	if req.UpstreamTLS, err = d.unmarshalTLSInfo(upstreamTLSRaw); err != nil {
+		return nil, fmt.Errorf("scan single request: unmarshal upstream tls: %w", err)
+	}
 	if errorText.Valid {
 		req.errorText = errorText.String
 	} else {
@@ -210,27 +374,7 @@ func (d *Database) scanSingleRequest(row interface {
 }
 
 func (d *Database) GetRequestByID(id string) (*Request, error) {
-	query := `SELECT
-		id,
-		starred,
-		secure,
-		datetime,
-		host,
-		clientIP,
-		clientAuthorization,
-		clientApplication,
-		reqMethod,
-		reqPath,
-		reqQuery,
-		reqHeaders,
-		reqBodyID,
-		reqBodySize,
-		respStatusCode,
-		respHeaders,
-		respBodyID,
-		respBodySize,
-		timing,
-		error
+	query := `SELECT` + requestColumns + `
 	FROM requests WHERE id = ?`
 	row := d.QueryRow(query, id)
 	return d.scanSingleRequest(row)
@@ -282,27 +426,7 @@ func (d *Database) uniqueValues(by string) ([]any, error) {
 // this function executes two queries, one for paginated []Request and one for total count as if there was no limit or offset
 func (d *Database) GetRequestsMatchingFilter(f Filter, offset, limit int) ([]*Request, int, error) {
 	// paginated query
-	queryBase := `SELECT
-		id,
-		starred,
-		secure,
-		datetime,
-		host,
-		clientIP,
-		clientAuthorization,
-		clientApplication,
-		reqMethod,
-		reqPath,
-		reqQuery,
-		reqHeaders,
-		reqBodyID,
-		reqBodySize,
-		respStatusCode,
-		respHeaders,
-		respBodyID,
-		respBodySize,
-		timing,
-		error
+	queryBase := `SELECT` + requestColumns + `
 	FROM requests`
 
 	// count query
@@ -379,22 +503,54 @@ func (d *Database) GetRequestsMatchingFilter(f Filter, offset, limit int) ([]*Re
 func (d *Database) SaveRequest(req *Request, err error) error {
 	query := `INSERT INTO requests (
 		id,
+		connectionID,
+		upstreamReused,
+		proto,
+		upstreamProto,
+		rewrites,
+		mocked,
+		upstreamHost,
+		upstreamSecure,
+		mapRemoteRule,
+		upstreamProxy,
+		inbound,
+		rejected,
+		mitmBypass,
+		clientTLS,
+		upstreamTLS,
 		secure,
 		datetime,
 		host,
 
 		clientIP,
 		clientAuthorization,
+		clientUser,
 		clientApplication,
 
 		error`
 	args := []any{
 		req.ID,
+		req.ConnectionID,
+		req.UpstreamReused,
+		req.Proto,
+		req.UpstreamProto,
+		marshal(req.Rewrites),
+		req.Mocked,
+		req.UpstreamHost,
+		req.UpstreamSecure,
+		req.MapRemoteRuleID,
+		req.UpstreamProxy,
+		req.Inbound,
+		req.Rejected,
+		req.MITMBypass,
+		marshal(req.ClientTLS),
+		d.marshalTLSInfo(req.UpstreamTLS),
 		req.Secure,
 		sqlite3.TimeFormat4.Encode(req.Datetime),
 		req.Host,
 		req.ClientIP,
 		req.ClientAuthorization,
+		req.ClientUser,
 		req.ClientApplication,
 	}
 	if err != nil {
@@ -418,7 +574,7 @@ func (d *Database) SaveRequest(req *Request, err error) error {
 			marshal(req.req.Header),
 			marshal(req.req.Query),
 			req.reqBodyID,
-			req.req.ContentLength,
+			bodySize(req.req.ContentLength, req.req.Body),
 		)
 	} else {
 		args = append(args,
@@ -442,7 +598,7 @@ func (d *Database) SaveRequest(req *Request, err error) error {
 			req.resp.StatusCode,
 			marshal(req.resp.Header),
 			req.respBodyID,
-			req.resp.ContentLength,
+			bodySize(req.resp.ContentLength, req.resp.Body),
 		)
 	} else {
 		args = append(args,
@@ -480,50 +636,139 @@ func (d *Database) SaveRequest(req *Request, err error) error {
 	return nil
 }
 
-// NOTE: combine next two last parts of func into one for wblob
+// storedTLSInfo is how a TLSInfo is saved in the requests table: the certificates of its chain are saved in
+// the tlsCertificates table and referred to by fingerprint.
+type storedTLSInfo struct {
+	TLSInfo
+	Chain []string `json:"chain,omitempty"` // fingerprints, leaf first
+}
 
+// marshalTLSInfo saves the certificates of the chain of info that were not saved yet, and returns info as it is
+// saved in the requests table.
+func (d *Database) marshalTLSInfo(info *TLSInfo) []byte {
+	if info == nil {
+		return marshal(info)
+	}
+	stored := storedTLSInfo{TLSInfo: *info}
+	for _, cert := range info.Chain {
+		stored.Chain = append(stored.Chain, cert.Fingerprint)
+		if _, ok := d.savedCertificates.Load(cert.Fingerprint); ok {
+			continue
+		}
+		_, err := d.Exec(`INSERT OR IGNORE INTO tlsCertificates (fingerprint, certificate) VALUES (?, ?)`,
+			cert.Fingerprint, marshal(cert))
+		if err != nil {
+			slog.Error("failed to save tls certificate", "fingerprint", cert.Fingerprint, "err", err.Error())
+			continue
+		}
+		d.savedCertificates.Store(cert.Fingerprint, struct{}{})
+	}
+	return marshal(stored)
+}
+
+// unmarshalTLSInfo returns the TLSInfo saved as raw in the requests table (see marshalTLSInfo), with its chain.
+func (d *Database) unmarshalTLSInfo(raw []byte) (*TLSInfo, error) {
+	var stored *storedTLSInfo
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		return nil, nil
+	}
+	info := stored.TLSInfo
+	for _, fingerprint := range stored.Chain {
+		var certRaw []byte
+		err := d.QueryRow(`SELECT certificate FROM tlsCertificates WHERE fingerprint = ?`, fingerprint).Scan(&certRaw)
+		if err != nil {
+			return nil, fmt.Errorf("load certificate %s: %w", fingerprint, err)
+		}
+		var cert TLSCertificate
+		if err := json.Unmarshal(certRaw, &cert); err != nil {
+			return nil, fmt.Errorf("unmarshal certificate %s: %w", fingerprint, err)
+		}
+		info.Chain = append(info.Chain, cert)
+	}
+	return &info, nil
+}
+
+// SaveBody stores body under id. A body of known length is written into a blob of that size as it is read,
+// one of unknown length (chunked or delimited by the server closing the connection, and not read in full
+// yet) is read in full and stored as is.
 func (d *Database) SaveBody(id string, body *http.Body) error {
 	cl := body.ContentLength()
+	if cl < 0 {
+		b, err := readBody(body)
+		if err != nil {
+			return fmt.Errorf("save body: %w", err)
+		}
+		if _, err := d.Exec(`INSERT INTO bodies (id, body) VALUES (?, ?)`, id, b); err != nil {
+			return fmt.Errorf("save body: %w", err)
+		}
+		return nil
+	}
 	if cl == 0 {
 		_, err := d.Exec(`INSERT INTO bodies (id, body) VALUES (?, ?)`, id, []byte{})
 		return err
 	}
-	query := `INSERT INTO bodies (id, body) VALUES (:id, :cl);`
-	res, err := d.Exec(query, sql.Named("id", id), sql.Named("cl", sqlite3.ZeroBlob(cl)))
-	if err != nil {
+	query := `INSERT INTO bodies (id, body) VALUES (:id, :cl) RETURNING rowid;`
+	var rowid int64
+	if err := d.QueryRow(query, sql.Named("id", id), sql.Named("cl", sqlite3.ZeroBlob(cl))).Scan(&rowid); err != nil {
 		return fmt.Errorf("save body: %w", err)
 	}
-	rowid, _ := res.LastInsertId()
-
-	_, err = d.Exec(
-		`SELECT writeblob('main', 'bodies', 'body', :rowid, :offset, :message)`,
-		sql.Named("rowid", rowid), sql.Named("offset", 0), sql.Named("message", sqlite3.Pointer(body)),
-	)
-	if err != nil {
-		return fmt.Errorf("save body: writeblob: %w", err)
+	if err := d.writeBlob(rowid, body); err != nil {
+		return fmt.Errorf("save body: %w", err)
 	}
 	return nil
 }
 
+// UpdateBody replaces the body stored under id with body, the way SaveBody stores it.
 func (d *Database) UpdateBody(id string, body *http.Body) error {
 	cl := body.ContentLength()
-	query := `UPDATE bodies SET body = :cl WHERE id = :id;`
-	res, err := d.Exec(query, sql.Named("cl", sqlite3.ZeroBlob(cl)), sql.Named("id", id))
-	if err != nil {
+	if cl < 0 {
+		b, err := readBody(body)
+		if err != nil {
+			return fmt.Errorf("update body: %w", err)
+		}
+		if _, err := d.Exec(`UPDATE bodies SET body = ? WHERE id = ?`, b, id); err != nil {
+			return fmt.Errorf("update body: %w", err)
+		}
+		return nil
+	}
+	query := `UPDATE bodies SET body = :cl WHERE id = :id RETURNING rowid;`
+	var rowid int64
+	if err := d.QueryRow(query, sql.Named("cl", sqlite3.ZeroBlob(cl)), sql.Named("id", id)).Scan(&rowid); err != nil {
 		return fmt.Errorf("update body: %w", err)
 	}
-	rowid, _ := res.LastInsertId()
+	if cl == 0 {
+		return nil
+	}
+	if err := d.writeBlob(rowid, body); err != nil {
+		return fmt.Errorf("update body: %w", err)
+	}
+	return nil
+}
 
-	_, err = d.Exec(
+// writeBlob writes body into the (already sized) blob of the bodies row with the given rowid.
+func (d *Database) writeBlob(rowid int64, body *http.Body) error {
+	_, err := d.Exec(
 		`SELECT writeblob('main', 'bodies', 'body', :rowid, :offset, :message)`,
 		sql.Named("rowid", rowid), sql.Named("offset", 0), sql.Named("message", sqlite3.Pointer(body)),
 	)
 	if err != nil {
-		return fmt.Errorf("save body: writeblob: %w", err)
+		return fmt.Errorf("writeblob: %w", err)
 	}
 	return nil
 }
 
+// readBody reads the whole decoded body, the part already read included.
+func readBody(body *http.Body) ([]byte, error) {
+	var b bytes.Buffer
+	if _, err := body.WriteTo(&b); err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
 func (d *Database) WriteRequestBody(id string, writer io.Writer) error {
 	query := `SELECT rowid, length(body) FROM bodies WHERE id = ?;`
 	row := d.QueryRow(query, id+"-req-body")
@@ -551,6 +796,139 @@ func (d *Database) SetRequestStarred(id string, starred bool) error {
 	return nil
 }
 
+// SaveWebSocketFrame saves a frame sent over the upgraded connection of a request.
+func (d *Database) SaveWebSocketFrame(f *WebSocketFrame) error {
+	query := `INSERT INTO websocketFrames (
+		requestID,
+		direction,
+		opcode,
+		fin,
+		compressed,
+		payload,
+		length,
+		truncated,
+		datetime
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	payload := f.Payload
+	if payload == nil {
+		payload = []byte{} // NOT NULL
+	}
+	_, err := d.Exec(query,
+		f.RequestID,
+		f.Direction,
+		f.Opcode,
+		f.Fin,
+		f.Compressed,
+		payload,
+		f.Length,
+		f.Truncated,
+		sqlite3.TimeFormat4.Encode(f.Datetime),
+	)
+	if err != nil {
+		return fmt.Errorf("save websocket frame: %w", err)
+	}
+	return nil
+}
+
+// GetWebSocketFrames returns the frames recorded for a request, oldest first.
+func (d *Database) GetWebSocketFrames(requestID string) ([]*WebSocketFrame, error) {
+	query := `SELECT
+		requestID,
+		direction,
+		opcode,
+		fin,
+		compressed,
+		payload,
+		length,
+		truncated,
+		datetime
+	FROM websocketFrames WHERE requestID = ? ORDER BY rowid;`
+	rows, err := d.Query(query, requestID)
+	if err != nil {
+		return nil, fmt.Errorf("get websocket frames: %w", err)
+	}
+	defer rows.Close()
+
+	frames := make([]*WebSocketFrame, 0)
+	for rows.Next() {
+		f := new(WebSocketFrame)
+		err := rows.Scan(
+			&f.RequestID,
+			&f.Direction,
+			&f.Opcode,
+			&f.Fin,
+			&f.Compressed,
+			&f.Payload,
+			&f.Length,
+			&f.Truncated,
+			sqlite3.TimeFormat4.Scanner(&f.Datetime),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("get websocket frames (scan): %w", err)
+		}
+		frames = append(frames, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("get websocket frames: %w", err)
+	}
+	return frames, nil
+}
+
+// SaveSSEEvent saves an event of a text/event-stream response.
+func (d *Database) SaveSSEEvent(e *SSEEvent) error {
+	query := `INSERT INTO sseEvents (
+		requestID,
+		type,
+		data,
+		lastEventID,
+		retry,
+		datetime
+	) VALUES (?, ?, ?, ?, ?, ?);`
+	_, err := d.Exec(query, e.RequestID, e.Type, e.Data, e.ID, e.Retry, sqlite3.TimeFormat4.Encode(e.Datetime))
+	if err != nil {
+		return fmt.Errorf("save sse event: %w", err)
+	}
+	return nil
+}
+
+// GetSSEEvents returns the events recorded for a request, oldest first.
+func (d *Database) GetSSEEvents(requestID string) ([]*SSEEvent, error) {
+	query := `SELECT
+		requestID,
+		type,
+		data,
+		lastEventID,
+		retry,
+		datetime
+	FROM sseEvents WHERE requestID = ? ORDER BY rowid;`
+	rows, err := d.Query(query, requestID)
+	if err != nil {
+		return nil, fmt.Errorf("get sse events: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]*SSEEvent, 0)
+	for rows.Next() {
+		e := new(SSEEvent)
+		err := rows.Scan(
+			&e.RequestID,
+			&e.Type,
+			&e.Data,
+			&e.ID,
+			&e.Retry,
+			sqlite3.TimeFormat4.Scanner(&e.Datetime),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("get sse events (scan): %w", err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("get sse events: %w", err)
+	}
+	return events, nil
+}
+
 func (d *Database) readBlobToWriterWithRowID(row *sql.Row, writer io.Writer) error {
 	var rowid int64
 	var length int64
@@ -569,6 +947,14 @@ func (d *Database) readBlobToWriterWithRowID(row *sql.Row, writer io.Writer) err
 	return nil
 }
 
+// bodySize returns the decoded size of body if it is known, otherwise the declared content length.
+func bodySize(contentLength int64, body *http.Body) int64 {
+	if body != nil && body.ContentLength() >= 0 {
+		return body.ContentLength()
+	}
+	return contentLength
+}
+
 func NewDatabase() *Database {
 	return &Database{workerpool: work.NewWorkerPool(1)}
 }
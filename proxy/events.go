@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"mime"
+	"time"
+
+	"github.com/tiredkangaroo/cap/proxy/http"
+	"github.com/tiredkangaroo/cap/proxy/sse"
+)
+
+// SSEEvent is an event of a text/event-stream (Server-Sent Events) response, as recorded.
+type SSEEvent struct {
+	RequestID string
+	Type      string
+	Data      string
+	ID        string // last event ID
+	Retry     int    // -1 if the event did not set a reconnection time
+	Datetime  time.Time
+}
+
+func (e *SSEEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"id":          e.RequestID,
+		"event":       e.Type,
+		"data":        e.Data,
+		"lastEventID": e.ID,
+		"retry":       e.Retry,
+		"datetime":    e.Datetime.UnixMilli(), // unix milli for js
+	})
+}
+
+// isEventStream reports whether resp is an uncompressed stream of server-sent events.
+func isEventStream(resp *http.Response) bool {
+	mediatype, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediatype != "text/event-stream" {
+		return false
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	return encoding == "" || encoding == "identity"
+}
+
+// observeEvents parses the events of the response body as it is forwarded. Every event is sent to live
+// websocket connections and saved.
+func (r *Request) observeEvents(m *Manager) {
+	r.resp.Body.Observe(sse.NewParser(func(e sse.Event) {
+		event := &SSEEvent{
+			RequestID: r.ID,
+			Type:      e.Type,
+			Data:      e.Data,
+			ID:        e.ID,
+			Retry:     e.Retry,
+			Datetime:  time.Now(),
+		}
+		m.SendSSEEvent(event)
+		if err := m.db.SaveSSEEvent(event); err != nil {
+			slog.Error("save sse event", "id", r.ID, "err", err.Error())
+		}
+	}))
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+
+	"github.com/tiredkangaroo/cap/proxy/config"
+	"github.com/tiredkangaroo/cap/proxy/http"
+	"github.com/tiredkangaroo/cap/proxy/timing"
+)
+
+// ErrH2NoStreams is the error of the first request of an HTTP/2 session the client closed without opening
+// a single stream.
+var ErrH2NoStreams = errors.New("client closed the http2 session without sending a request")
+
+// HTTP/2 framing, HPACK and flow control are handled by golang.org/x/net/http2. Every stream is converted
+// into the proxy's own http.Request/http.Response model, so it goes through the same pipeline (approval,
+// storage, etc.) as an HTTP/1 request.
+
+const (
+	ProtoHTTP10 = "HTTP/1.0"
+	ProtoHTTP11 = "HTTP/1.1"
+	ProtoHTTP2  = "HTTP/2.0"
+)
+
+// hopByHopHeaders are connection-specific headers. They are meaningless (and forbidden) in HTTP/2.
+var hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
+// serveH2 serves the streams of a MITM'd TLS session that negotiated HTTP/2. The first stream is served as
+// first (the request made for the CONNECT request), every other stream as its own exchange on the same
+// connection. It returns once the client closes the session.
+func (c *ProxyHandler) serveH2(first *Request, session *clientSession) {
+	first.client = nil // streams cannot be upgraded
+	var firstTaken atomic.Bool
+	server := &http2.Server{
+		IdleTimeout: config.DefaultConfig.KeepAliveDuration(),
+	}
+	server.ServeConn(session.conn, &http2.ServeConnOpts{
+		Handler: nethttp.HandlerFunc(func(w nethttp.ResponseWriter, hr *nethttp.Request) {
+			r := first
+			if !firstTaken.CompareAndSwap(false, true) {
+				r = first.nextExchange(c.m)
+				c.m.SendNew(r)
+			}
+			r.Proto = ProtoHTTP2
+
+			r.timing.Start(timing.TimeReadRequest)
+			req := requestFromH2(hr)
+			r.timing.Stop()
+			defer req.Body.CloseBody()
+
+			_, err := r.handleMITMRequest(c.m, req, w, c.certifcates)
+			c.sendResult(r, err)
+			if errors.Is(err, ErrPerformStop) || (err != nil && r.resp != nil) {
+				// canceled, or failed midway through the response: reset the stream, so the client does not take
+				// a missing or partial response for a complete one (as closing an HTTP/1 connection does)
+				panic(nethttp.ErrAbortHandler)
+			}
+			if err != nil {
+				// nothing was written to the stream yet, let the client know the request failed
+				w.WriteHeader(nethttp.StatusBadGateway)
+			}
+		}),
+	})
+	if !firstTaken.Load() {
+		c.sendResult(first, ErrH2NoStreams)
+	}
+}
+
+// requestFromH2 converts a request read from an HTTP/2 stream into a request that can be sent to the host
+// over HTTP/1.1 (or HTTP/2 again, see roundTripH2).
+func requestFromH2(hr *nethttp.Request) *http.Request {
+	req := http.NewRequest()
+	req.Method = http.MethodFromString(hr.Method)
+	req.Path = hr.URL.Path
+	req.Query = hr.URL.Query()
+	req.Proto = []byte(ProtoHTTP11)
+	req.Host = hr.Host
+	for k, v := range hr.Header {
+		req.Header[k] = append([]string(nil), v...)
+	}
+	req.Header.Set("Host", hr.Host) // :authority
+	req.ContentLength = hr.ContentLength
+	if hr.Body == nil || hr.Body == nethttp.NoBody {
+		req.ContentLength = 0
+	}
+	req.Body = http.NewBodyFromReader(hr.Body, req.ContentLength)
+	if req.ContentLength < 0 {
+		req.Header.Set("Transfer-Encoding", "chunked")
+	}
+	return req
+}
+
+// isH2 reports whether conn negotiated HTTP/2 via ALPN.
+func isH2(conn interface {
+	ConnectionState() tls.ConnectionState
+}) bool {
+	return conn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS
+}
+
+// newH2ClientConn starts an HTTP/2 client connection on a TLS connection to a host that negotiated it.
+func newH2ClientConn(conn *tls.Conn) (*http2.ClientConn, error) {
+	// the request is forwarded as the client sent it, the transport must not ask for (and decode) gzip itself
+	t := &http2.Transport{DisableCompression: true}
+	return t.NewClientConn(conn)
+}
+
+// roundTripH2 sends the request to the host over the HTTP/2 client connection and converts the response
+// into one that can be written to an HTTP/1.1 client (or to an HTTP/2 client again, see writeH2Response).
+func (r *Request) roundTripH2(cc *http2.ClientConn) (*http.Response, error) {
+	r.timing.Substart(timing.SubtimeWriteRequest)
+	hr := &nethttp.Request{
+		Method: r.req.Method.String(),
+		URL: &url.URL{
+			Scheme:   "https",
+			Host:     r.UpstreamHost,
+			Path:     r.req.Path,
+			RawQuery: r.req.Query.Encode(),
+		},
+		Proto:         ProtoHTTP2,
+		ProtoMajor:    2,
+		Header:        make(nethttp.Header, len(r.req.Header)),
+		Host:          r.req.Header.Get("Host"),
+		ContentLength: r.req.ContentLength,
+	}
+	for k, v := range r.req.Header {
+		if k == "Host" || isHopByHop(k) {
+			continue
+		}
+		hr.Header[k] = v
+	}
+	if hr.Host == "" {
+		hr.Host = r.req.Host
+	}
+	if r.req.Body != nil && r.req.ContentLength != 0 {
+		hr.Body = noWriterTo{r.req.Body}
+	}
+	r.timing.Substop()
+
+	r.timing.Substart(timing.SubtimeReadResponse)
+	hresp, err := cc.RoundTrip(hr)
+	r.timing.Substop()
+	if err != nil {
+		return nil, fmt.Errorf("h2 round trip: %w", err)
+	}
+
+	resp := http.NewResponse()
+	resp.Version = []byte(ProtoHTTP11)
+	resp.StatusCode = hresp.StatusCode
+	for k, v := range hresp.Header {
+		resp.Header[k] = v
+	}
+	resp.ContentLength = hresp.ContentLength
+	if r.req.Method == http.MethodHead {
+		resp.ContentLength = 0
+	}
+	resp.Body = http.NewBodyFromReader(hresp.Body, resp.ContentLength)
+	if resp.ContentLength < 0 {
+		resp.Header.Set("Transfer-Encoding", "chunked")
+	}
+	r.UpstreamProto = ProtoHTTP2
+	return resp, nil
+}
+
+// writeH2Response writes the response to an HTTP/2 stream.
+func (r *Request) writeH2Response(w nethttp.ResponseWriter) error {
+	for k, v := range r.resp.Header {
+		if isHopByHop(k) {
+			continue
+		}
+		w.Header()[k] = v
+	}
+	if r.resp.Body.ContentLength() >= 0 && r.req.Method != http.MethodHead {
+		w.Header().Set("Content-Length", fmt.Sprint(r.resp.Body.ContentLength()))
+	}
+	w.WriteHeader(r.resp.StatusCode)
+	if _, err := r.resp.Body.WriteTo(flushWriter{w}); err != nil {
+		return err
+	}
+	for k, v := range r.resp.Body.Trailer {
+		w.Header()[nethttp.TrailerPrefix+k] = v
+	}
+	return nil
+}
+
+func isHopByHop(k string) bool {
+	for _, h := range hopByHopHeaders {
+		if strings.EqualFold(k, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// flushWriter flushes every write to the stream, so the body reaches the client as it arrives from the
+// host (the stream buffers writes otherwise).
+type flushWriter struct {
+	w nethttp.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		err = nethttp.NewResponseController(f.w).Flush()
+	}
+	return n, err
+}
+
+// noWriterTo hides the WriteTo method of a body, so net/http reads the body instead of asking it to write
+// itself (which writes from the start, for a body that may already be partly read).
+type noWriterTo struct {
+	b *http.Body
+}
+
+func (n noWriterTo) Read(p []byte) (int, error) {
+	return n.b.Read(p)
+}
+
+func (n noWriterTo) Close() error {
+	return nil
+}
@@ -7,11 +7,13 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	nethttp "net/http"
 	"time"
 
 	certificate "github.com/tiredkangaroo/cap/proxy/certificates"
 	"github.com/tiredkangaroo/cap/proxy/config"
 	"github.com/tiredkangaroo/cap/proxy/http"
+	"github.com/tiredkangaroo/cap/proxy/rules"
 	"github.com/tiredkangaroo/cap/proxy/timing"
 )
 
@@ -30,62 +32,44 @@ var (
 		"\r\n")
 )
 
-// look over HTTP/2 handling and streaming responses
+// look over streaming responses
 
 // handleHTTP handles a HTTP request to the proxy.
 //
 // HTTP requests do not create secure tunnels, therefore the original request to the
 // proxy is the one meant for the host. The only prep we need to do is strip proxy
 // headers. The proxy will then perform the request to the host and send the response
-// back to the client.
-func (r *Request) handleHTTP(m *Manager, req *http.Request, c *certificate.Certificates) error {
+// back to the client. It returns whether the client connection can be kept alive.
+func (r *Request) handleHTTP(m *Manager, req *http.Request, c *certificate.Certificates) (bool, error) {
 	// HTTP requests send the full request to the proxy, so this is the request we want to perform
 	r.req = req
+	r.Proto = string(req.Proto)
+	r.clientKeepAlive = clientWantsKeepAlive(req)
 	handleRealIPHeader(r)
+	r.prepareUpgrade()
+	defer r.releaseHostConn(m)
 
 	// send request to live websocket connections
 	m.SendRequest(r)
 
 	// perform the request
-	resp, err := r.Perform(m, c)
+	_, err := r.Perform(m, c)
 	if err != nil {
-		return fmt.Errorf("perform: %w", err)
+		return false, fmt.Errorf("perform: %w", err)
 	}
 
 	// send response to live websocket connections
 	m.SendResponse(r)
 
-	if config.DefaultConfig.ProvideRequestBody {
-		// save the request body to the database
-		r.timing.Start(timing.TimeSaveRequestBody)
-		if err := m.db.SaveBody(r.reqBodyID, r.req.Body); err != nil {
-			slog.Error("save request body: %w", "err", err)
-		} else {
-			slog.Debug("saved request body", "id", r.reqBodyID)
-		}
-		r.timing.Stop()
-	}
-
-	if config.DefaultConfig.ProvideResponseBody {
-		// save the response body to the database
-		r.timing.Start(timing.TimeSaveResponseBody)
-		if err := m.db.SaveBody(r.respBodyID, r.resp.Body); err != nil {
-			slog.Error("save response body: %w", "err", err)
-		} else {
-			slog.Debug("saved response body", "id", r.reqBodyID)
-		}
-		r.timing.Stop()
-	}
-
-	// write the response to the connection
-	r.timing.Start(timing.TimeWriteResponse)
-	err = resp.Write(r.conn) // write the response to the connection
-	r.timing.Stop()
+	keepAlive, err := r.finishExchange(m, r.conn)
 	if err != nil {
-		return fmt.Errorf("connection write: %w", err)
+		return false, fmt.Errorf("connection write: %w", err)
+	}
+	if r.upgraded() {
+		return false, r.serveUpgraded(m)
 	}
 
-	return nil
+	return keepAlive, nil
 }
 
 // handleHTTPS handles a HTTPS request. This proxy is a MITM proxy, so it will
@@ -97,19 +81,27 @@ func (r *Request) handleHTTP(m *Manager, req *http.Request, c *certificate.Certi
 // (3) The proxy reads the actual request from the client that it meant to send the host.
 // (4) The proxy performs the request to the real host.
 // (5) The proxy sends the response back to the client.
-func (r *Request) handleHTTPS(m *Manager, c *certificate.Certificates) error {
-	// write a success response to the client (this is meant to be the last thing before the secure tunnel is expected)
-	r.timing.Start(timing.TimeSendProxyResponse)
-	_, err := r.conn.Write(ResponseRawSuccess)
-	r.timing.Stop()
-	if err != nil {
-		return fmt.Errorf("connection write: %w", err)
+//
+// It returns the TLS session with the client (nil if the connection was tunneled) and whether the client
+// can send more requests over it. If the client negotiated HTTP/2, no request is read here: the session is
+// returned as is, to be served by serveH2.
+func (r *Request) handleHTTPS(m *Manager, c *certificate.Certificates) (*clientSession, bool, error) {
+	// write a success response to the client (this is meant to be the last thing before the secure tunnel is expected).
+	// clients of the SOCKS listener were already told the connection succeeded during the SOCKS handshake, and
+	// clients of the transparent listener think they are connected to the host already.
+	if r.Inbound == InboundHTTP {
+		r.timing.Start(timing.TimeSendProxyResponse)
+		_, err := r.conn.Write(ResponseRawSuccess)
+		r.timing.Stop()
+		if err != nil {
+			return nil, false, fmt.Errorf("connection write: %w", err)
+		}
 	}
 
-	if !config.DefaultConfig.MITM {
-		return r.handleNoMITM(m)
-	} else if c == nil {
-		return fmt.Errorf("mitm is enabled, but certificate service is unavailable")
+	if r.Kind != RequestKindHTTPSMITM {
+		return nil, false, r.handleNoMITM(m)
+	} else if c == nil || c.CA() == nil {
+		return nil, false, fmt.Errorf("mitm is enabled, but certificate service is unavailable")
 	}
 
 	// after the success response, a handshake will occur and the user will
@@ -117,65 +109,179 @@ func (r *Request) handleHTTPS(m *Manager, c *certificate.Certificates) error {
 	// we need to perform a TLS handshake with the client using the self-signed certificate for the requested host.
 	// this will allow us to read the request from the client as if we were the host.
 
-	// NOTE: consider IPV6 square bracket and how that affects the hostname
 	r.timing.Start(timing.TimeCertGenTLSHandshake)
-	tlsconn, err := c.TLSConn(r.conn, getHostname(r.Host))
+	dial := dialMirror
+	if r.streamHost != "" {
+		// the certificate to mirror is the one presented where the client connected to, for the name it asked for
+		dial = func(string) (net.Conn, error) { return dialMirror(r.streamHost) }
+	}
+	tlsconn, err := c.TLSConn(r.conn, r.Host, dial)
 	if err != nil {
-		return fmt.Errorf("tls conn: %w", err)
+		return nil, false, fmt.Errorf("tls conn: %w", err)
 	}
+	written := r.conn.(*CustomConn).Writen()
 	if err := tlsconn.Handshake(); err != nil {
-		return fmt.Errorf("tls handshake: %w", err)
+		// a client that pins the certificate of the host aborts the handshake once it sees the generated one
+		err = r.pinHost(m, err, r.conn.(*CustomConn).Writen()-written)
+		return nil, false, fmt.Errorf("tls handshake: %w", err)
 	}
+	m.pinned.accept(r.pinKey())
 	r.timing.Stop()
+	r.ClientTLS = newTLSInfo(tlsconn.ConnectionState())
+
+	session := newClientSession(tlsconn)
+	r.client = session
+	if isH2(tlsconn) {
+		session.h2 = true
+		return session, true, nil
+	}
 
 	// read the request from the TLS connection (this is the ACTUAL request meant for the host, which we will perform)
-	r.timing.Start(timing.TimeReadRequest)
-	req, err := http.ReadRequest(tlsconn)
-	r.timing.Stop()
+	req, err := session.readNextRequest(r.timing, timing.TimeReadRequest)
 	if err != nil {
-		return fmt.Errorf("read mitm request: %w", err)
+		return nil, false, fmt.Errorf("read mitm request: %w", err)
 	}
-	r.req = req
+	defer req.Body.CloseBody()
 
+	keepAlive, err := r.handleMITMRequest(m, req, session.conn, c)
+	return session, keepAlive, err
+}
+
+// handleMITMRequest performs a request read from a MITM'd TLS session and writes the response to w (the
+// session itself, or the stream the request was read from for HTTP/2). It returns whether the client can
+// send more requests over the session. It also serves the origin-form requests of reverse proxy mode, read
+// from the client connection or the TLS session terminated on it.
+func (r *Request) handleMITMRequest(m *Manager, req *http.Request, w io.Writer, c *certificate.Certificates) (bool, error) {
+	r.req = req
+	if r.Inbound == InboundReverse {
+		r.setReverseHost()
+		r.setReversePath()
+	}
+	if r.Proto == "" {
+		r.Proto = string(req.Proto)
+	}
+	r.clientKeepAlive = clientWantsKeepAlive(req)
 	handleRealIPHeader(r)
+	r.prepareUpgrade()
+	defer r.releaseHostConn(m)
 
 	// send the request to live websocket connections
 	m.SendRequest(r)
 
-	resp, err := r.Perform(m, c)
+	_, err := r.Perform(m, c)
 	if err != nil {
-		return fmt.Errorf("perform: %w", err)
+		return false, fmt.Errorf("perform: %w", err)
 	}
 
 	// send the response to live websocket connections
 	m.SendResponse(r)
 
-	// save the request body to the database
-	r.timing.Start(timing.TimeSaveRequestBody)
-	if err := m.db.SaveBody(r.reqBodyID, r.req.Body); err != nil {
-		slog.Error("save request body: %w", "err", err)
+	keepAlive, err := r.finishExchange(m, w)
+	if err != nil {
+		return false, fmt.Errorf("tls connection write: %w", err)
+	}
+	if r.upgraded() {
+		return false, r.serveUpgraded(m)
+	}
+
+	return keepAlive, nil
+}
+
+// finishExchange saves the request and response bodies to the database (if configured to) and writes
+// the response to w. The response body is forwarded to w as it arrives from the host (while it is written
+// to a temporary file) and only saved once it is over, so streaming responses such as server-sent events
+// and long polls reach the client live. The events of an event stream are parsed on the way.
+//
+// It returns whether the client connection can be kept alive, which is also announced to the client
+// in the response's Connection and Keep-Alive headers.
+func (r *Request) finishExchange(m *Manager, w io.Writer) (bool, error) {
+	if config.DefaultConfig.ProvideRequestBody {
+		// save the request body to the database
+		r.timing.Start(timing.TimeSaveRequestBody)
+		if err := m.db.SaveBody(r.reqBodyID, r.req.Body); err != nil {
+			slog.Error("save request body: %w", "err", err)
+		} else {
+			slog.Debug("saved request body", "id", r.reqBodyID)
+		}
+		r.timing.Stop()
+	}
+
+	keepAlive := r.keepAlive()
+	if r.resp.StatusCode == http.StatusSwitchingProtocols {
+		// the connection now belongs to the new protocol, the host's Connection: upgrade must reach the client
+		keepAlive = false
+	} else if keepAlive {
+		r.resp.Header.Set("Connection", "keep-alive")
+		r.resp.Header.Set("Keep-Alive", fmt.Sprintf("timeout=%d", int(config.DefaultConfig.KeepAliveDuration().Seconds())))
 	} else {
-		slog.Debug("saved request body", "id", r.reqBodyID)
+		r.resp.Header.Set("Connection", "close")
+		r.resp.Header.Del("Keep-Alive")
+	}
+
+	if config.DefaultConfig.ProvideResponseBody && isEventStream(r.resp) {
+		r.observeEvents(m)
 	}
-	r.timing.Stop()
 
+	if err := r.writeResponse(w); err != nil {
+		// the client (or the host) went away midway, keep the part of the body that was forwarded
+		r.resp.Body.Truncate()
+		r.saveResponseBody(m)
+		return false, err
+	}
+	r.saveResponseBody(m)
+	if r.resp.CloseDelimited {
+		return false, nil
+	}
+	return keepAlive, nil
+}
+
+// keepAlive reports whether the client connection can be used for another request after this exchange.
+func (r *Request) keepAlive() bool {
+	if config.DefaultConfig.DisableKeepAlive || !r.clientKeepAlive {
+		return false
+	}
+	// a close-delimited body can only be delimited for the client by closing its connection too
+	return !r.resp.CloseDelimited && !r.resp.Header.HasToken("Connection", "close")
+}
+
+// clientWantsKeepAlive reports whether the client that sent req wants to keep its connection open
+// afterwards. HTTP/1.1 connections are persistent unless closed explicitly, HTTP/1.0 connections
+// must ask for it.
+func clientWantsKeepAlive(req *http.Request) bool {
+	if req.Header.HasToken("Connection", "close") || req.Header.HasToken("Proxy-Connection", "close") {
+		return false
+	}
+	if string(req.Proto) == "HTTP/1.0" {
+		return req.Header.HasToken("Connection", "keep-alive") || req.Header.HasToken("Proxy-Connection", "keep-alive")
+	}
+	return true
+}
+
+func (r *Request) saveResponseBody(m *Manager) {
+	if !config.DefaultConfig.ProvideResponseBody {
+		return
+	}
 	// save the response body to the database
 	r.timing.Start(timing.TimeSaveResponseBody)
-	if err := m.db.SaveBody(r.respBodyID, resp.Body); err != nil {
+	if err := m.db.SaveBody(r.respBodyID, r.resp.Body); err != nil {
 		slog.Error("save response body: %w", "err", err)
 	} else {
-		slog.Debug("saved response body", "id", r.reqBodyID)
+		slog.Debug("saved response body", "id", r.respBodyID)
 	}
 	r.timing.Stop()
+}
 
+func (r *Request) writeResponse(w io.Writer) error {
+	// write the response to the connection (or the HTTP/2 stream)
 	r.timing.Start(timing.TimeWriteResponse)
-	err = r.resp.Write(tlsconn) // write the response to the TLS connection
-	r.timing.Stop()
-	if err != nil {
-		return fmt.Errorf("tls connection write: %w", err)
+	var err error
+	if hw, ok := w.(nethttp.ResponseWriter); ok {
+		err = r.writeH2Response(hw)
+	} else {
+		err = r.resp.Write(w)
 	}
-
-	return nil
+	r.timing.Stop()
+	return err
 }
 
 // NOTE: handleNoMITM is falling out of support rn, gotta fix ts
@@ -184,9 +290,14 @@ func (r *Request) handleHTTPS(m *Manager, c *certificate.Certificates) error {
 // tunnel.
 func (r *Request) handleNoMITM(m *Manager) error {
 	// this code will need to be combined because it's the same in Perform and here in tunneling
-	if config.DefaultConfig.RequireApproval {
+	switch r.interceptAction() {
+	case rules.ActionCancel:
+		m.SendCanceled(r)
+		return ErrPerformStop
+	case rules.ActionIntercept:
 		r.timing.Start(timing.TimeWaitApproval)
-		if !m.RecieveApproval(r) { // req.Secure changes should not affect this (so we're good i think)
+		// the tunnel was already established, so there is no response to respond with
+		if m.RecieveApproval(r) != ApprovalApproved { // req.Secure changes should not affect this (so we're good i think)
 			return ErrPerformStop
 		}
 		r.timing.Stop()
@@ -200,7 +311,8 @@ func (r *Request) handleNoMITM(m *Manager) error {
 
 	r.timing.Start(timing.TimeTunnel)
 	defer r.timing.Stop()
-	hconn, err := net.Dial("tcp", r.Host)
+	r.selectUpstreamProxy(r.Host)
+	hconn, err := r.dialTunnel()
 	if err != nil {
 		return fmt.Errorf("dial host: %w", err)
 	}
@@ -11,151 +11,294 @@ import (
 
 type Body struct {
 	buf           *bufio.Reader
+	src           io.Reader // decoded body source (buf itself, or a chunked reader on top of it)
 	readN         int64
-	contentLength int64
+	contentLength int64 // -1 means unknown until the whole body has been read (chunked)
+
+	// chunked is whether the body is sent with Transfer-Encoding: chunked. The body itself is
+	// always stored decoded, it is only re-encoded when it is written to the other side.
+	chunked bool
+	// Trailer holds the trailer fields sent after the last chunk of a chunked body. It is only
+	// populated once the whole body has been read.
+	Trailer Header
+
+	closer io.Closer // closes src if it needs closing (bodies not read from a bufio.Reader)
+
+	observer  io.Writer // sees every decoded byte as it is read from src, see Observe
+	truncated bool      // whether the body was cut short, see Truncate
 
 	tmpFile      *os.File
 	tmpCompleted bool  // whether the whole body has been written to the temporary file
 	offset       int64 // offset in the temporary file OR offset in reading FROM the tmep file, use for writing the whole thing
 }
 
+// Read reads the decoded body. The first pass reads from the connection and writes everything read
+// into a temporary file. Once the body has been read in full, the pass ends with io.EOF and any
+// following reads replay the temporary file from the start.
 func (buf *Body) Read(p []byte) (n int, err error) {
 	if buf.tmpCompleted {
 		n, err = buf.tmpFile.ReadAt(p, buf.offset)
-		if err != nil && err != io.EOF {
-			if config.DefaultConfig.Debug {
-				slog.Error("http body: failed to read from temporary file", "err", err.Error())
-			}
-			return n, err
-		}
 		buf.offset += int64(n)
-		if buf.offset >= buf.contentLength {
+		if err == io.EOF {
+			if n > 0 {
+				return n, nil // the pass ends with io.EOF on the next read
+			}
 			buf.offset = 0 // reset offset for next read
-			return n, nil
+			return 0, io.EOF
+		}
+		if err != nil && config.DefaultConfig.Debug {
+			slog.Error("http body: failed to read from temporary file", "err", err.Error())
 		}
+		return n, err
 	}
 
-	if buf.readN >= buf.contentLength || buf.buf == nil {
-		buf.buf = nil // release the buffer (we're done reading)
+	if buf.src == nil {
 		return 0, io.EOF
 	}
+	if buf.contentLength >= 0 {
+		remaining := buf.contentLength - buf.readN
+		if remaining <= 0 {
+			buf.complete()
+			buf.offset = 0 // this pass ends here
+			return 0, io.EOF
+		}
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
 
-	n, err = buf.buf.Read(p)
-	if err != nil && err != io.EOF {
+	n, err = buf.src.Read(p)
+	if n > 0 {
+		if werr := buf.writeTmp(p[:n]); werr != nil {
+			return n, werr
+		}
+		if buf.observer != nil {
+			buf.observer.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		if buf.contentLength >= 0 && buf.readN < buf.contentLength {
+			return n, io.ErrUnexpectedEOF
+		}
+		buf.complete()
+		if n > 0 {
+			return n, nil
+		}
+		buf.offset = 0 // this pass ends here
+		return 0, io.EOF
+	}
+	if err != nil {
 		return n, err
 	}
-	maxRead := int(buf.contentLength - buf.readN)
-	if n > maxRead {
-		n = maxRead
-		clear(p[n:]) // clear the rest of the buffer
+	if buf.contentLength >= 0 && buf.readN >= buf.contentLength {
+		buf.complete()
 	}
-	buf.readN += int64(n)
+	return n, nil
+}
 
+// writeTmp appends p to the temporary file, creating it if needed.
+func (buf *Body) writeTmp(p []byte) error {
 	if buf.tmpFile == nil {
+		var err error
 		buf.tmpFile, err = os.CreateTemp("", "cap-http-request-body-*")
 		if err != nil {
 			if config.DefaultConfig.Debug {
 				slog.Error("http body: failed to create temporary file", "err", err.Error())
 			}
-			return n, err
+			return err
 		}
 		buf.offset = 0
 	}
-	_, err = buf.tmpFile.WriteAt(p[:n], buf.offset)
+	_, err := buf.tmpFile.WriteAt(p, buf.offset)
 	if err != nil {
 		if config.DefaultConfig.Debug {
 			slog.Error("http body: failed to write to temporary file", "err", err.Error())
 		}
-		return n, err
+		return err
 	}
-	buf.offset += int64(n)
-	if buf.offset >= buf.contentLength {
-		buf.tmpCompleted = true
-		buf.offset = 0
-	}
-
-	return n, nil
+	buf.offset += int64(len(p))
+	buf.readN += int64(len(p))
+	return nil
 }
 
-func (buf *Body) WriteTo(w io.Writer) (n int64, err error) {
-	if buf.tmpCompleted {
-		return buf.tmpFile.WriteTo(w)
+// complete marks the body as fully read. The content length becomes the amount of decoded bytes
+// read and the offset is left at the end so the current pass ends with io.EOF.
+func (buf *Body) complete() {
+	buf.contentLength = buf.readN
+	buf.buf = nil // release the buffer (we're done reading)
+	buf.src = nil
+	if buf.tmpFile != nil {
+		buf.tmpCompleted = true
+		buf.offset = buf.readN
 	}
+}
 
-	if buf.buf == nil {
-		return 0, nil // nothing to write
+// Buffer reads the rest of the body into the temporary file. After Buffer returns without error,
+// ContentLength reports the real (decoded) length of the body.
+func (buf *Body) Buffer() error {
+	if buf.tmpCompleted || buf.src == nil {
+		return nil
 	}
-
-	if buf.tmpFile == nil {
-		buf.tmpFile, err = os.CreateTemp("", "cap-http-request-body-*")
+	p := make([]byte, 32*1024)
+	for {
+		_, err := buf.Read(p)
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			if config.DefaultConfig.Debug {
-				slog.Error("http body: failed to create temporary file", "err", err.Error())
-			}
-			return 0, err
+			return err
 		}
-		buf.offset = 0
 	}
+}
 
-	// Copy from buffer to tmp file until contentLength is reached
-	tmpBuf := make([]byte, 32*1024)
-	for buf.readN < buf.contentLength {
-		maxRead := int64(len(tmpBuf))
-		if buf.contentLength-buf.readN < maxRead {
-			maxRead = buf.contentLength - buf.readN
+// WriteTo writes the whole decoded body to w. If the body has not been read in full yet, the part
+// already read is written first and the rest is forwarded to w as it arrives (while still being
+// written to the temporary file).
+func (buf *Body) WriteTo(w io.Writer) (n int64, err error) {
+	if !buf.tmpCompleted && buf.src != nil {
+		if buf.readN > 0 {
+			n, err = io.Copy(w, io.NewSectionReader(buf.tmpFile, 0, buf.readN))
+			if err != nil {
+				return n, err
+			}
 		}
-		readN, readErr := buf.buf.Read(tmpBuf[:maxRead])
-		if readN > 0 {
-			_, writeErr := buf.tmpFile.WriteAt(tmpBuf[:readN], buf.offset)
-			if writeErr != nil {
-				if config.DefaultConfig.Debug {
-					slog.Error("http body: failed to write to temporary file", "err", writeErr.Error())
+		p := make([]byte, 32*1024)
+		for {
+			readN, readErr := buf.Read(p)
+			if readN > 0 {
+				writeN, writeErr := w.Write(p[:readN])
+				n += int64(writeN)
+				if writeErr != nil {
+					return n, writeErr
 				}
-				return n, writeErr
 			}
-			buf.offset += int64(readN)
-			buf.readN += int64(readN)
-		}
-		if readErr != nil {
 			if readErr == io.EOF {
-				break
+				return n, nil
+			}
+			if readErr != nil {
+				return n, readErr
 			}
-			return n, readErr
 		}
 	}
+	if buf.tmpFile == nil {
+		return 0, nil // nothing to write
+	}
+	return io.Copy(w, io.NewSectionReader(buf.tmpFile, 0, buf.contentLength))
+}
 
-	buf.tmpCompleted = true
-	buf.offset = 0
-	buf.buf = nil // release memory
-
-	// Reset file read pointer and write to output
-	_, err = buf.tmpFile.Seek(0, io.SeekStart)
-	if err != nil {
-		if config.DefaultConfig.Debug {
-			slog.Error("http body: failed to seek in temporary file", "err", err.Error())
-		}
-		return 0, err
+// encode writes the body to w the way it is framed on the wire: chunked bodies are written
+// as chunks followed by their trailers, other bodies are written as is.
+func (buf *Body) encode(w io.Writer) error {
+	if !buf.chunked {
+		_, err := buf.WriteTo(w)
+		return err
 	}
-	return io.Copy(w, buf.tmpFile)
+	cw := &chunkedWriter{w: w}
+	if _, err := buf.WriteTo(cw); err != nil {
+		return err
+	}
+	return cw.close(buf.Trailer)
 }
 
+// ContentLength returns the length of the decoded body, or -1 if it is not known yet.
 func (b *Body) ContentLength() int64 {
 	return b.contentLength
 }
 
+// BytesRead returns how many bytes of the decoded body were read from its source so far.
+func (b *Body) BytesRead() int64 {
+	return b.readN
+}
+
+// Complete reports whether the body has been read in full (or has nothing left to read).
+func (b *Body) Complete() bool {
+	return b.src == nil && !b.truncated
+}
+
+// Observe makes w see the rest of the decoded body as it is read from its source (e.g. to parse a stream
+// while it is forwarded). Write errors of w are ignored.
+func (b *Body) Observe(w io.Writer) {
+	b.observer = w
+}
+
+// Truncate ends the body at the bytes read so far, the rest is never read. It is used when the body stops
+// being forwarded midway (e.g. the client went away during an endless stream), so what was forwarded can
+// still be saved. The body is not Complete afterwards, since its source was not read in full.
+func (b *Body) Truncate() {
+	if b.src == nil {
+		return
+	}
+	b.truncated = true
+	b.contentLength = b.readN
+	b.buf = nil
+	b.src = nil
+	if b.tmpFile != nil {
+		b.tmpCompleted = true
+	}
+	b.offset = 0
+}
+
+// Chunked reports whether the body is framed with Transfer-Encoding: chunked.
+func (b *Body) Chunked() bool {
+	return b.chunked
+}
+
 // this func is named close body in order to avoid ncruces/go-sqlite3 from closing it? (that's not even documented behavior :/)
 // NOTE: instead of renaming closebody use the new utils.go NoOpCloser
 func (buf *Body) CloseBody() error {
+	buf.buf = nil // release the buffer
+	buf.src = nil
+	if buf.closer != nil {
+		buf.closer.Close()
+		buf.closer = nil
+	}
 	if buf.tmpFile != nil {
-		return buf.tmpFile.Close()
+		name := buf.tmpFile.Name()
+		err := buf.tmpFile.Close()
+		os.Remove(name)
+		buf.tmpFile = nil // closing the body again does nothing
+		buf.tmpCompleted = false
+		return err
 	}
-	buf.buf = nil // release the buffer
 	return nil
 }
 
 func NewBody(buf *bufio.Reader, cl int64) *Body {
-	return &Body{
+	b := &Body{
 		buf:           buf,
 		contentLength: cl,
+		Trailer:       make(Header),
+	}
+	if buf != nil {
+		b.src = buf
+	}
+	return b
+}
+
+// NewChunkedBody returns a body that decodes the chunked transfer coding read from buf.
+func NewChunkedBody(buf *bufio.Reader) *Body {
+	b := &Body{
+		buf:           buf,
+		contentLength: -1,
+		chunked:       true,
+		Trailer:       make(Header),
+	}
+	b.src = &chunkedReader{buf: buf, trailer: b.Trailer}
+	return b
+}
+
+// NewBodyFromReader returns a body read from r that is not framed by an HTTP/1 connection (e.g. the body of
+// an HTTP/2 stream). If cl is -1 (unknown), the body is framed as chunked when it is written to an HTTP/1
+// connection. If r is an io.Closer, CloseBody closes it.
+func NewBodyFromReader(r io.Reader, cl int64) *Body {
+	b := &Body{
+		src:           r,
+		contentLength: cl,
+		chunked:       cl < 0,
+		Trailer:       make(Header),
+	}
+	if c, ok := r.(io.Closer); ok {
+		b.closer = c
 	}
+	return b
 }
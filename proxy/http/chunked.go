@@ -0,0 +1,151 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+
+	"github.com/tiredkangaroo/cap/proxy/config"
+)
+
+var (
+	ErrChunkSizeInvalid = errors.New("invalid chunk size line in chunked body")
+)
+
+// chunkedReader decodes a body sent with Transfer-Encoding: chunked.
+//
+//	4\r\n
+//	Wiki\r\n
+//	0\r\n
+//	Trailer: value\r\n
+//	\r\n
+type chunkedReader struct {
+	buf     *bufio.Reader
+	trailer Header
+
+	remaining int64 // bytes left in the current chunk
+	done      bool  // whether the last chunk (and the trailers) have been read
+}
+
+func (cr *chunkedReader) Read(p []byte) (n int, err error) {
+	if cr.done {
+		return 0, io.EOF
+	}
+	if cr.remaining == 0 {
+		size, err := cr.readChunkSize()
+		if err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			// last chunk, the trailer section (which may be empty) follows
+			trailer, err := readHeader(cr.buf)
+			if err != nil {
+				return 0, err
+			}
+			for k, v := range trailer {
+				cr.trailer[k] = v
+			}
+			cr.done = true
+			return 0, io.EOF
+		}
+		cr.remaining = size
+	}
+
+	if int64(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+	n, err = cr.buf.Read(p)
+	cr.remaining -= int64(n)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, err
+	}
+	if cr.remaining == 0 {
+		// every chunk's data is followed by a CRLF
+		if err := cr.readCRLF(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (cr *chunkedReader) readChunkSize() (int64, error) {
+	line, err := cr.buf.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	line = bytes.TrimRight(line, "\r\n")
+	// chunk extensions (;name=value) are ignored
+	if i := bytes.IndexByte(line, ';'); i != -1 {
+		line = line[:i]
+	}
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		if config.DefaultConfig.Debug {
+			slog.Error("http parser: empty chunk size line")
+		}
+		return 0, ErrChunkSizeInvalid
+	}
+	size, err := strconv.ParseInt(b2s(line), 16, 64)
+	if err != nil || size < 0 {
+		if config.DefaultConfig.Debug {
+			slog.Error("http parser: invalid chunk size", "line", b2s(line))
+		}
+		return 0, ErrChunkSizeInvalid
+	}
+	return size, nil
+}
+
+func (cr *chunkedReader) readCRLF() error {
+	line, err := cr.buf.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if len(bytes.TrimRight(line, "\r\n")) != 0 {
+		return ErrProtocolError
+	}
+	return nil
+}
+
+// chunkedWriter encodes everything written to it as chunks. close must be called to write the
+// last chunk and the trailer section.
+type chunkedWriter struct {
+	w io.Writer
+}
+
+func (cw *chunkedWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil // a zero length chunk would end the body
+	}
+	if _, err := fmt.Fprintf(cw.w, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	n, err := cw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if _, err := cw.w.Write([]byte{'\r', '\n'}); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (cw *chunkedWriter) close(trailer Header) error {
+	if _, err := cw.w.Write([]byte("0\r\n")); err != nil {
+		return err
+	}
+	// header.write also writes the CRLF that ends the trailer section
+	return trailer.write(cw.w)
+}
@@ -0,0 +1,197 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestChunkedBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		body    string
+		trailer Header
+		err     error
+	}{
+		{
+			name: "valid",
+			raw:  "4\r\nWiki\r\n5\r\npedia\r\n0\r\n\r\n",
+			body: "Wikipedia",
+		},
+		{
+			name: "extensions and uppercase hex",
+			raw:  "A;name=value\r\n0123456789\r\n0\r\n\r\n",
+			body: "0123456789",
+		},
+		{
+			name:    "trailers",
+			raw:     "4\r\nWiki\r\n0\r\nX-Checksum: abc\r\nX-Other: def\r\n\r\n",
+			body:    "Wiki",
+			trailer: Header{"X-Checksum": {"abc"}, "X-Other": {"def"}},
+		},
+		{
+			name: "empty",
+			raw:  "0\r\n\r\n",
+			body: "",
+		},
+		{
+			name: "invalid size",
+			raw:  "zz\r\nWiki\r\n0\r\n\r\n",
+			err:  ErrChunkSizeInvalid,
+		},
+		{
+			name: "empty size line",
+			raw:  "\r\nWiki\r\n0\r\n\r\n",
+			err:  ErrChunkSizeInvalid,
+		},
+		{
+			name: "negative size",
+			raw:  "-4\r\nWiki\r\n0\r\n\r\n",
+			err:  ErrChunkSizeInvalid,
+		},
+		{
+			name: "oversized size",
+			raw:  "fffffffffffffffff\r\nWiki\r\n0\r\n\r\n",
+			err:  ErrChunkSizeInvalid,
+		},
+		{
+			name: "data longer than its size",
+			raw:  "4\r\nWikipedia\r\n0\r\n\r\n",
+			err:  ErrProtocolError,
+		},
+		{
+			name: "cut short in a chunk",
+			raw:  "9\r\nWiki",
+			err:  io.ErrUnexpectedEOF,
+		},
+		{
+			name: "cut short before the last chunk",
+			raw:  "4\r\nWiki\r\n",
+			err:  io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := NewChunkedBody(bufio.NewReader(strings.NewReader(tt.raw)))
+			t.Cleanup(func() { body.CloseBody() })
+
+			b, err := io.ReadAll(body)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if string(b) != tt.body {
+				t.Errorf("body = %q, want %q", b, tt.body)
+			}
+			if body.ContentLength() != int64(len(tt.body)) {
+				t.Errorf("content length = %d, want %d", body.ContentLength(), len(tt.body))
+			}
+			for k, v := range tt.trailer {
+				if got := body.Trailer.Get(k); got != v[0] {
+					t.Errorf("trailer %s = %q, want %q", k, got, v[0])
+				}
+			}
+		})
+	}
+}
+
+func TestChunkedBodyEncode(t *testing.T) {
+	raw := "4\r\nWiki\r\n5\r\npedia\r\n0\r\nX-Checksum: abc\r\n\r\n"
+	body := NewChunkedBody(bufio.NewReader(strings.NewReader(raw)))
+	t.Cleanup(func() { body.CloseBody() })
+
+	var encoded bytes.Buffer
+	if err := body.encode(&encoded); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	// the chunks are re-encoded as they are read, the decoded body and the trailers must survive
+	decoded := NewChunkedBody(bufio.NewReader(&encoded))
+	t.Cleanup(func() { decoded.CloseBody() })
+	b, err := io.ReadAll(decoded)
+	if err != nil {
+		t.Fatalf("read encoded body: %v", err)
+	}
+	if string(b) != "Wikipedia" {
+		t.Errorf("body = %q, want %q", b, "Wikipedia")
+	}
+	if got := decoded.Trailer.Get("X-Checksum"); got != "abc" {
+		t.Errorf("trailer X-Checksum = %q, want %q", got, "abc")
+	}
+}
+
+func TestBodyReplayAfterPartialRead(t *testing.T) {
+	raw := "4\r\nWiki\r\n5\r\npedia\r\n0\r\n\r\n"
+	body := NewChunkedBody(bufio.NewReader(strings.NewReader(raw)))
+	t.Cleanup(func() { body.CloseBody() })
+
+	p := make([]byte, 3)
+	if _, err := io.ReadFull(body, p); err != nil {
+		t.Fatalf("partial read: %v", err)
+	}
+
+	// the part already read is written first, then the rest as it is read
+	var w bytes.Buffer
+	if _, err := body.WriteTo(&w); err != nil {
+		t.Fatalf("write to: %v", err)
+	}
+	if w.String() != "Wikipedia" {
+		t.Errorf("written body = %q, want %q", w.String(), "Wikipedia")
+	}
+
+	// once read in full, every pass replays the whole body
+	for range 2 {
+		b, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("replay: %v", err)
+		}
+		if string(b) != "Wikipedia" {
+			t.Errorf("replayed body = %q, want %q", b, "Wikipedia")
+		}
+	}
+}
+
+func TestCloseDelimitedBody(t *testing.T) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		server.Write([]byte("HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\nhello, "))
+		server.Write([]byte("world"))
+		server.Close() // the body ends here
+	}()
+
+	resp, err := ReadResponse(client, MethodGet)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.CloseBody() })
+	if !resp.CloseDelimited {
+		t.Error("response without Content-Length or chunked framing is not close-delimited")
+	}
+	if resp.Header.Get("Connection") != "close" {
+		t.Error("close-delimited response does not tell the client to close the connection")
+	}
+	if resp.Body.ContentLength() != -1 {
+		t.Errorf("content length before the body is read = %d, want -1", resp.Body.ContentLength())
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	if string(b) != "hello, world" {
+		t.Errorf("body = %q, want %q", b, "hello, world")
+	}
+	if resp.Body.ContentLength() != int64(len(b)) {
+		t.Errorf("content length = %d, want %d", resp.Body.ContentLength(), len(b))
+	}
+}
@@ -2,6 +2,7 @@ package http
 
 import (
 	"io"
+	"strings"
 )
 
 type Header map[string][]string
@@ -34,6 +35,19 @@ func (header Header) Del(k string) {
 	delete(header, k)
 }
 
+// HasToken reports whether any of the comma-separated values of k contains token (case-insensitive),
+// e.g. Connection: keep-alive, Upgrade.
+func (header Header) HasToken(k, token string) bool {
+	for _, value := range header[k] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (header Header) write(w io.Writer) error {
 	// headers
 	for key, values := range header {
@@ -23,7 +23,15 @@ var (
 
 // we can do pooling of http.Request later
 
+// ReadRequest reads a request from conn. Use ReadRequestFrom to read more than one request from the
+// same connection, since anything buffered past the end of this request is lost.
 func ReadRequest(conn net.Conn) (*Request, error) {
+	return ReadRequestFrom(conn, bufio.NewReader(conn))
+}
+
+// ReadRequestFrom reads a request from buf, which buffers conn. The same buf must be used for every
+// request read from a persistent (keep-alive) connection.
+func ReadRequestFrom(conn net.Conn, buf *bufio.Reader) (*Request, error) {
 	// example request:
 	// POST /cgi-bin/process.cgi HTTP/1.1
 	// User-Agent: Mozilla/4.0 (compatible; MSIE5.01; Windows NT)
@@ -38,7 +46,6 @@ func ReadRequest(conn net.Conn) (*Request, error) {
 	req := NewRequest()
 	req.conn = conn
 
-	buf := bufio.NewReader(conn)
 	data, err := buf.ReadBytes('\n')
 	if err != nil {
 		if config.DefaultConfig.Debug {
@@ -80,10 +87,15 @@ func ReadRequest(conn net.Conn) (*Request, error) {
 		return nil, fmt.Errorf("special headers issue: %w", err)
 	}
 
-	req.Body = NewBody(buf, req.ContentLength)
-	if req.ContentLength == 0 {
-		// if Content-Length is 0, we don't need to read the body. this releases the buffer.
-		req.Body.buf = nil
+	if req.ContentLength == -1 {
+		req.Body = NewChunkedBody(buf)
+	} else {
+		req.Body = NewBody(buf, req.ContentLength)
+		if req.ContentLength == 0 {
+			// if Content-Length is 0, we don't need to read the body. this releases the buffer.
+			req.Body.buf = nil
+			req.Body.src = nil
+		}
 	}
 
 	return req, nil
@@ -95,6 +107,15 @@ func manageSpecialRequestHeaders(req *Request) error {
 		return ErrMissingHostHeader
 	}
 
+	req.Connection = req.Header.Get("Connection")
+
+	if isChunked(req.Header) {
+		// Transfer-Encoding overrides Content-Length, and the two must not be forwarded together
+		req.Header.Del("Content-Length")
+		req.ContentLength = -1
+		return nil
+	}
+
 	contentLength := req.Header.Get("Content-Length")
 	if (req.Method == MethodPost || req.Method == MethodPut || req.Method == MethodPatch) && contentLength == "" {
 		return ErrMissingContentLengthHeader
@@ -107,8 +128,6 @@ func manageSpecialRequestHeaders(req *Request) error {
 		req.ContentLength = int64(cl)
 	}
 
-	req.Connection = req.Header.Get("Connection")
-
 	return nil
 }
 
@@ -3,6 +3,7 @@ package http
 import (
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/url"
 )
@@ -99,15 +100,24 @@ type Request struct {
 }
 
 // Write writes the HTTP request to the provided writer. It writes the request line, headers, and body if present.
+// Requests read from HTTP/2 streams have no connection of their own, but can still be written (e.g. to a host
+// that only speaks HTTP/1.1).
 func (r *Request) Write(w io.Writer) error {
-	if r.conn == nil {
-		return io.ErrClosedPipe
-	}
+	return r.write(w, "", "")
+}
+
+// WriteProxy writes the request to a forward proxy for the host: the request target is in absolute form
+// (http://host/path) and the Proxy-Authorization header is auth, unless it is empty.
+func (r *Request) WriteProxy(w io.Writer, host, auth string) error {
+	return r.write(w, "http://"+host, auth)
+}
 
+func (r *Request) write(w io.Writer, origin, proxyAuth string) error {
 	// request line
 	var requestLine = make([]byte, 0, 64)
 	requestLine = append(requestLine, s2b(r.Method.String())...)
 	requestLine = append(requestLine, ' ')
+	requestLine = append(requestLine, s2b(origin)...)
 	requestLine = append(requestLine, s2b(r.Path)...)
 	requestLine = append(requestLine, queryString(r.Query)...)
 	requestLine = append(requestLine, ' ')
@@ -119,14 +129,18 @@ func (r *Request) Write(w io.Writer) error {
 	}
 
 	// headers
-	if err := r.Header.write(w); err != nil {
+	header := r.Header
+	if proxyAuth != "" {
+		header = maps.Clone(r.Header)
+		header["Proxy-Authorization"] = []string{proxyAuth}
+	}
+	if err := header.write(w); err != nil {
 		return fmt.Errorf("header write: %w", err)
 	}
 
 	// body
 	if r.Body != nil {
-		_, err = r.Body.WriteTo(w)
-		return err
+		return r.Body.encode(w)
 	}
 	return nil
 }
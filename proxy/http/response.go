@@ -213,7 +213,10 @@ type Response struct {
 	StatusCode    StatusCode
 	Header        Header
 	ContentLength int64 // -1 means unknown or not set
-	Body          *Body
+	// CloseDelimited is whether the body has no declared length and ends when the server closes
+	// the connection.
+	CloseDelimited bool
+	Body           *Body
 }
 
 func (r *Response) Write(w io.Writer) error {
@@ -225,7 +228,7 @@ func (r *Response) Write(w io.Writer) error {
 		return fmt.Errorf("write headers: %w", err)
 	}
 	if r.Body != nil {
-		if _, err := r.Body.WriteTo(w); err != nil {
+		if err := r.Body.encode(w); err != nil {
 			return fmt.Errorf("write body: %w", err)
 		}
 	}
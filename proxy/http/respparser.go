@@ -18,7 +18,14 @@ var (
 	ErrInvalidStatusCode   = errors.New("invalid status code in response")
 )
 
-func ReadResponse(conn net.Conn) (*Response, error) {
+// ReadResponse reads a response to a request made with method from conn.
+func ReadResponse(conn net.Conn, method Method) (*Response, error) {
+	return ReadResponseFrom(conn, bufio.NewReader(conn), method)
+}
+
+// ReadResponseFrom reads a response to a request made with method from buf, which buffers conn. The
+// same buf must be used for every response read from a persistent connection.
+func ReadResponseFrom(conn net.Conn, buf *bufio.Reader, method Method) (*Response, error) {
 	// HTTP/1.1 200 OK
 	// Date: Tue, 22 Jun 2024 16:00:00 GMT
 	// Content-Type: text/html; charset=UTF-8
@@ -34,7 +41,6 @@ func ReadResponse(conn net.Conn) (*Response, error) {
 	// </body>
 	// </html>
 
-	buf := bufio.NewReader(conn)
 	resp := NewResponse()
 
 	conn.SetReadDeadline(time.Now().Add(time.Minute))
@@ -43,7 +49,7 @@ func ReadResponse(conn net.Conn) (*Response, error) {
 		if config.DefaultConfig.Debug {
 			slog.Error("http parser: failed to read first line", "err", err.Error())
 		}
-		return nil, ErrProtocolError
+		return nil, err // io.EOF here means the host closed the connection before responding
 	}
 	firstLineData := bytes.Split(data, []byte{' '})
 	if len(firstLineData) < 3 {
@@ -75,21 +81,41 @@ func ReadResponse(conn net.Conn) (*Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := manageSpecialResponseHeaders(resp); err != nil {
+	if err := manageSpecialResponseHeaders(resp, method); err != nil {
 		return nil, fmt.Errorf("special headers issue: %w", err)
 	}
 
 	conn.SetDeadline(time.Time{})
 
-	resp.Body = NewBody(buf, resp.ContentLength)
-	if resp.ContentLength == 0 {
-		resp.Body.buf = nil // release at once
+	if resp.CloseDelimited {
+		resp.Body = NewBody(buf, -1) // read until the server closes the connection
+	} else if resp.ContentLength == -1 {
+		resp.Body = NewChunkedBody(buf)
+	} else {
+		resp.Body = NewBody(buf, resp.ContentLength)
+		if resp.ContentLength == 0 {
+			resp.Body.buf = nil // release at once
+			resp.Body.src = nil
+		}
 	}
 
 	return resp, nil
 }
 
-func manageSpecialResponseHeaders(resp *Response) error {
+func manageSpecialResponseHeaders(resp *Response, method Method) error {
+	if !responseHasBody(resp.StatusCode, method) {
+		// Content-Length (if present) describes the body that would have been sent, there is no body here
+		resp.ContentLength = 0
+		return nil
+	}
+
+	if isChunked(resp.Header) {
+		// Transfer-Encoding overrides Content-Length, and the two must not be forwarded together
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		return nil
+	}
+
 	contentLength := resp.Header.Get("Content-Length")
 	if contentLength != "" {
 		cl, err := strconv.Atoi(contentLength)
@@ -97,6 +123,25 @@ func manageSpecialResponseHeaders(resp *Response) error {
 			return fmt.Errorf("invalid Content-Length header: %w", err)
 		}
 		resp.ContentLength = int64(cl)
+		return nil
 	}
+
+	// neither Content-Length nor chunked: the body ends when the server closes the connection
+	// (HTTP/1.0 and Connection: close servers). the client must see the close too.
+	resp.ContentLength = -1
+	resp.CloseDelimited = true
+	resp.Header.Set("Connection", "close")
 	return nil
 }
+
+// responseHasBody reports whether a response with the given status code to a request made with
+// method can have a body. Responses to HEAD, 1xx, 204 and 304 responses never do.
+func responseHasBody(statusCode StatusCode, method Method) bool {
+	if method == MethodHead {
+		return false
+	}
+	if statusCode/100 == 1 || statusCode == StatusNoContent || statusCode == StatusNotModified {
+		return false
+	}
+	return true
+}
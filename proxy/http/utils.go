@@ -3,9 +3,12 @@ package http
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"io"
 	"log/slog"
 	"net/textproto"
 	"net/url"
+	"strings"
 	"unsafe"
 
 	"github.com/tiredkangaroo/cap/proxy/config"
@@ -15,7 +18,8 @@ func readHeader(buf *bufio.Reader) (Header, error) {
 	rnSuffix := []byte("\r\n")
 	header := make(map[string][]string)
 	// len(data) > 2 is to ensure the thing we just read isn't \r\n (indicates the end of headers)
-	for data, err := buf.ReadBytes('\n'); err == nil && len(data) > 2; data, err = buf.ReadBytes('\n') {
+	data, err := buf.ReadBytes('\n')
+	for ; err == nil && len(data) > 2; data, err = buf.ReadBytes('\n') {
 		// split by ": " to get key and value
 		keyVSplit := bytes.SplitN(data, []byte{':', ' '}, 2)
 		if len(keyVSplit) != 2 {
@@ -38,6 +42,11 @@ func readHeader(buf *bufio.Reader) (Header, error) {
 			header[key] = append(header[key], value)
 		}
 	}
+	// the headers of a message cut short by EOF are taken as they are, but a connection that failed (or timed
+	// out) while they were read is an error
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
 	return header, nil
 }
 
@@ -54,3 +63,13 @@ func queryString(q url.Values) []byte {
 	}
 	return s2b("?" + q.Encode())
 }
+
+// isChunked reports whether the final transfer coding in the Transfer-Encoding header is chunked.
+func isChunked(h Header) bool {
+	te := h["Transfer-Encoding"]
+	if len(te) == 0 {
+		return false
+	}
+	codings := strings.Split(te[len(te)-1], ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+
+	"github.com/tiredkangaroo/cap/proxy/config"
+	"github.com/tiredkangaroo/cap/proxy/http"
+	"github.com/tiredkangaroo/cap/proxy/rules"
+)
+
+// matchRule returns the first intercept rule that matches the request, or nil if none does.
+func (r *Request) matchRule() *rules.Rule {
+	subject := rules.Subject{
+		Host:              r.Host,
+		ClientApplication: r.ClientApplication,
+		ClientIP:          r.ClientIP,
+	}
+	if r.req != nil { // tunnels (see handleNoMITM) have no request of their own
+		subject.Method = r.req.Method.String()
+		subject.Path = r.req.Path
+	}
+	if subject.ClientIP == ThisDevice {
+		subject.ClientIP = "127.0.0.1"
+	}
+	return rules.Match(config.Rules(&config.DefaultConfig.InterceptRules), subject)
+}
+
+// interceptAction decides what happens to the request before it is performed, from the first intercept rule
+// that matches it. If none does, the request is intercepted if approval is required, approved otherwise.
+func (r *Request) interceptAction() rules.Action {
+	if r.rule = r.matchRule(); r.rule != nil {
+		return r.rule.Action
+	}
+	if config.DefaultConfig.RequireApproval {
+		return rules.ActionIntercept
+	}
+	return rules.ActionApprove
+}
+
+// approveResponse decides whether the response may be forwarded to the client. It waits for approval if
+// response approval is required, unless the request was approved by an intercept rule.
+func (r *Request) approveResponse(m *Manager) Approval {
+	if !config.DefaultConfig.RequireResponseApproval || (r.rule != nil && r.rule.Action == rules.ActionApprove) {
+		return ApprovalApproved
+	}
+	return m.RecieveResponseApproval(r)
+}
+
+// approvalTimeoutResponse returns the response sent to the client instead of performing a request (or forwarding
+// its response) that was not approved in time.
+func approvalTimeoutResponse() *http.Response {
+	const body = "the request was not approved in time\n"
+	resp := http.NewResponse()
+	resp.Version = []byte(ProtoHTTP11)
+	resp.StatusCode = http.StatusGatewayTimeout
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.ContentLength = int64(len(body))
+	resp.Body = http.NewBody(bufio.NewReader(strings.NewReader(body)), resp.ContentLength)
+	return resp
+}
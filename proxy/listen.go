@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// unixPrefix is the prefix of listen addresses that are Unix domain sockets (e.g. unix:/tmp/cap.sock).
+const unixPrefix = "unix:"
+
+// listen listens on addr: host:port ([::1]:8000 for IPv6, :8000 for every interface) or unix:/path for a Unix
+// domain socket. A stale socket file left behind at the path is replaced.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen %s: socket is in use", addr)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// listenerGroup is a set of listeners that can be changed while the proxy runs: connections accepted by a
+// listener that is closed are still served.
+type listenerGroup struct {
+	name   string                             // what the listeners are, for logs
+	listen func(string) (net.Listener, error) // opens a listener, listen unless the group needs more
+	serve  func(net.Conn)                     // serves an accepted connection
+
+	mu        sync.Mutex
+	listeners map[string]net.Listener // by address
+}
+
+func newListenerGroup(name string, serve func(net.Conn)) *listenerGroup {
+	return &listenerGroup{
+		name:      name,
+		listen:    listen,
+		serve:     serve,
+		listeners: make(map[string]net.Listener),
+	}
+}
+
+// Set makes the group listen on addrs: it listens on the addresses it does not listen on yet and then closes
+// the listeners of the addresses that are not in addrs anymore. If it fails to listen on an address, the
+// group is left as it was.
+func (g *listenerGroup) Set(addrs []string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	want := make(map[string]bool, len(addrs))
+	opened := make(map[string]net.Listener)
+	for _, addr := range addrs {
+		want[addr] = true
+		if _, ok := g.listeners[addr]; ok || opened[addr] != nil {
+			continue
+		}
+		l, err := g.listen(addr)
+		if err != nil {
+			for _, l := range opened {
+				l.Close()
+			}
+			return fmt.Errorf("%s listener: %w", g.name, err)
+		}
+		opened[addr] = l
+	}
+
+	for addr, l := range g.listeners {
+		if !want[addr] {
+			l.Close()
+			delete(g.listeners, addr)
+			slog.Info("stopped listening", "listener", g.name, "addr", addr)
+		}
+	}
+	for addr, l := range opened {
+		g.listeners[addr] = l
+		go g.accept(l)
+		slog.Info("listening", "listener", g.name, "addr", l.Addr().String())
+	}
+	return nil
+}
+
+func (g *listenerGroup) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error("failed to accept connection", "listener", g.name, "err", err.Error())
+			continue
+		}
+		go g.serve(conn)
+	}
+}
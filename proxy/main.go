@@ -2,6 +2,9 @@ package main
 
 import (
 	_ "embed"
+	"flag"
+	"fmt"
+	"path"
 	"path/filepath"
 
 	"log/slog"
@@ -9,6 +12,14 @@ import (
 	"os"
 
 	"github.com/google/uuid"
+
+	"github.com/tiredkangaroo/cap/proxy/ca"
+	"github.com/tiredkangaroo/cap/proxy/config"
+	"github.com/tiredkangaroo/cap/proxy/mock"
+	"github.com/tiredkangaroo/cap/proxy/remote"
+	"github.com/tiredkangaroo/cap/proxy/rewrite"
+	"github.com/tiredkangaroo/cap/proxy/rules"
+	"github.com/tiredkangaroo/cap/proxy/upstream"
 )
 
 var myLocalIP string
@@ -29,6 +40,21 @@ func init() {
 func main() {
 	slog.SetLogLoggerLevel(slog.LevelInfo)
 
+	rp := &config.DefaultConfig.ReverseProxy
+	listen := flag.String("listen", "", "comma-separated addresses of the proxy listeners (host:port or unix:/path)")
+	controlListen := flag.String("control-listen", "", "address of the control server (host:port or unix:/path)")
+	flag.StringVar(&rp.Target, "reverse", "", "run as a reverse proxy in front of the backend at this url (e.g. http://localhost:3000, or http://localhost:3000/api to prefix request paths)")
+	flag.StringVar(&rp.CertFile, "cert", "", "certificate file to terminate TLS with in reverse proxy mode")
+	flag.StringVar(&rp.KeyFile, "key", "", "key file to terminate TLS with in reverse proxy mode")
+	flag.BoolVar(&rp.PreserveHost, "preserve-host", false, "keep the Host header of clients in reverse proxy mode")
+	flag.Parse()
+	if *listen != "" {
+		config.DefaultConfig.ProxyListen = config.SplitAddresses(*listen)
+	}
+	if *controlListen != "" {
+		config.DefaultConfig.ControlListen = *controlListen
+	}
+
 	var dirname string
 	if os.Getenv("BUILT") != "false" {
 		execFile, err := os.Executable()
@@ -51,7 +77,83 @@ func main() {
 
 	m := NewManager(db)
 
-	ph := new(ProxyHandler)
+	for _, err := range prepareRuleLists(config.DefaultConfig) {
+		slog.Warn("invalid "+err.kind, "id", err.id, "err", err.err.Error())
+	}
+	for _, u := range config.DefaultConfig.ProxyUsers {
+		if err := u.Validate(); err != nil {
+			slog.Warn("invalid proxy user", "username", u.Username, "err", err.Error())
+		}
+	}
+	for _, entry := range append(config.DefaultConfig.ClientAllow, config.DefaultConfig.ClientDeny...) {
+		if err := rules.ValidateIP(entry); err != nil {
+			slog.Warn("invalid client allow/deny entry (it never matches)", "entry", entry, "err", err.Error())
+		}
+	}
+	for _, glob := range append(config.DefaultConfig.MITMInclude, config.DefaultConfig.MITMExclude...) {
+		if _, err := path.Match(glob, ""); err != nil {
+			slog.Warn("invalid mitm include/exclude glob (it never matches)", "glob", glob, "err", err.Error())
+		}
+	}
+	switch config.DefaultConfig.CAKeyType {
+	case "", ca.KeyTypeECDSA, ca.KeyTypeRSA:
+	default:
+		slog.Warn("invalid ca key type (a ca cannot be generated)", "ca_key_type", config.DefaultConfig.CAKeyType)
+	}
+	if config.DefaultConfig.ProxyAuth && len(config.DefaultConfig.ProxyUsers) == 0 {
+		slog.Warn("proxy authentication is enabled without any proxy users, every client will be rejected")
+	}
+
+	ph := NewProxyHandler()
+	// the certificates are initialized before the control server starts, its CA endpoints use them
+	ph.Init(dirname)
 	go startControlServer(m, ph)
-	ph.ListenAndServe(m, dirname)
+	ph.ListenAndServe(m)
+}
+
+// ruleError is the error of an invalid rule of a rule list of the config.
+type ruleError struct {
+	kind string // of rule, e.g. "intercept rule"
+	id   string
+	err  error
+}
+
+func (e *ruleError) Error() string {
+	return fmt.Sprintf("invalid %s %s: %s", e.kind, e.id, e.err.Error())
+}
+
+func (e *ruleError) Unwrap() error {
+	return e.err
+}
+
+// prepareRuleLists gives the rules of the lists of c that have no ID (e.g. the ones written into the config
+// file by hand) one, and returns the errors of the invalid ones.
+func prepareRuleLists(c *config.Config) []*ruleError {
+	var errs []*ruleError
+	errs = prepareRules(errs, c.InterceptRules, "intercept rule", (*rules.Rule).Validate,
+		func(r *rules.Rule) *string { return &r.ID })
+	errs = prepareRules(errs, c.RewriteRules, "rewrite rule", (*rewrite.Rule).Validate,
+		func(r *rewrite.Rule) *string { return &r.ID })
+	errs = prepareRules(errs, c.MockRules, "mock rule", (*mock.Rule).Validate,
+		func(r *mock.Rule) *string { return &r.ID })
+	errs = prepareRules(errs, c.MapRemoteRules, "map remote rule", (*remote.Rule).Validate,
+		func(r *remote.Rule) *string { return &r.ID })
+	errs = prepareRules(errs, c.UpstreamProxies, "upstream proxy", (*upstream.Proxy).Validate,
+		func(p *upstream.Proxy) *string { return &p.ID })
+	return errs
+}
+
+// prepareRules prepares the rules of list (see prepareRuleLists), kind names them in the errors appended to
+// errs.
+func prepareRules[R any](errs []*ruleError, list []R, kind string, validate func(*R) error, id func(*R) *string) []*ruleError {
+	for i := range list {
+		rule := &list[i]
+		if *id(rule) == "" {
+			*id(rule) = newID()
+		}
+		if err := validate(rule); err != nil {
+			errs = append(errs, &ruleError{kind: kind, id: *id(rule), err: err})
+		}
+	}
+	return errs
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/cap/proxy/config"
+)
+
+// Why a request over TLS was tunneled although MITM is enabled (see Request.MITMBypass).
+const (
+	MITMBypassExcluded = "excluded" // by the MITM include and exclude lists
+	MITMBypassPinned   = "pinned"   // a client rejected the certificate of the host before (see pinnedHosts)
+)
+
+// ErrCertificateRejected is returned when a client aborts the TLS handshake after it was sent the certificate
+// generated for the host, most likely because the app pins the certificate of the host.
+var ErrCertificateRejected = errors.New("client rejected the certificate of the host")
+
+const (
+	// pinFailures is how many handshakes in a row a client must abort after it was sent the certificate of a
+	// host for the host to be pinned for it: a single abort may be the user giving up, or a network error.
+	pinFailures = 3
+	// pinDuration is how long a host stays pinned for a client, in case the app stops pinning it.
+	pinDuration = 24 * time.Hour
+)
+
+// pinKey is a host (host:port) as reached by a client: the application that connects to it if it is known
+// (see getClientProcessInfo), the IP address of the client otherwise.
+type pinKey struct {
+	client string
+	host   string
+}
+
+// pinnedHost is a host whose certificate a client rejected.
+type pinnedHost struct {
+	Client string // the application or the IP address of the client
+	Host   string // host:port
+	Since  time.Time
+	Until  time.Time // when the host is MITM'd again for the client
+	Error  string    // how the client aborted the last handshake
+}
+
+// pinnedHosts remembers the hosts whose certificates clients rejected, so the connections of those clients to
+// them are tunneled instead of MITM'd until the pins expire or are forgotten (or the proxy restarts). Other
+// clients of the same hosts are still MITM'd.
+type pinnedHosts struct {
+	mu       sync.Mutex
+	hosts    map[pinKey]pinnedHost
+	failures map[pinKey]int // the handshakes in a row clients aborted, for hosts not pinned yet
+}
+
+func newPinnedHosts() *pinnedHosts {
+	return &pinnedHosts{hosts: make(map[pinKey]pinnedHost), failures: make(map[pinKey]int)}
+}
+
+// reject records that a client aborted a handshake with the certificate of a host, and reports whether the
+// host is pinned for it now.
+func (p *pinnedHosts) reject(key pinKey, err error) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures[key]++
+	if p.failures[key] < pinFailures {
+		return false
+	}
+	delete(p.failures, key)
+	now := time.Now()
+	p.hosts[key] = pinnedHost{
+		Client: key.client,
+		Host:   key.host,
+		Since:  now,
+		Until:  now.Add(pinDuration),
+		Error:  err.Error(),
+	}
+	return true
+}
+
+// accept records that a client completed a handshake with the certificate of a host: the aborted ones before
+// it no longer count.
+func (p *pinnedHosts) accept(key pinKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.failures, key)
+}
+
+func (p *pinnedHosts) has(key pinKey) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.hosts[key]
+	if ok && time.Now().After(h.Until) {
+		delete(p.hosts, key)
+		return false
+	}
+	return ok
+}
+
+// list returns the pinned hosts that have not expired, most recently pinned first.
+func (p *pinnedHosts) list() []pinnedHost {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	list := make([]pinnedHost, 0, len(p.hosts))
+	for key, h := range p.hosts {
+		if now.After(h.Until) {
+			delete(p.hosts, key)
+			continue
+		}
+		list = append(list, h)
+	}
+	slices.SortFunc(list, func(a, b pinnedHost) int { return b.Since.Compare(a.Since) })
+	return list
+}
+
+// forget forgets host for every client, or every host if it is empty.
+func (p *pinnedHosts) forget(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if host == "" {
+		clear(p.hosts)
+		clear(p.failures)
+		return
+	}
+	for key := range p.hosts {
+		if key.host == host {
+			delete(p.hosts, key)
+		}
+	}
+	for key := range p.failures {
+		if key.host == host {
+			delete(p.failures, key)
+		}
+	}
+}
+
+// pinKey returns the key the host of r is pinned by for its client.
+func (r *Request) pinKey() pinKey {
+	client := r.ClientApplication
+	if client == "" {
+		client = r.ClientIP
+	}
+	return pinKey{client: client, host: r.Host}
+}
+
+// decideMITM decides whether a request over TLS that MITM is enabled for is MITM'd: it is tunneled instead if
+// its host is excluded or pinned, and MITMBypass says why. It must be called before the request is sent to
+// live websocket connections.
+func (r *Request) decideMITM(m *Manager) {
+	if r.Kind != RequestKindHTTPSMITM {
+		return
+	}
+	switch {
+	case !config.DefaultConfig.MITMHost(r.Host):
+		r.MITMBypass = MITMBypassExcluded
+	case m.pinned.has(r.pinKey()):
+		r.MITMBypass = MITMBypassPinned
+	default:
+		return
+	}
+	r.Kind = RequestKindHTTPS
+}
+
+// serverFlightMin is more than any alert the proxy sends on its own during a handshake: if more was written to
+// the client, it was sent the certificate.
+const serverFlightMin = 64
+
+// certificateRejected reports whether a TLS handshake with a client failed with err because the client
+// rejected the certificate it was sent: it answered it with an alert, or aborted the handshake once it got it
+// (clients differ: some hang up, some send an alert the proxy cannot read). written is how many bytes were
+// written to the client during the handshake.
+func certificateRejected(err error, written int64) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		return true // e.g. "tls: bad certificate" or "tls: unknown certificate authority"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false // the client is slow, not picky
+	}
+	return written > serverFlightMin
+}
+
+// pinHost records whether the client of r rejected the certificate of its host in a handshake that failed with
+// err (see certificateRejected), and returns the error the request fails with. The host is pinned for the client
+// once it rejected it pinFailures times in a row.
+func (r *Request) pinHost(m *Manager, err error, written int64) error {
+	if !certificateRejected(err, written) {
+		return err
+	}
+	key := r.pinKey()
+	if m.pinned.reject(key, err) {
+		slog.Warn("client rejected the certificate of the host repeatedly, tunneling it for the client", "host", r.Host,
+			"client", key.client, "until", time.Now().Add(pinDuration), "err", err.Error())
+	}
+	return fmt.Errorf("%w: %w", ErrCertificateRejected, err)
+}
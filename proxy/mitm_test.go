@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPinnedHosts(t *testing.T) {
+	p := newPinnedHosts()
+	key := pinKey{client: "app", host: "example.com:443"}
+	other := pinKey{client: "other app", host: "example.com:443"}
+	errAborted := errors.New("handshake aborted")
+
+	for i := 1; i < pinFailures; i++ {
+		if p.reject(key, errAborted) {
+			t.Fatalf("host pinned after %d aborted handshakes, want %d", i, pinFailures)
+		}
+	}
+	// a completed handshake resets the count
+	p.accept(key)
+	for i := 1; i < pinFailures; i++ {
+		p.reject(key, errAborted)
+	}
+	if p.has(key) {
+		t.Fatal("host pinned although a handshake was completed in between")
+	}
+	if !p.reject(key, errAborted) {
+		t.Fatalf("host not pinned after %d aborted handshakes in a row", pinFailures)
+	}
+	if !p.has(key) {
+		t.Fatal("pinned host is not reported as pinned")
+	}
+	if p.has(other) {
+		t.Fatal("host pinned for another client")
+	}
+	if list := p.list(); len(list) != 1 || list[0].Client != key.client || list[0].Error != errAborted.Error() {
+		t.Fatalf("list = %+v, want the pin of %v", list, key)
+	}
+
+	p.forget(key.host)
+	if p.has(key) {
+		t.Fatal("forgotten host is still pinned")
+	}
+}
+
+func TestPinnedHostsExpire(t *testing.T) {
+	p := newPinnedHosts()
+	key := pinKey{client: "app", host: "example.com:443"}
+	for range pinFailures {
+		p.reject(key, errors.New("handshake aborted"))
+	}
+	if until := p.list()[0].Until; time.Until(until) > pinDuration {
+		t.Errorf("pin expires in %v, want at most %v", time.Until(until), pinDuration)
+	}
+
+	expire := func() {
+		p.mu.Lock()
+		h := p.hosts[key]
+		h.Until = time.Now().Add(-time.Second)
+		p.hosts[key] = h
+		p.mu.Unlock()
+	}
+	expire()
+	if p.has(key) {
+		t.Error("expired pin is still reported")
+	}
+	for range pinFailures {
+		p.reject(key, errors.New("handshake aborted"))
+	}
+	expire()
+	if list := p.list(); len(list) != 0 {
+		t.Errorf("list = %+v, want no expired pins", list)
+	}
+}
@@ -0,0 +1,289 @@
+// Package mock builds responses for requests from local files, directories or inline templates, so
+// endpoints can be stubbed without the host being dialed (Map Local).
+package mock
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/tiredkangaroo/cap/proxy/regexps"
+	"github.com/tiredkangaroo/cap/proxy/rules"
+)
+
+var (
+	ErrNoSource     = errors.New("mock rule must have at most one of file, directory or an inline body")
+	ErrInvalidCode  = errors.New("mock rule status code must be between 200 and 999")
+	ErrEmptyMatcher = errors.New("mock rule must match on host or path")
+)
+
+// Rule serves a mocked response to every request it matches. The response is built from File, from the
+// file under Directory the path of the request maps to, or inline from StatusCode, Headers and Body.
+type Rule struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled"`
+
+	// Host is a glob the host must match (see rules.MatchHost).
+	Host string `json:"host"`
+	// Path is a regular expression the path of the request must match. For a Directory rule, the part of
+	// the path it matches at the start is stripped before the rest is mapped to a file under Directory.
+	Path string `json:"path"`
+	// Method is matched case-insensitively against the method of the request. Every method matches if it
+	// is empty.
+	Method string `json:"method"`
+
+	File      string `json:"file"`
+	Directory string `json:"directory"`
+
+	// StatusCode is the status code of the response, 200 if it is 0 (404 for a Directory rule that maps
+	// to no file).
+	StatusCode int `json:"status_code"`
+	// Headers are added to the response. They override the Content-Type guessed for File and Directory
+	// rules.
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+	// Template is whether Body is a text/template executed with the request (see TemplateData).
+	Template bool `json:"template"`
+}
+
+// Subject is the request a rule is matched against and responds to.
+type Subject struct {
+	Host   string // host:port
+	Method string
+	Path   string
+	Query  url.Values
+	Header map[string][]string
+}
+
+// TemplateData is what the template of an inline body is executed with, e.g. {{.Path}} or
+// {{index .Query "id"}}.
+type TemplateData struct {
+	Host   string
+	Method string
+	Path   string
+	Query  map[string]string // first value of every query parameter
+	Header map[string]string // first value of every header
+}
+
+// Response is a mocked response. Body must be closed.
+type Response struct {
+	StatusCode    int
+	Header        map[string][]string
+	Body          io.ReadCloser
+	ContentLength int64
+}
+
+// Validate reports whether the rule is well formed.
+func (r *Rule) Validate() error {
+	if r.Host == "" && r.Path == "" {
+		return ErrEmptyMatcher
+	}
+	sources := 0
+	if r.File != "" {
+		sources++
+	}
+	if r.Directory != "" {
+		sources++
+	}
+	if r.Body != "" {
+		sources++
+	}
+	if sources > 1 {
+		return ErrNoSource
+	}
+	// informational responses are not final, a client would wait for the response that follows
+	if r.StatusCode != 0 && (r.StatusCode < 200 || r.StatusCode > 999) {
+		return ErrInvalidCode
+	}
+	if _, err := path.Match(r.Host, ""); err != nil {
+		return fmt.Errorf("invalid host glob: %w", err)
+	}
+	if _, err := regexps.Compile(r.Path); err != nil {
+		return fmt.Errorf("invalid path regex: %w", err)
+	}
+	if r.Template {
+		if _, err := template.New("body").Parse(r.Body); err != nil {
+			return fmt.Errorf("invalid body template: %w", err)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the rule matches s. A disabled (or invalid) rule never matches.
+func (r *Rule) Matches(s Subject) bool {
+	if r.Disabled {
+		return false
+	}
+	if r.Host != "" && !rules.MatchHost(r.Host, s.Host) {
+		return false
+	}
+	if r.Path != "" {
+		re, err := regexps.Compile(r.Path)
+		if err != nil || !re.MatchString(s.Path) {
+			return false
+		}
+	}
+	return r.Method == "" || strings.EqualFold(r.Method, s.Method)
+}
+
+// Match returns the first rule that matches s, or nil if none does.
+func Match(rs []Rule, s Subject) *Rule {
+	for i := range rs {
+		if rs[i].Matches(s) {
+			return &rs[i]
+		}
+	}
+	return nil
+}
+
+// Respond builds the response of the rule to s.
+func (r *Rule) Respond(s Subject) (*Response, error) {
+	switch {
+	case r.File != "":
+		return r.respondFile(r.File)
+	case r.Directory != "":
+		name, err := r.directoryFile(s.Path)
+		if err != nil {
+			return r.respondNotFound(), nil
+		}
+		return r.respondFile(name)
+	default:
+		return r.respondInline(s)
+	}
+}
+
+// directoryFile returns the file under Directory the path maps to (index.html for a directory).
+func (r *Rule) directoryFile(p string) (string, error) {
+	if r.Path != "" {
+		if re, err := regexps.Compile(r.Path); err == nil {
+			if loc := re.FindStringIndex(p); loc != nil && loc[0] == 0 {
+				p = p[loc[1]:]
+			}
+		}
+	}
+	// cleaned as an absolute path first, so the path cannot climb out of the directory
+	name := filepath.Join(r.Directory, filepath.FromSlash(path.Clean("/"+p)))
+	info, err := os.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		name = filepath.Join(name, "index.html")
+		if _, err := os.Stat(name); err != nil {
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+func (r *Rule) respondFile(name string) (*Response, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r.respondNotFound(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open mock file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("stat mock file: %w", err)
+	}
+	if info.IsDir() {
+		f.Close()
+		return r.respondNotFound(), nil
+	}
+
+	resp := r.newResponse(info.Size())
+	if _, ok := resp.Header["Content-Type"]; !ok {
+		if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+			resp.Header["Content-Type"] = []string{ctype}
+		} else {
+			resp.Header["Content-Type"] = []string{"application/octet-stream"}
+		}
+	}
+	resp.Body = f
+	return resp, nil
+}
+
+func (r *Rule) respondNotFound() *Response {
+	const body = "mock file not found\n"
+	resp := &Response{
+		StatusCode: 404,
+		Header: map[string][]string{
+			"Content-Type":   {"text/plain; charset=utf-8"},
+			"Content-Length": {strconv.Itoa(len(body))},
+		},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	return resp
+}
+
+func (r *Rule) respondInline(s Subject) (*Response, error) {
+	body := []byte(r.Body)
+	if r.Template {
+		tmpl, err := template.New("body").Parse(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("parse mock body template: %w", err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, templateData(s)); err != nil {
+			return nil, fmt.Errorf("execute mock body template: %w", err)
+		}
+		body = buf.Bytes()
+	}
+	resp := r.newResponse(int64(len(body)))
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// newResponse returns a response with the status code and headers of the rule, for a body of length cl.
+func (r *Rule) newResponse(cl int64) *Response {
+	resp := &Response{
+		StatusCode:    r.StatusCode,
+		Header:        make(map[string][]string, len(r.Headers)+1),
+		ContentLength: cl,
+	}
+	if resp.StatusCode == 0 {
+		resp.StatusCode = 200
+	}
+	for k, v := range r.Headers {
+		resp.Header[k] = append([]string(nil), v...)
+	}
+	resp.Header["Content-Length"] = []string{strconv.FormatInt(cl, 10)}
+	delete(resp.Header, "Transfer-Encoding")
+	return resp
+}
+
+func templateData(s Subject) TemplateData {
+	data := TemplateData{
+		Host:   s.Host,
+		Method: s.Method,
+		Path:   s.Path,
+		Query:  make(map[string]string, len(s.Query)),
+		Header: make(map[string]string, len(s.Header)),
+	}
+	for k, v := range s.Query {
+		if len(v) > 0 {
+			data.Query[k] = v[0]
+		}
+	}
+	for k, v := range s.Header {
+		if len(v) > 0 {
+			data.Header[k] = v[0]
+		}
+	}
+	return data
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/tiredkangaroo/cap/proxy/config"
+	"github.com/tiredkangaroo/cap/proxy/http"
+	"github.com/tiredkangaroo/cap/proxy/mock"
+	"github.com/tiredkangaroo/cap/proxy/timing"
+)
+
+// mockResponse returns the response of the first mock rule that matches the request, or nil if none does.
+// A mocked request is marked as such and never reaches the host.
+func (r *Request) mockResponse() (*http.Response, error) {
+	subject := mock.Subject{
+		Host:   r.Host,
+		Method: r.req.Method.String(),
+		Path:   r.req.Path,
+		Query:  r.req.Query,
+		Header: r.req.Header,
+	}
+	rule := mock.Match(config.Rules(&config.DefaultConfig.MockRules), subject)
+	if rule == nil {
+		return nil, nil
+	}
+
+	r.timing.Substart(timing.SubtimeMock)
+	defer r.timing.Substop()
+	mresp, err := rule.Respond(subject)
+	if err != nil {
+		return nil, fmt.Errorf("mock %s: %w", rule.ID, err)
+	}
+
+	resp := http.NewResponse()
+	resp.Version = []byte(ProtoHTTP11)
+	resp.StatusCode = http.StatusCode(mresp.StatusCode)
+	resp.Header = http.Header(mresp.Header)
+	resp.ContentLength = mresp.ContentLength
+	resp.Body = http.NewBodyFromReader(mresp.Body, mresp.ContentLength)
+	r.Mocked = true
+	return resp, nil
+}
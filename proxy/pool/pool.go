@@ -0,0 +1,169 @@
+package pool
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/tiredkangaroo/cap/proxy/config"
+)
+
+// Key identifies the upstream connections that can be used interchangeably. Connections are only ever
+// shared between requests with an equal key.
+type Key struct {
+	// Host is the host:port dialed.
+	Host string
+	// TLS is whether the connection is a TLS connection.
+	TLS bool
+	// TLSConfig identifies the TLS config the connection was made with (empty for plain connections). Two
+	// requests that would verify the host differently must not share a connection.
+	TLSConfig string
+	// Via is the URL of the upstream proxy the connection goes through (empty for direct connections).
+	Via string
+}
+
+// Conn is an upstream connection that can be returned to the pool once the response read from it has been
+// read in full. Buf must be used to read responses from it, since it may hold bytes read past a response.
+//
+// If the host negotiated HTTP/2, H2 is the client connection running on top of it and requests must be
+// sent through it instead (Buf is unused).
+type Conn struct {
+	net.Conn
+	Buf *bufio.Reader
+	H2  *http2.ClientConn
+	// Reused is whether the connection was taken from the pool rather than freshly dialed.
+	Reused bool
+	// Info is what its user derived from the connection once it was dialed (e.g. what was negotiated in its
+	// TLS handshake), kept with it for the requests that reuse it.
+	Info any
+
+	key       Key
+	idleSince time.Time
+}
+
+// Pool keeps idle upstream connections per Key so they can be reused by later requests to the same host
+// instead of dialing (and performing a TLS handshake) every time.
+type Pool struct {
+	mu   sync.Mutex
+	idle map[Key][]*Conn
+
+	janitorOnce sync.Once
+}
+
+// Get returns a healthy idle connection for key, or nil if there is none. Connections that have been idle
+// for too long, or that the host has closed in the meantime, are closed and skipped.
+func (p *Pool) Get(key Key) *Conn {
+	if config.DefaultConfig.DisableUpstreamPooling {
+		return nil
+	}
+	for {
+		p.mu.Lock()
+		conns := p.idle[key]
+		if len(conns) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		// most recently used first, it is the least likely to have been closed by the host
+		c := conns[len(conns)-1]
+		p.idle[key] = conns[:len(conns)-1]
+		p.mu.Unlock()
+
+		if time.Since(c.idleSince) > config.DefaultConfig.UpstreamIdleDuration() || !c.healthy() {
+			c.Close()
+			continue
+		}
+		c.Reused = true
+		return c
+	}
+}
+
+// Put returns c to the pool. It is closed instead if pooling is disabled or the pool already holds the
+// maximum number of idle connections for its key.
+func (p *Pool) Put(c *Conn) {
+	if config.DefaultConfig.DisableUpstreamPooling {
+		c.Close()
+		return
+	}
+	p.janitorOnce.Do(func() {
+		go p.janitor()
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[c.key]) >= config.DefaultConfig.MaxIdleUpstreamConnsPerHost() {
+		c.Close()
+		return
+	}
+	c.idleSince = time.Now()
+	p.idle[c.key] = append(p.idle[c.key], c)
+}
+
+// Close closes the connection (and the HTTP/2 client connection on top of it, if any).
+func (c *Conn) Close() error {
+	if c.H2 != nil {
+		c.H2.Close()
+	}
+	return c.Conn.Close()
+}
+
+// healthy reports whether the host has not closed the idle connection (or sent anything unexpected on it).
+// It peeks with a very short deadline, so it never blocks for long.
+func (c *Conn) healthy() bool {
+	if c.H2 != nil {
+		// the HTTP/2 client conn reads frames (pings, settings, GOAWAY) on its own, it knows best
+		return c.H2.CanTakeNewRequest()
+	}
+	if err := c.Conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	defer c.Conn.SetReadDeadline(time.Time{})
+	_, err := c.Buf.Peek(1)
+	// a timeout means nothing was there to read: the connection is idle, as it should be
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// janitor periodically closes connections that have been idle for longer than the idle timeout, so they
+// are not held open until the next request to their host.
+func (p *Pool) janitor() {
+	for {
+		time.Sleep(config.DefaultConfig.UpstreamIdleDuration() / 2)
+
+		p.mu.Lock()
+		for key, conns := range p.idle {
+			kept := conns[:0]
+			for _, c := range conns {
+				if time.Since(c.idleSince) > config.DefaultConfig.UpstreamIdleDuration() {
+					c.Close()
+				} else {
+					kept = append(kept, c)
+				}
+			}
+			if len(kept) == 0 {
+				delete(p.idle, key)
+			} else {
+				p.idle[key] = kept
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// NewConn wraps a freshly dialed connection for key so it can be returned to the pool later.
+func NewConn(conn net.Conn, key Key) *Conn {
+	return &Conn{
+		Conn: conn,
+		Buf:  bufio.NewReader(conn),
+		key:  key,
+	}
+}
+
+func New() *Pool {
+	return &Pool{
+		idle: make(map[Key][]*Conn),
+	}
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net"
 
-	"github.com/google/uuid"
 	"github.com/tiredkangaroo/cap/proxy/http"
 	"github.com/tiredkangaroo/cap/proxy/timing"
 
@@ -18,24 +19,86 @@ import (
 type ProxyHandler struct {
 	certifcates *certificate.Certificates
 	m           *Manager
+
+	// reverseTLS is the config TLS is terminated with in reverse proxy mode, nil if clients speak plain HTTP.
+	reverseTLS *tls.Config
+
+	// conns counts the client connections of every listener, to limit them.
+	conns *connLimiter
+
+	proxyListeners       *listenerGroup
+	socksListeners       *listenerGroup
+	transparentListeners *listenerGroup
+}
+
+func NewProxyHandler() *ProxyHandler {
+	c := new(ProxyHandler)
+	c.conns = newConnLimiter()
+	c.proxyListeners = newListenerGroup("proxy", c.admitted(InboundHTTP, c.serveProxyConn))
+	c.socksListeners = newListenerGroup("socks", c.admitted(InboundSOCKS, c.serveSOCKS))
+	c.transparentListeners = newListenerGroup("transparent", c.admitted(InboundTransparent, c.serveTransparent))
+	c.transparentListeners.listen = listenTransparent
+	return c
 }
 
-func (c *ProxyHandler) ServeHTTP(pr *Request, r *http.Request) {
+func (c *ProxyHandler) ServeHTTP(pr *Request, r *http.Request) (keepAlive bool) {
 	pr.Init(r)
-	c.serveAfterInit(pr, r)
+	return c.serveAfterInit(pr, r)
 }
 
-func (c *ProxyHandler) serveAfterInit(req *Request, r *http.Request) {
+// serveAfterInit serves an initialized request. It returns whether the client connection can be used
+// for another request afterwards.
+func (c *ProxyHandler) serveAfterInit(req *Request, r *http.Request) (keepAlive bool) {
+	req.decideMITM(c.m)
 	c.m.SendNew(req)
 
-	var err error
 	if req.Secure { // we're handling an HTTPS connection here
-		err = req.handleHTTPS(c.m, c.certifcates)
-	} else {
-		// we're handling an HTTP connection here, HTTP connections send the full request to the proxy, so we actually do need this request here
-		err = req.handleHTTP(c.m, r, c.certifcates)
+		session, keepAlive, err := req.handleHTTPS(c.m, c.certifcates)
+		if err == nil && session != nil && session.h2 {
+			// every stream (the first one included) is its own exchange, serveH2 sends their results
+			c.serveH2(req, session)
+			return false
+		}
+		c.sendResult(req, err)
+		if session != nil && keepAlive && err == nil {
+			c.serveTLSSession(req, session)
+		}
+		// after a CONNECT the client connection belongs to the tunnel (or the TLS session), it is never
+		// used for plain proxy requests again
+		return false
+	}
+
+	// we're handling an HTTP connection here, HTTP connections send the full request to the proxy, so we actually do need this request here
+	keepAlive, err := req.handleHTTP(c.m, r, c.certifcates)
+	c.sendResult(req, err)
+	return keepAlive && err == nil
+}
+
+// serveTLSSession serves the requests a client sends after the first one over the same MITM'd TLS session.
+// Each request becomes its own exchange, linked to the first one by the connection ID.
+func (c *ProxyHandler) serveTLSSession(first *Request, session *clientSession) {
+	for {
+		next := first.nextExchange(c.m)
+		next.client = session
+		req, err := session.readNextRequest(next.timing, timing.TimeReadRequest)
+		if err != nil {
+			if !isConnClosed(err) {
+				slog.Error("failed to read request from tls session", "err", err.Error(), "connection_id", first.ConnectionID)
+			}
+			return
+		}
+		c.m.SendNew(next)
+		keepAlive, err := next.handleMITMRequest(c.m, req, session.conn, c.certifcates)
+		c.sendResult(next, err)
+		req.Body.CloseBody()
+		if !keepAlive || err != nil {
+			return
+		}
 	}
+}
 
+// sendResult sends the result of an exchange to live websocket connections and saves it.
+func (c *ProxyHandler) sendResult(req *Request, err error) {
 	if errors.Is(err, ErrPerformStop) { // ignore PerformStop errors and don't send a control message
 		return
 	}
@@ -51,14 +114,16 @@ func (c *ProxyHandler) serveAfterInit(req *Request, r *http.Request) {
 func (c *ProxyHandler) Init(dirname string) error {
 	c.certifcates = new(certificate.Certificates)
 	if err := c.certifcates.Init(dirname); err != nil {
+		// a CA can still be imported (or generated) from the control server
 		slog.Warn("initializing certificates (mitm cannot be used)", "err", err.Error())
-		c.certifcates = nil
 		config.DefaultConfig.MITM = false
 	}
 	return nil
 }
 
-func (c *ProxyHandler) ListenAndServe(m *Manager, dirname string) error {
+// ListenAndServe makes the proxy listen on the addresses of the config and serve its clients until it exits.
+// The certificates must be initialized (with Init) beforehand.
+func (c *ProxyHandler) ListenAndServe(m *Manager) error {
 	// HTTP pathway:
 	// read request -> init request -> dial host -> write request -> read response -> write response
 	// HTTPS NO MITM pathway:
@@ -66,48 +131,85 @@ func (c *ProxyHandler) ListenAndServe(m *Manager, dirname string) error {
 	// HTTPS MITM pathway:
 	// read request -> init request -> send 200 response -> cert gen + handshake -> dial host -> write request -> read response -> write response
 
-	if err := c.Init(dirname); err != nil {
+	c.m = m
+
+	if config.DefaultConfig.ReverseProxy.Enabled() {
+		if err := c.initReverseProxy(); err != nil {
+			slog.Error("failed to start reverse proxy", "err", err.Error())
+			return err
+		}
+	}
+
+	if err := c.Listen(config.DefaultConfig); err != nil {
+		slog.Error("failed to start proxy listeners", "err", err.Error())
 		return err
 	}
-	c.m = m
+	select {}
+}
 
-	listener, err := net.Listen("tcp", ":8000")
-	if err != nil {
-		slog.Error("failed to start proxy listener", "err", err.Error())
+// Listen makes the proxy listen on the addresses of cfg: its proxy listeners, and its SOCKS and transparent
+// listeners if they are enabled. It is called again with the new config whenever the config changes, so
+// listeners are opened and closed without restarting the proxy. If it fails, some listeners may already have
+// changed: calling it again with the previous config puts them back.
+func (c *ProxyHandler) Listen(cfg *config.Config) error {
+	if err := c.proxyListeners.Set(cfg.ProxyListenAddresses()); err != nil {
 		return err
 	}
+	if err := c.socksListeners.Set(portAddresses(cfg.SOCKSPort)); err != nil {
+		return err
+	}
+	return c.transparentListeners.Set(portAddresses(cfg.TransparentPort))
+}
+
+// portAddresses returns the address to listen on port on every interface, none if port is 0.
+func portAddresses(port uint16) []string {
+	if port == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf(":%d", port)}
+}
+
+// serveProxyConn serves a connection to a proxy listener, as a forward proxy or a reverse proxy.
+func (c *ProxyHandler) serveProxyConn(rawconn net.Conn) {
+	conn := NewCustomConn(rawconn)
+	if config.DefaultConfig.ReverseProxy.Enabled() {
+		c.serveReverseConn(conn)
+		return
+	}
+	c.serveConn(conn)
+}
+
+// serveConn serves the requests sent over a client connection until the client closes it, the connection
+// stays idle for too long, or a request does not allow the connection to be kept alive.
+func (c *ProxyHandler) serveConn(conn *CustomConn) {
+	defer conn.Close()
+
+	connectionID := newID()
+	session := newClientSession(conn)
 	for {
-		rawconn, err := listener.Accept()
+		r := newRequest(c.m, conn, connectionID)
+		r.client = session
+		req, err := session.readNextRequest(r.timing, timing.TimeReadProxyRequest)
 		if err != nil {
-			slog.Error("failed to accept connection", "err", err.Error())
-			continue
+			if !isConnClosed(err) {
+				slog.Error("failed to read request", "err", err.Error())
+			}
+			return
 		}
-		r := new(Request)
-		t := timing.New(m.setStateFunc(r))
-		conn := NewCustomConn(rawconn)
 
-		r.conn = conn
-		id, err := uuid.NewRandom()
+		user, err := authenticateProxyRequest(req)
 		if err != nil {
-			slog.Error("uuid error", "err", err.Error())
-			r.ID = "75756964-7634-6765-6e65-72726f720000" // this isn't a random UUID
+			slog.Warn("rejected proxy request", "err", err.Error(), "client", conn.RemoteAddr().String(), "host", req.Host)
+			writeProxyAuthRequired(conn)
+			req.Body.CloseBody()
+			return
 		}
-		r.ID = id.String()
-		r.timing = t
+		r.ClientUser = user
 
-		t.Start(timing.TimeReadProxyRequest)
-		req, err := http.ReadRequest(conn)
-		if err != nil {
-			slog.Error("failed to read request", "err", err.Error())
-			conn.Close()
-			continue
+		keepAlive := c.ServeHTTP(r, req)
+		req.Body.CloseBody()
+		if !keepAlive {
+			return
 		}
-		t.Stop()
-
-		go func() {
-			defer req.Body.CloseBody()
-			defer conn.Close()
-			c.ServeHTTP(r, req)
-		}()
 	}
 }
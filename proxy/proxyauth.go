@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+
+	"github.com/tiredkangaroo/cap/proxy/auth"
+	"github.com/tiredkangaroo/cap/proxy/config"
+	"github.com/tiredkangaroo/cap/proxy/http"
+)
+
+// authenticateProxyRequest returns the name of the proxy user a request to the HTTP proxy listener
+// authenticated as with its Proxy-Authorization header. It returns "" if proxy authentication is not enforced,
+// and an error if it is and the request did not authenticate.
+func authenticateProxyRequest(req *http.Request) (string, error) {
+	if !config.DefaultConfig.ProxyAuth {
+		return "", nil
+	}
+	return auth.Authenticate(config.DefaultConfig.ProxyUsers, req.Header.Get("Proxy-Authorization"))
+}
+
+// authenticateSOCKS returns the name of the proxy user a SOCKS5 client authenticated as with its username and
+// password, as authenticateProxyRequest does for a request.
+func authenticateSOCKS(username, password string) (string, error) {
+	if !config.DefaultConfig.ProxyAuth {
+		return "", nil
+	}
+	return auth.Check(config.DefaultConfig.ProxyUsers, username, password)
+}
+
+// writeProxyAuthRequired writes the response that challenges a client to authenticate. The connection is
+// closed afterwards: clients retry with their credentials on a new one.
+func writeProxyAuthRequired(w io.Writer) error {
+	resp := http.NewResponse()
+	resp.Version = []byte(ProtoHTTP11)
+	resp.StatusCode = http.StatusProxyAuthenticationRequired
+	resp.Header["Proxy-Authenticate"] = auth.Challenges()
+	resp.Header.Set("Connection", "close")
+	resp.Header.Set("Content-Length", "0")
+	return resp.Write(w)
+}
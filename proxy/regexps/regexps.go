@@ -0,0 +1,45 @@
+// Package regexps compiles the regular expressions of the rules of the proxy once, as they are matched against
+// every request.
+package regexps
+
+import (
+	"container/list"
+	"regexp"
+	"sync"
+)
+
+// capacity is the number of compiled expressions kept. Once there are more (as rules are edited), the least
+// recently used ones are evicted.
+const capacity = 1024
+
+type entry struct {
+	expr string
+	re   *regexp.Regexp
+}
+
+var (
+	cacheMu sync.Mutex
+	order   = list.New() // of *entry, most recently used first
+	cache   = make(map[string]*list.Element)
+)
+
+// Compile returns expr compiled, from the cache if it was compiled before.
+func Compile(expr string) (*regexp.Regexp, error) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if e, ok := cache[expr]; ok {
+		order.MoveToFront(e)
+		return e.Value.(*entry).re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	cache[expr] = order.PushFront(&entry{expr: expr, re: re})
+	if order.Len() > capacity {
+		oldest := order.Back()
+		order.Remove(oldest)
+		delete(cache, oldest.Value.(*entry).expr)
+	}
+	return re, nil
+}
@@ -0,0 +1,147 @@
+// Package remote redirects requests to a different host, port or scheme than the one the client sent them
+// to (Map Remote), e.g. to point a production hostname at a local or staging backend.
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+
+	"github.com/tiredkangaroo/cap/proxy/regexps"
+	"github.com/tiredkangaroo/cap/proxy/rules"
+)
+
+var (
+	ErrEmptyMatcher  = errors.New("map remote rule must match on host")
+	ErrEmptyTarget   = errors.New("map remote rule must change the host, port or scheme")
+	ErrInvalidScheme = errors.New("invalid map remote scheme (must be http or https)")
+	ErrInvalidPort   = errors.New("map remote port must be between 1 and 65535")
+	ErrHostHasPort   = errors.New("map remote host must not have a port (use port)")
+)
+
+// Scheme is the scheme a request is sent to the host with.
+type Scheme string
+
+const (
+	SchemeHTTP  Scheme = "http"
+	SchemeHTTPS Scheme = "https"
+)
+
+// Rule sends the requests it matches to ToHost, ToPort and ToScheme instead of where the client sent them.
+// Every part that is not set is kept as it was.
+type Rule struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled"`
+
+	// Host is a glob the host must match (see rules.MatchHost).
+	Host string `json:"host"`
+	// Path is a regular expression the path of the request must match. Every path matches if it is empty.
+	Path string `json:"path"`
+
+	ToHost   string `json:"to_host"` // hostname or IP address, without a port
+	ToPort   int    `json:"to_port"`
+	ToScheme Scheme `json:"to_scheme"`
+	// PreserveHost is whether the Host header is left as the client sent it. Otherwise it is set to the host
+	// the request is sent to.
+	PreserveHost bool `json:"preserve_host"`
+}
+
+// Validate reports whether the rule is well formed.
+func (r *Rule) Validate() error {
+	if r.Host == "" {
+		return ErrEmptyMatcher
+	}
+	if r.ToHost == "" && r.ToPort == 0 && r.ToScheme == "" {
+		return ErrEmptyTarget
+	}
+	switch r.ToScheme {
+	case "", SchemeHTTP, SchemeHTTPS:
+	default:
+		return ErrInvalidScheme
+	}
+	if r.ToPort < 0 || r.ToPort > 65535 {
+		return ErrInvalidPort
+	}
+	if _, _, err := net.SplitHostPort(r.ToHost); err == nil {
+		return ErrHostHasPort
+	}
+	if _, err := path.Match(r.Host, ""); err != nil {
+		return fmt.Errorf("invalid host glob: %w", err)
+	}
+	if _, err := regexps.Compile(r.Path); err != nil {
+		return fmt.Errorf("invalid path regex: %w", err)
+	}
+	return nil
+}
+
+// Matches reports whether the rule matches a request to the host (host:port) for the path. A disabled (or
+// invalid) rule never matches.
+func (r *Rule) Matches(host, p string) bool {
+	if r.Disabled || !rules.MatchHost(r.Host, host) {
+		return false
+	}
+	if r.Path == "" {
+		return true
+	}
+	re, err := regexps.Compile(r.Path)
+	return err == nil && re.MatchString(p)
+}
+
+// Match returns the first rule that matches a request to the host for the path, or nil if none does.
+func Match(rs []Rule, host, p string) *Rule {
+	for i := range rs {
+		if rs[i].Matches(host, p) {
+			return &rs[i]
+		}
+	}
+	return nil
+}
+
+// Map returns where a request to the host (host:port) over TLS (if secure) is sent instead. If the rule
+// changes the scheme but not the port, the port is the default port of the new scheme.
+func (r *Rule) Map(host string, secure bool) (string, bool) {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname, port = host, ""
+	}
+	if r.ToHost != "" {
+		hostname = r.ToHost
+	}
+	if r.ToScheme != "" {
+		newSecure := r.ToScheme == SchemeHTTPS
+		if newSecure != secure && r.ToPort == 0 && port == defaultPort(secure) {
+			port = defaultPort(newSecure)
+		}
+		secure = newSecure
+	}
+	if r.ToPort != 0 {
+		port = strconv.Itoa(r.ToPort)
+	}
+	if port == "" {
+		port = defaultPort(secure)
+	}
+	return net.JoinHostPort(hostname, port), secure
+}
+
+// HostHeader returns the Host header of a request sent to the host (host:port), without the port if it is
+// the default port of the scheme.
+func HostHeader(host string, secure bool) string {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil || port != defaultPort(secure) {
+		return host
+	}
+	if net.ParseIP(hostname) != nil && net.ParseIP(hostname).To4() == nil {
+		return "[" + hostname + "]"
+	}
+	return hostname
+}
+
+func defaultPort(secure bool) string {
+	if secure {
+		return "443"
+	}
+	return "80"
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/tiredkangaroo/cap/proxy/config"
+	"github.com/tiredkangaroo/cap/proxy/remote"
+)
+
+// mapRemote sets where the request is sent: where the client sent it, or where the first map remote rule
+// that matches it redirects it.
+func (r *Request) mapRemote() {
+	r.UpstreamHost, r.UpstreamSecure = r.hostAddr(), r.Secure
+	rule := remote.Match(config.Rules(&config.DefaultConfig.MapRemoteRules), r.Host, r.req.Path)
+	if rule == nil {
+		return
+	}
+	r.UpstreamHost, r.UpstreamSecure = rule.Map(r.Host, r.Secure)
+	r.MapRemoteRuleID = rule.ID
+	if !rule.PreserveHost {
+		r.req.Header.Set("Host", remote.HostHeader(r.UpstreamHost, r.UpstreamSecure))
+	}
+}
+
+// serverName returns the name the host the request is sent to is verified against: the name of Host, unless a
+// map remote rule redirected the request.
+func (r *Request) serverName() string {
+	if r.MapRemoteRuleID == "" {
+		return getHostname(r.Host)
+	}
+	return getHostname(r.UpstreamHost)
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"syscall"
 	"time"
 
 	certificate "github.com/tiredkangaroo/cap/proxy/certificates"
 	"github.com/tiredkangaroo/cap/proxy/http"
+	"github.com/tiredkangaroo/cap/proxy/pool"
+	"github.com/tiredkangaroo/cap/proxy/rules"
+	"github.com/tiredkangaroo/cap/proxy/upstream"
 
 	"github.com/tiredkangaroo/cap/proxy/config"
 	"github.com/tiredkangaroo/cap/proxy/timing"
@@ -20,8 +24,15 @@ const ThisDevice string = "This Device"
 
 var (
 	ErrPerformStop = errors.New("perform stopped")
+	// errNoResponse is returned by roundTrip when the host closed the connection before sending any of the
+	// response, which it does to idle connections it no longer wants to keep.
+	errNoResponse = errors.New("host closed the connection without responding")
 )
 
+// hostSessions keeps the TLS sessions of hosts, so that new connections to them resume a session instead of
+// performing a full handshake (see TLSInfo.Resumed).
+var hostSessions = tls.NewLRUClientSessionCache(1024)
+
 type Kind int64
 
 const (
@@ -66,12 +77,41 @@ type Request struct {
 	Starred  bool
 	Datetime time.Time
 	Host     string
-
-	conn net.Conn
+	// streamHost is the address (host:port) a stream through the SOCKS or transparent listener goes to. Host is
+	// the name the client asked for instead, if it is known (see namedHost), but the request is still sent to
+	// streamHost.
+	streamHost string
+	// Inbound is how the client reached the proxy: InboundHTTP (an HTTP proxy request), InboundSOCKS5 or
+	// InboundSOCKS4 (a connection through the SOCKS listener), InboundTransparent (a connection redirected to
+	// the transparent listener) or InboundReverse (a request to the proxy running as a reverse proxy).
+	Inbound string
+
+	// ConnectionID identifies the client connection the request was sent over. Requests sent over
+	// the same persistent connection (or TLS session) share it.
+	ConnectionID string
+
+	conn      net.Conn
+	bytesBase int64 // bytes transferred over conn before this request
+	// client is the session the request was read from (nil for HTTP/2 streams). It is handed over to
+	// serveUpgraded if the host switches protocols.
+	client *clientSession
+
+	// clientKeepAlive is whether the client asked to keep its connection open after this request.
+	clientKeepAlive bool
+	hostconn        *pool.Conn
+	// UpstreamReused is whether the request was sent over a pooled connection to the host instead of a
+	// freshly dialed one.
+	UpstreamReused bool
+
+	// Proto is the protocol the client sent the request with (HTTP/1.0, HTTP/1.1 or HTTP/2.0), UpstreamProto
+	// the protocol it was sent to the host with.
+	Proto         string
+	UpstreamProto string
 
 	ClientIP            string
 	ClientPort          string
 	ClientAuthorization string
+	ClientUser          string // the proxy user the client authenticated as (see config.Config.ProxyAuth), if any
 	ClientProcessID     int
 	ClientApplication   string
 
@@ -81,15 +121,85 @@ type Request struct {
 	reqBodyID  string // ID of the request body in the database
 	resp       *http.Response
 	respBodyID string // ID of the response body in the database
+	// hostBody is the body of the response as read from the host. It differs from resp.Body if the body was
+	// replaced while waiting for response approval, and decides whether the host connection can be reused.
+	hostBody *http.Body
+
+	// rule is the intercept rule that matched the request, if any.
+	rule *rules.Rule
+	// Mocked is whether the response was built by a mock rule instead of being sent by the host.
+	Mocked bool
+	// ClientTLS is what was negotiated in the TLS handshake with the client (of a MITM'd request, or of a
+	// request to the proxy running as a reverse proxy with TLS), UpstreamTLS in the one with the host. They
+	// are nil if there was none.
+	ClientTLS   *TLSInfo
+	UpstreamTLS *TLSInfo
+	// MITMBypass is why the request was tunneled although MITM is enabled (MITMBypassExcluded or
+	// MITMBypassPinned), if it was.
+	MITMBypass string
+	// Rejected is whether the client connection was rejected before anything was read from it (by the client
+	// allow and deny lists or the connection limits).
+	Rejected bool
+	// UpstreamHost (host:port) and UpstreamSecure are where the request was sent: Host (see hostAddr) and
+	// Secure, unless the map remote rule MapRemoteRuleID redirected it. UpstreamHost is empty if the request was not sent.
+	UpstreamHost    string
+	UpstreamSecure  bool
+	MapRemoteRuleID string
+	// UpstreamProxy is the label of the upstream proxy the request (or tunnel) went through, if any.
+	UpstreamProxy string
+	proxy         *upstream.Proxy
+	// Rewrites are the rewrite rules applied to the request and its response.
+	Rewrites []AppliedRewrite
 
 	errorText string // NOTE: only populated at db, prolly should change that, maybe not, who knows, not me, maybe me, who knows
 
-	approveResponseFunc func(approved bool)
+	approveResponseFunc func(approval Approval)
+	// reqPreview and respPreview are the bodies shown while the request (or its response) waits for approval,
+	// nil if they could not be read (see previewBody).
+	reqPreview, respPreview []byte
+}
+
+// newRequest returns a new request for an exchange on the client connection conn.
+func newRequest(m *Manager, conn *CustomConn, connectionID string) *Request {
+	r := &Request{
+		ID:           newID(),
+		ConnectionID: connectionID,
+		conn:         conn,
+		bytesBase:    conn.BytesTransferred(),
+	}
+	r.timing = timing.New(m.setStateFunc(r))
+	return r
+}
+
+// nextExchange returns a new request for the next exchange in the same MITM'd TLS session as r. It
+// shares everything Init derived from the CONNECT request with r.
+func (r *Request) nextExchange(m *Manager) *Request {
+	next := newRequest(m, r.conn.(*CustomConn), r.ConnectionID)
+	next.Kind = r.Kind
+	next.Secure = r.Secure
+	next.Datetime = time.Now()
+	next.Host = r.Host
+	next.streamHost = r.streamHost
+	next.Inbound = r.Inbound
+	next.ClientIP = r.ClientIP
+	next.ClientPort = r.ClientPort
+	next.ClientAuthorization = r.ClientAuthorization
+	next.ClientUser = r.ClientUser
+	next.ClientTLS = r.ClientTLS
+	next.ClientProcessID = r.ClientProcessID
+	next.ClientApplication = r.ClientApplication
+	next.reqBodyID = next.ID + "-req-body"
+	next.respBodyID = next.ID + "-resp-body"
+	return next
 }
 
 func (r *Request) Init(req *http.Request) error {
 	r.timing.Start(timing.TimeRequestInit)
 	defer r.timing.Stop()
+	if r.Inbound == InboundReverse {
+		// origin-form: the request is for the backend, whatever its Host header says
+		return r.initReverse()
+	}
 	r.Secure = req.Method == http.MethodConnect
 	r.reqBodyID = r.ID + "-req-body"
 	r.respBodyID = r.ID + "-resp-body"
@@ -104,6 +214,9 @@ func (r *Request) Init(req *http.Request) error {
 	}
 
 	r.Datetime = time.Now()
+	if r.Inbound == "" {
+		r.Inbound = InboundHTTP
+	}
 
 	r.Host = req.Host
 	if _, _, err := net.SplitHostPort(req.Host); err != nil {
@@ -114,6 +227,22 @@ func (r *Request) Init(req *http.Request) error {
 		}
 	}
 
+	if r.ClientUser == "" {
+		r.ClientAuthorization = req.Header.Get("Proxy-Authorization")
+	}
+	r.initClient()
+
+	return nil
+}
+
+// initClient sets what is known about the client from its connection. It must be called while a major time
+// is running.
+func (r *Request) initClient() {
+	if _, ok := r.conn.LocalAddr().(*net.UnixAddr); ok {
+		// the clients of a Unix domain socket are on this device, without a port to find their process by
+		r.ClientIP = ThisDevice
+		return
+	}
 	r.ClientIP = r.conn.RemoteAddr().String()
 	if ip, port, err := net.SplitHostPort(r.ClientIP); err == nil {
 		r.ClientIP = ip
@@ -123,15 +252,11 @@ func (r *Request) Init(req *http.Request) error {
 		r.ClientIP = ThisDevice
 	}
 
-	r.ClientAuthorization = req.Header.Get("Proxy-Authorization")
-
 	if config.DefaultConfig.GetClientProcessInfo {
 		r.timing.Substart(timing.SubtimeGetClientProcessInfo)
 		getClientProcessInfo(r.ClientIP, r.ClientPort, &r.ClientProcessID, &r.ClientApplication)
 		r.timing.Substop()
 	}
-
-	return nil
 }
 
 // Perform performs the request and returns the raw response as a byte slice.
@@ -141,12 +266,19 @@ func (r *Request) Perform(m *Manager, c *certificate.Certificates) (*http.Respon
 	r.req.Header.Del("Proxy-Authorization")
 	r.req.Header.Del("Proxy-Connection")
 
-	if config.DefaultConfig.RequireApproval {
-		r.timing.Substart(timing.SubtimeWaitApproval)
-		if !m.RecieveApproval(r) {
+	switch r.interceptAction() {
+	case rules.ActionCancel:
+		m.SendCanceled(r)
+		return nil, ErrPerformStop
+	case rules.ActionIntercept:
+		switch m.RecieveApproval(r) {
+		case ApprovalCanceled:
 			return nil, ErrPerformStop
+		case ApprovalRespond:
+			r.discardRequestBody()
+			r.resp = approvalTimeoutResponse()
+			return r.resp, nil
 		}
-		r.timing.Substop()
 	}
 
 	if config.DefaultConfig.PerformDelay != 0 {
@@ -156,63 +288,275 @@ func (r *Request) Perform(m *Manager, c *certificate.Certificates) (*http.Respon
 		r.timing.Substop()
 	}
 
+	// hop-by-hop headers describe the client's connection to the proxy, not the proxy's connection to the host
+	r.req.Header.Del("Keep-Alive")
+	if !r.req.Header.HasToken("Connection", "upgrade") {
+		r.req.Header.Del("Connection")
+	}
+
+	if applied, err := r.rewriteRequest(); err != nil {
+		return nil, err
+	} else if applied {
+		m.SendRequest(r) // let live websocket connections see the request as it is sent
+	}
+
+	resp, err := r.mockResponse()
+	if err != nil {
+		return nil, err
+	}
+	if resp != nil {
+		r.discardRequestBody()
+	} else {
+		if resp, err = r.send(m, c); err != nil {
+			return nil, err
+		}
+	}
+	r.resp = resp
+	r.hostBody = resp.Body
+	if _, err := r.rewriteResponse(); err != nil {
+		return nil, err
+	}
+
+	switch r.approveResponse(m) {
+	case ApprovalCanceled:
+		return nil, ErrPerformStop
+	case ApprovalRespond:
+		// the host's body is not forwarded, the host connection is closed (see releaseHostConn)
+		r.resp = approvalTimeoutResponse()
+	}
+	return r.resp, nil
+}
+
+// maxDiscardBodySize is the most of a request body that is read and discarded to keep the client connection
+// alive when the request is not sent to the host. If more is left, the connection is closed instead.
+const maxDiscardBodySize = 256 << 10
+
+// discardRequestBody reads the rest of the request body when the request is answered without being sent to the
+// host, so that the next request on the client connection is read from its start. If the rest is too large (or
+// cannot be read), the client connection is closed after the response instead.
+func (r *Request) discardRequestBody() {
+	body := r.req.Body
+	if body == nil || body.Complete() {
+		return
+	}
+	if n := body.ContentLength(); n >= 0 && n-body.BytesRead() > maxDiscardBodySize {
+		r.clientKeepAlive = false
+		return
+	}
+	if _, err := io.Copy(io.Discard, io.LimitReader(body, maxDiscardBodySize+1)); err != nil || !body.Complete() {
+		r.clientKeepAlive = false
+	}
+}
+
+// send sends the request to the host and reads its response.
+func (r *Request) send(m *Manager, c *certificate.Certificates) (*http.Response, error) {
+	r.mapRemote()
+	r.selectUpstreamProxy(r.UpstreamHost)
+	if err := r.connectHost(m, c); err != nil {
+		return nil, err
+	}
+	resp, err := r.roundTrip()
+	if errors.Is(err, errNoResponse) && r.hostconn.Reused && isIdempotent(r.req.Method) && r.req.Body.BytesRead() == 0 {
+		// the host closed the pooled connection just as it was reused, retry once on a new connection (the
+		// request is sent again as is, so not if its body was read already)
+		r.hostconn.Close()
+		r.hostconn = nil
+		if err := r.dialHost(c); err != nil {
+			return nil, err
+		}
+		resp, err = r.roundTrip()
+	}
+	if r.UpstreamSecure {
+		// the handshake may have been performed for an earlier request, if the connection was pooled
+		r.UpstreamTLS, _ = r.hostconn.Info.(*TLSInfo)
+	}
+	return resp, err
+}
+
+// connectHost sets r.hostconn to a pooled connection to the host if there is a healthy one, otherwise
+// it dials a new one.
+func (r *Request) connectHost(m *Manager, c *certificate.Certificates) error {
+	if r.wantsUpgrade() {
+		// the connection will belong to the new protocol, it is not worth taking a pooled one for it
+		return r.dialHost(c)
+	}
+	if hostconn := m.pool.Get(r.poolKey()); hostconn != nil {
+		r.timing.Substart(timing.SubtimeReusePooledConn)
+		r.hostconn = hostconn
+		r.UpstreamReused = true
+		r.timing.Substop()
+		return nil
+	}
+	return r.dialHost(c)
+}
+
+func (r *Request) dialHost(c *certificate.Certificates) error {
 	r.timing.Substart(timing.SubtimeDialHost)
-	var hostconn net.Conn
-	var err error
-	if r.Secure {
-		var sysCertPool *x509.CertPool
-		sysCertPool, err = c.SystemCertPool()
+	defer r.timing.Substop()
+	conn, err := r.dialUpstream()
+	if err != nil {
+		return fmt.Errorf("dial host: %w", err)
+	}
+	if !r.UpstreamSecure {
+		r.hostconn = pool.NewConn(conn, r.poolKey())
+		r.UpstreamReused = false
+		return nil
+	}
+
+	sysCertPool, err := c.SystemCertPool()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("get system cert pool: %w", err)
+	}
+	nextProtos := config.DefaultConfig.NextProtos()
+	if r.wantsUpgrade() {
+		nextProtos = []string{"http/1.1"} // HTTP/2 has no Upgrade
+	}
+	tlsconn := tls.Client(conn, &tls.Config{
+		ServerName:         r.serverName(),
+		RootCAs:            sysCertPool,
+		NextProtos:         nextProtos,
+		ClientSessionCache: hostSessions,
+	})
+	if err := tlsconn.Handshake(); err != nil {
+		conn.Close()
+		return fmt.Errorf("dial host: %w", err)
+	}
+	r.hostconn = pool.NewConn(tlsconn, r.poolKey())
+	r.hostconn.Info = newTLSInfo(tlsconn.ConnectionState())
+	r.UpstreamReused = false
+	if isH2(tlsconn) {
+		r.hostconn.H2, err = newH2ClientConn(tlsconn)
 		if err != nil {
-			return nil, fmt.Errorf("get system cert pool: %w", err)
+			tlsconn.Close()
+			r.hostconn = nil
+			return fmt.Errorf("http2 client conn: %w", err)
 		}
-		hostconn, err = tls.Dial("tcp", r.Host, &tls.Config{
-			RootCAs: sysCertPool,
-		})
-	} else {
-		hostconn, err = net.Dial("tcp", r.Host)
 	}
-	if err != nil {
-		return nil, fmt.Errorf("dial host: %w", err)
+	return nil
+}
+
+// roundTrip writes the request to the host connection and reads the response from it.
+func (r *Request) roundTrip() (*http.Response, error) {
+	if r.hostconn.H2 != nil {
+		return r.roundTripH2(r.hostconn.H2)
 	}
-	r.timing.Substop()
 
 	r.timing.Substart(timing.SubtimeWriteRequest)
-	if err := r.req.Write(hostconn); err != nil {
-		return nil, fmt.Errorf("write request: %w", err)
+	var err error
+	if r.forwarded() {
+		err = r.req.WriteProxy(r.hostconn, r.UpstreamHost, r.proxy.Authorization())
+	} else {
+		err = r.req.Write(r.hostconn)
 	}
 	r.timing.Substop()
+	if err != nil {
+		return nil, fmt.Errorf("write request: %w", err)
+	}
 
 	r.timing.Substart(timing.SubtimeReadResponse)
-	resp, err := http.ReadResponse(hostconn)
+	r.hostconn.SetReadDeadline(time.Now().Add(time.Minute))
+	if _, err := r.hostconn.Buf.Peek(1); err != nil && (errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)) {
+		r.timing.Substop()
+		return nil, fmt.Errorf("read response: %w: %w", errNoResponse, err)
+	}
+	resp, err := http.ReadResponseFrom(r.hostconn, r.hostconn.Buf, r.req.Method)
 	r.timing.Substop()
 	if err != nil {
 		return nil, fmt.Errorf("read response: %w", err)
 	}
-	r.resp = resp
-	return r.resp, nil
+	r.UpstreamProto = string(resp.Version)
+	return resp, nil
 }
 
+// poolKey returns the key of the pooled connections that can be used for this request.
+func (r *Request) poolKey() pool.Key {
+	key := pool.Key{
+		Host: r.UpstreamHost,
+		TLS:  r.UpstreamSecure,
+	}
+	if r.UpstreamSecure {
+		// connections are verified against the system cert pool for the server name of the host
+		key.TLSConfig = r.serverName()
+	}
+	if r.proxy != nil {
+		key.Via = r.proxy.URL
+	}
+	return key
+}
+
+// releaseHostConn returns the connection to the host (if one was used) to the pool once the exchange is
+// over. It is closed instead if it cannot carry another request: the response was not read in full, its
+// body was delimited by the host closing the connection, or either side asked to close it. The response
+// bodies are released either way.
+func (r *Request) releaseHostConn(m *Manager) {
+	hostconn := r.hostconn
+	r.hostconn = nil
+	// whether the host body was read in full must be known before the bodies are closed
+	reusable := hostconn != nil && r.hostConnReusable(hostconn)
+	r.closeBodies()
+	if hostconn == nil {
+		return
+	}
+	if !reusable {
+		hostconn.Close()
+		return
+	}
+	m.pool.Put(hostconn)
+}
+
+// hostConnReusable reports whether the connection to the host can carry another request once this exchange
+// is over.
+func (r *Request) hostConnReusable(hostconn *pool.Conn) bool {
+	if hostconn.H2 != nil {
+		// streams end on their own, the connection can carry another request as long as the host allows it
+		return r.resp != nil && r.hostBody.Complete() && hostconn.H2.CanTakeNewRequest()
+	}
+	return r.resp != nil && r.hostBody.Complete() && !r.resp.CloseDelimited &&
+		string(r.resp.Version) == "HTTP/1.1" && !r.resp.Header.HasToken("Connection", "close") &&
+		!r.req.Header.HasToken("Connection", "close") && r.resp.StatusCode != http.StatusSwitchingProtocols
+}
+
+// closeBodies releases the response body read from the host (or the mock file) and the one sent to the
+// client instead, if it was replaced: their temporary files are deleted.
+func (r *Request) closeBodies() {
+	if r.hostBody != nil {
+		r.hostBody.CloseBody()
+	}
+	if r.resp != nil && r.resp.Body != nil && r.resp.Body != r.hostBody {
+		r.resp.Body.CloseBody()
+	}
+}
+
+// BytesTransferred returns the bytes transferred over the client connection during this request.
 func (r *Request) BytesTransferred() int64 {
 	cc := r.conn.(*CustomConn)
-	return cc.BytesTransferred()
+	return cc.BytesTransferred() - r.bytesBase
 }
 
 func (r *Request) MarshalJSON() ([]byte, error) {
 	var state string
-	if r.errorText != "" {
+	if r.Rejected {
+		state = "Rejected"
+	} else if r.errorText != "" {
 		state = "Error"
 	} else {
 		state = "Done"
 	}
 	return json.Marshal(map[string]any{
 		"id":                  r.ID,
+		"connectionID":        r.ConnectionID,
 		"starred":             r.Starred,
 		"datetime":            r.Datetime.UnixMilli(), // unix milli for js
 		"secure":              r.Secure,
 		"clientIP":            r.ClientIP,
 		"clientApplication":   r.ClientApplication,
 		"clientAuthorization": r.ClientAuthorization,
+		"clientUser":          r.ClientUser,
 		"host":                r.Host,
+		"inbound":             r.Inbound,
+		"mitmBypass":          r.MITMBypass,
+		"clientTLS":           r.ClientTLS,
 
 		"method":     r.req.Method.String(),
 		"path":       r.req.Path,
@@ -228,6 +572,17 @@ func (r *Request) MarshalJSON() ([]byte, error) {
 			"bodyLength": r.resp.ContentLength,
 		},
 
+		"upstreamReused": r.UpstreamReused,
+		"proto":          r.Proto,
+		"upstreamProto":  r.UpstreamProto,
+		"rewrites":       r.Rewrites,
+		"mocked":         r.Mocked,
+		"upstreamHost":   r.UpstreamHost,
+		"upstreamSecure": r.UpstreamSecure,
+		"mapRemoteRule":  r.MapRemoteRuleID,
+		"upstreamProxy":  r.UpstreamProxy,
+		"upstreamTLS":    r.UpstreamTLS,
+
 		"state":        state,
 		"error":        r.errorText,
 		"timing":       r.timing.Export(),
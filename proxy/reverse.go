@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/tiredkangaroo/cap/proxy/config"
+	"github.com/tiredkangaroo/cap/proxy/remote"
+	"github.com/tiredkangaroo/cap/proxy/timing"
+)
+
+// initReverseProxy prepares the proxy to run as a reverse proxy (see config.ReverseProxy): its proxy
+// listeners serve the clients of the backend.
+func (c *ProxyHandler) initReverseProxy() error {
+	rp := config.DefaultConfig.ReverseProxy
+	if _, _, err := rp.Backend(); err != nil {
+		return err
+	}
+	if rp.CertFile != "" || rp.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(rp.CertFile, rp.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load reverse proxy certificate: %w", err)
+		}
+		c.reverseTLS = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   config.DefaultConfig.NextProtos(),
+		}
+	}
+	slog.Info("running as a reverse proxy", "target", rp.Target, "tls", c.reverseTLS != nil)
+	return nil
+}
+
+// serveReverseConn serves the origin-form requests a client sends over conn (over TLS, if it is terminated)
+// until the client closes it, the connection stays idle for too long, or a request does not allow the
+// connection to be kept alive.
+func (c *ProxyHandler) serveReverseConn(conn *CustomConn) {
+	defer conn.Close()
+
+	connectionID := newID()
+	session := newClientSession(conn)
+	if c.reverseTLS != nil {
+		tlsconn := tls.Server(conn, c.reverseTLS)
+		conn.SetDeadline(time.Now().Add(config.DefaultConfig.KeepAliveDuration()))
+		if err := tlsconn.Handshake(); err != nil {
+			if !isConnClosed(err) {
+				slog.Error("reverse proxy tls handshake", "err", err.Error(), "client", conn.RemoteAddr().String())
+			}
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		session = newClientSession(tlsconn)
+		if isH2(tlsconn) {
+			// every stream is its own exchange, initialized like the first one
+			first := newRequest(c.m, conn, connectionID)
+			first.Inbound = InboundReverse
+			first.ClientTLS = connTLSInfo(tlsconn)
+			first.timing.Start(timing.TimeRequestInit)
+			err := first.initReverse()
+			first.timing.Stop()
+			c.m.SendNew(first)
+			if err != nil {
+				c.sendResult(first, err)
+				return
+			}
+			session.h2 = true
+			c.serveH2(first, session)
+			return
+		}
+	}
+
+	for {
+		r := newRequest(c.m, conn, connectionID)
+		r.client = session
+		r.Inbound = InboundReverse
+		r.ClientTLS = connTLSInfo(session.conn)
+		req, err := session.readNextRequest(r.timing, timing.TimeReadRequest)
+		if err != nil {
+			if !isConnClosed(err) {
+				slog.Error("failed to read reverse proxy request", "err", err.Error())
+			}
+			return
+		}
+		err = r.Init(req)
+		c.m.SendNew(r)
+		keepAlive := false
+		if err == nil {
+			keepAlive, err = r.handleMITMRequest(c.m, req, session.conn, c.certifcates)
+		}
+		c.sendResult(r, err)
+		req.Body.CloseBody()
+		if !keepAlive || err != nil {
+			return
+		}
+	}
+}
+
+// initReverse initializes a request to the proxy running as a reverse proxy: it is sent to the backend. It
+// must be called while a major time is running.
+func (r *Request) initReverse() error {
+	r.reqBodyID = r.ID + "-req-body"
+	r.respBodyID = r.ID + "-resp-body"
+	r.Datetime = time.Now()
+
+	host, secure, err := config.DefaultConfig.ReverseProxy.Backend()
+	if err != nil {
+		return fmt.Errorf("reverse proxy backend: %w", err)
+	}
+	r.Host, r.Secure = host, secure
+	if secure {
+		r.Kind = RequestKindHTTPS
+	} else {
+		r.Kind = RequestKindHTTP
+	}
+	r.initClient()
+	return nil
+}
+
+// setReverseHost sets the Host header of a request to the proxy running as a reverse proxy to the host of the
+// backend, unless the Host header the client sent is to be preserved.
+func (r *Request) setReverseHost() {
+	if config.DefaultConfig.ReverseProxy.PreserveHost {
+		return
+	}
+	r.req.Header.Set("Host", remote.HostHeader(r.Host, r.Secure))
+}
+
+// setReversePath prefixes the path of a request to the proxy running as a reverse proxy with the path of the
+// backend URL, if it has one.
+func (r *Request) setReversePath() {
+	base := config.DefaultConfig.ReverseProxy.BasePath()
+	if base != "" && strings.HasPrefix(r.req.Path, "/") { // not the asterisk-form of OPTIONS *
+		r.req.Path = base + r.req.Path
+	}
+}
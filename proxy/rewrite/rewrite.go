@@ -0,0 +1,224 @@
+// Package rewrite applies match-and-replace rules to requests before they are sent to the host and to
+// responses before they are forwarded to the client.
+package rewrite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/tiredkangaroo/cap/proxy/regexps"
+	"github.com/tiredkangaroo/cap/proxy/rules"
+)
+
+var (
+	ErrInvalidStage  = errors.New("invalid rewrite stage (must be request or response)")
+	ErrInvalidTarget = errors.New("invalid rewrite target (must be url, header_name, header_value or body)")
+	ErrEmptyMatch    = errors.New("rewrite rule must have something to match")
+	ErrURLResponse   = errors.New("url rewrite rules only apply to requests")
+)
+
+// Stage is whether a rule rewrites requests or responses.
+type Stage string
+
+const (
+	StageRequest  Stage = "request"
+	StageResponse Stage = "response"
+)
+
+// Target is the part of a request or response a rule rewrites.
+type Target string
+
+const (
+	// TargetURL is the path and query of a request (path?query).
+	TargetURL Target = "url"
+	// TargetHeaderName is the name of every header. A literal match must be the whole name (compared
+	// case-insensitively). A header renamed to an empty name is removed.
+	TargetHeaderName Target = "header_name"
+	// TargetHeaderValue is the value of every header, or of the header named Header only. If Match is empty,
+	// the header named Header is set to Replace instead.
+	TargetHeaderValue Target = "header_value"
+	// TargetBody is the (uncompressed) body.
+	TargetBody Target = "body"
+)
+
+// Rule replaces what matches Match with Replace in the Target of every request or response (depending on the
+// Stage) it applies to.
+type Rule struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled"`
+
+	Stage Stage `json:"stage"`
+	// Host is a glob the host must match for the rule to apply (see rules.MatchHost). The rule applies to
+	// every host if it is empty.
+	Host   string `json:"host"`
+	Target Target `json:"target"`
+	// Header is the name of the header a TargetHeaderValue rule applies to. If it is empty, it applies to
+	// every header.
+	Header string `json:"header"`
+
+	// Match is a regular expression if Regex is true, a literal string otherwise. Replace may refer to
+	// capture groups of a regular expression ($1, ${name}).
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+	Regex   bool   `json:"regex"`
+}
+
+// Label returns the name of the rule, or a description of it if it has none.
+func (r *Rule) Label() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	if r.Match == "" {
+		return fmt.Sprintf("%s set %s", r.Stage, r.Header)
+	}
+	return fmt.Sprintf("%s %s %q", r.Stage, r.Target, r.Match)
+}
+
+// Validate reports whether the rule is well formed.
+func (r *Rule) Validate() error {
+	switch r.Stage {
+	case StageRequest, StageResponse:
+	default:
+		return ErrInvalidStage
+	}
+	switch r.Target {
+	case TargetURL:
+		if r.Stage != StageRequest {
+			return ErrURLResponse
+		}
+	case TargetHeaderName, TargetHeaderValue, TargetBody:
+	default:
+		return ErrInvalidTarget
+	}
+	if r.Match == "" && (r.Target != TargetHeaderValue || r.Header == "") {
+		return ErrEmptyMatch
+	}
+	if _, err := path.Match(r.Host, ""); err != nil {
+		return fmt.Errorf("invalid host glob: %w", err)
+	}
+	if r.Regex {
+		if _, err := regexps.Compile(r.Match); err != nil {
+			return fmt.Errorf("invalid match regex: %w", err)
+		}
+	}
+	return nil
+}
+
+// AppliesTo reports whether the rule applies to the stage of an exchange with the host (host:port). A
+// disabled rule applies to nothing.
+func (r *Rule) AppliesTo(stage Stage, host string) bool {
+	return !r.Disabled && r.Stage == stage && (r.Host == "" || rules.MatchHost(r.Host, host))
+}
+
+// ReplaceString replaces every match in s. It returns the result and the number of replacements made.
+func (r *Rule) ReplaceString(s string) (string, int) {
+	if r.Match == "" {
+		return s, 0
+	}
+	if !r.Regex {
+		n := strings.Count(s, r.Match)
+		if n == 0 {
+			return s, 0
+		}
+		return strings.ReplaceAll(s, r.Match, r.Replace), n
+	}
+	re, err := regexps.Compile(r.Match)
+	if err != nil {
+		return s, 0
+	}
+	n := len(re.FindAllStringIndex(s, -1))
+	if n == 0 {
+		return s, 0
+	}
+	return re.ReplaceAllString(s, r.Replace), n
+}
+
+// ReplaceBytes is ReplaceString for a body.
+func (r *Rule) ReplaceBytes(b []byte) ([]byte, int) {
+	if r.Match == "" {
+		return b, 0
+	}
+	if !r.Regex {
+		n := bytes.Count(b, []byte(r.Match))
+		if n == 0 {
+			return b, 0
+		}
+		return bytes.ReplaceAll(b, []byte(r.Match), []byte(r.Replace)), n
+	}
+	re, err := regexps.Compile(r.Match)
+	if err != nil {
+		return b, 0
+	}
+	n := len(re.FindAllIndex(b, -1))
+	if n == 0 {
+		return b, 0
+	}
+	return re.ReplaceAll(b, []byte(r.Replace)), n
+}
+
+// RewriteHeader applies a TargetHeaderName or TargetHeaderValue rule to h (an http.Header). It returns the number of
+// replacements made.
+func (r *Rule) RewriteHeader(h map[string][]string) int {
+	switch r.Target {
+	case TargetHeaderName:
+		return r.rewriteHeaderNames(h)
+	case TargetHeaderValue:
+		return r.rewriteHeaderValues(h)
+	}
+	return 0
+}
+
+func (r *Rule) rewriteHeaderNames(h map[string][]string) int {
+	n := 0
+	renamed := make(map[string][]string) // added after ranging over h, so a renamed header is not renamed again
+	for name, values := range h {
+		var newName string
+		if r.Regex {
+			var count int
+			if newName, count = r.ReplaceString(name); count == 0 {
+				continue
+			}
+		} else if strings.EqualFold(name, r.Match) {
+			newName = r.Replace
+		} else {
+			continue
+		}
+		n++
+		delete(h, name)
+		if newName != "" {
+			renamed[newName] = append(renamed[newName], values...)
+		}
+	}
+	for name, values := range renamed {
+		h[name] = append(h[name], values...)
+	}
+	return n
+}
+
+func (r *Rule) rewriteHeaderValues(h map[string][]string) int {
+	if r.Match == "" {
+		for name := range h {
+			if strings.EqualFold(name, r.Header) {
+				delete(h, name) // header names are kept as sent, it may differ in case
+			}
+		}
+		h[r.Header] = []string{r.Replace}
+		return 1
+	}
+	n := 0
+	for name, values := range h {
+		if r.Header != "" && !strings.EqualFold(name, r.Header) {
+			continue
+		}
+		for i, v := range values {
+			var count int
+			values[i], count = r.ReplaceString(v)
+			n += count
+		}
+	}
+	return n
+}
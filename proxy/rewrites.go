@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tiredkangaroo/cap/proxy/config"
+	"github.com/tiredkangaroo/cap/proxy/http"
+	"github.com/tiredkangaroo/cap/proxy/rewrite"
+	"github.com/tiredkangaroo/cap/proxy/timing"
+)
+
+// maxRewriteBodySize is the largest body that body rewrite rules apply to. Larger bodies are forwarded as they are.
+const maxRewriteBodySize = 16 << 20
+
+// AppliedRewrite is a rewrite rule applied to a request or its response, as recorded.
+type AppliedRewrite struct {
+	RuleID string         `json:"ruleID"`
+	Name   string         `json:"name"`
+	Stage  rewrite.Stage  `json:"stage"`
+	Target rewrite.Target `json:"target"`
+	Count  int            `json:"count"` // number of replacements made
+}
+
+// rewriteRequest applies the request rewrite rules to the request before it is sent to the host. It reports
+// whether any rule changed it.
+func (r *Request) rewriteRequest() (bool, error) {
+	return r.applyRewrites(rewrite.StageRequest)
+}
+
+// rewriteResponse applies the response rewrite rules to the response before it is forwarded to the client.
+func (r *Request) rewriteResponse() (bool, error) {
+	return r.applyRewrites(rewrite.StageResponse)
+}
+
+// applyRewrites applies the rewrite rules of the stage, in order. Every rule that changes something is
+// recorded in the timeline and in r.Rewrites.
+func (r *Request) applyRewrites(stage rewrite.Stage) (bool, error) {
+	header := r.req.Header
+	if stage == rewrite.StageResponse {
+		header = r.resp.Header
+	}
+
+	// the body is read once, the first time a rule needs it, and replaced once every rule was applied
+	var body []byte
+	var bodyLoaded, bodyRewritable, bodyChanged bool
+
+	applied := false
+	for _, rule := range config.Rules(&config.DefaultConfig.RewriteRules) {
+		if !rule.AppliesTo(stage, r.Host) {
+			continue
+		}
+		start := time.Now()
+
+		var n int
+		switch rule.Target {
+		case rewrite.TargetURL:
+			var err error
+			if n, err = r.rewriteURL(&rule); err != nil {
+				return applied, fmt.Errorf("rewrite %s: %w", rule.Label(), err)
+			}
+		case rewrite.TargetHeaderName, rewrite.TargetHeaderValue:
+			n = rule.RewriteHeader(header)
+		case rewrite.TargetBody:
+			if !bodyLoaded {
+				var err error
+				if body, bodyRewritable, err = r.rewritableBody(stage); err != nil {
+					return applied, fmt.Errorf("rewrite %s: %w", rule.Label(), err)
+				}
+				bodyLoaded = true
+			}
+			if bodyRewritable {
+				body, n = rule.ReplaceBytes(body)
+				bodyChanged = bodyChanged || n > 0
+			}
+		}
+		if n == 0 {
+			continue
+		}
+
+		applied = true
+		r.timing.Subrecord(timing.RewriteSubtime(rule.Label()), start)
+		r.Rewrites = append(r.Rewrites, AppliedRewrite{
+			RuleID: rule.ID,
+			Name:   rule.Label(),
+			Stage:  stage,
+			Target: rule.Target,
+			Count:  n,
+		})
+	}
+
+	if bodyChanged {
+		r.setRewrittenBody(stage, body)
+	}
+	return applied, nil
+}
+
+// rewriteURL applies a URL rewrite rule to the path and query of the request.
+func (r *Request) rewriteURL(rule *rewrite.Rule) (int, error) {
+	u := r.req.Path
+	if q := r.req.Query.Encode(); q != "" {
+		u += "?" + q
+	}
+	u, n := rule.ReplaceString(u)
+	if n == 0 {
+		return 0, nil
+	}
+	path, rawQuery, _ := strings.Cut(u, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return 0, fmt.Errorf("parse rewritten query: %w", err)
+	}
+	r.req.Path = path
+	r.req.Query = query
+	return n, nil
+}
+
+// rewritableBody reads the body of the stage in full. It reports false if body rewrite rules cannot apply to
+// it: it is compressed, too large, or a stream that must be forwarded as it arrives.
+func (r *Request) rewritableBody(stage rewrite.Stage) ([]byte, bool, error) {
+	body, header := r.req.Body, r.req.Header
+	if stage == rewrite.StageResponse {
+		if r.req.Method == http.MethodHead || r.resp.StatusCode == http.StatusSwitchingProtocols || isEventStream(r.resp) {
+			return nil, false, nil
+		}
+		body, header = r.resp.Body, r.resp.Header
+	}
+	if body == nil {
+		return nil, false, nil
+	}
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return nil, false, nil
+	}
+	if body.ContentLength() > maxRewriteBodySize {
+		return nil, false, nil
+	}
+
+	// a body of unknown length is read up to the limit only, it may be larger or never end
+	b, err := io.ReadAll(io.LimitReader(body, maxRewriteBodySize+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("read body: %w", err)
+	}
+	if len(b) > maxRewriteBodySize {
+		return nil, false, nil // what was read is forwarded first, then the rest as it arrives
+	}
+	return b, true, nil
+}
+
+// setRewrittenBody replaces the body of the stage. The new body is sent with a Content-Length.
+func (r *Request) setRewrittenBody(stage rewrite.Stage, b []byte) {
+	cl := int64(len(b))
+	body := http.NewBody(bufio.NewReader(bytes.NewReader(b)), cl)
+	header := r.req.Header
+	// the old body was read in full (see rewritableBody), nothing closes it once it is replaced
+	if stage == rewrite.StageRequest {
+		r.req.Body.CloseBody()
+		r.req.Body = body
+		r.req.ContentLength = cl
+	} else {
+		// the host's body was read in full, so the host connection can still be reused (see releaseHostConn)
+		header = r.resp.Header
+		r.resp.Body.CloseBody()
+		r.resp.Body = body
+		r.resp.ContentLength = cl
+		r.resp.CloseDelimited = false
+	}
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.FormatInt(cl, 10))
+}
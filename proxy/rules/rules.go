@@ -0,0 +1,164 @@
+// Package rules decides which requests the proxy pauses for approval (intercepts), which it lets through
+// and which it cancels, so that approval can be required for a few hosts without blocking everything else.
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/tiredkangaroo/cap/proxy/regexps"
+)
+
+var (
+	ErrInvalidAction = errors.New("invalid rule action (must be intercept, approve or cancel)")
+	ErrEmptyRule     = errors.New("rule must match on at least one field")
+)
+
+type Action string
+
+const (
+	// ActionIntercept pauses matching requests for approval, whether or not approval is required.
+	ActionIntercept Action = "intercept"
+	// ActionApprove lets matching requests through without pausing them, even if approval is required.
+	ActionApprove Action = "approve"
+	// ActionCancel cancels matching requests without pausing them.
+	ActionCancel Action = "cancel"
+)
+
+// Rule matches requests and decides what happens to them. Every field that is set must match, unset fields
+// match anything.
+type Rule struct {
+	ID       string `json:"id"`
+	Disabled bool   `json:"disabled"`
+
+	// Host is a glob (path.Match syntax, e.g. *.example.com) matched against the hostname, or against
+	// host:port if the glob has a port.
+	Host string `json:"host"`
+	// Path is a regular expression matched against the path of the request.
+	Path string `json:"path"`
+	// Method is matched case-insensitively against the method of the request (CONNECT for tunnels).
+	Method string `json:"method"`
+	// ClientApplication is a glob matched case-insensitively against the name of the client application.
+	ClientApplication string `json:"client_application"`
+	// ClientIP is an IP address or CIDR range the client IP must be in.
+	ClientIP string `json:"client_ip"`
+
+	Action Action `json:"action"`
+}
+
+// Subject is what rules are matched against.
+type Subject struct {
+	Host              string // host:port
+	Path              string
+	Method            string
+	ClientApplication string
+	ClientIP          string
+}
+
+// Validate reports whether the rule is well formed.
+func (r *Rule) Validate() error {
+	switch r.Action {
+	case ActionIntercept, ActionApprove, ActionCancel:
+	default:
+		return ErrInvalidAction
+	}
+	if r.Host == "" && r.Path == "" && r.Method == "" && r.ClientApplication == "" && r.ClientIP == "" {
+		return ErrEmptyRule
+	}
+	if _, err := path.Match(r.Host, ""); err != nil {
+		return fmt.Errorf("invalid host glob: %w", err)
+	}
+	if _, err := path.Match(r.ClientApplication, ""); err != nil {
+		return fmt.Errorf("invalid client application glob: %w", err)
+	}
+	if _, err := regexps.Compile(r.Path); err != nil {
+		return fmt.Errorf("invalid path regex: %w", err)
+	}
+	if r.ClientIP != "" {
+		if err := ValidateIP(r.ClientIP); err != nil {
+			return fmt.Errorf("invalid client ip: %w", err)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the rule matches s. A disabled (or invalid) rule never matches.
+func (r *Rule) Matches(s Subject) bool {
+	if r.Disabled {
+		return false
+	}
+	if r.Host != "" && !MatchHost(r.Host, s.Host) {
+		return false
+	}
+	if r.Path != "" {
+		re, err := regexps.Compile(r.Path)
+		if err != nil || !re.MatchString(s.Path) {
+			return false
+		}
+	}
+	if r.Method != "" && !strings.EqualFold(r.Method, s.Method) {
+		return false
+	}
+	if r.ClientApplication != "" {
+		ok, _ := path.Match(strings.ToLower(r.ClientApplication), strings.ToLower(s.ClientApplication))
+		if !ok {
+			return false
+		}
+	}
+	if r.ClientIP != "" && !MatchIP(r.ClientIP, s.ClientIP) {
+		return false
+	}
+	return true
+}
+
+// MatchHost reports whether the host:port matches the glob. The glob is matched against the hostname only,
+// unless it has a port.
+func MatchHost(glob, hostport string) bool {
+	subject := hostport
+	if _, _, err := net.SplitHostPort(glob); err != nil {
+		// no port in the glob, match the hostname only
+		if host, _, err := net.SplitHostPort(hostport); err == nil {
+			subject = host
+		}
+	}
+	ok, _ := path.Match(strings.ToLower(glob), strings.ToLower(subject))
+	return ok
+}
+
+// ValidateIP reports whether entry is an IP address or a CIDR range.
+func ValidateIP(entry string) error {
+	if net.ParseIP(entry) != nil {
+		return nil
+	}
+	_, _, err := net.ParseCIDR(entry)
+	return err
+}
+
+// MatchIP reports whether clientIP is the IP address rule, or in the CIDR range rule.
+func MatchIP(rule, clientIP string) bool {
+	if rule == clientIP {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	if ruleIP := net.ParseIP(rule); ruleIP != nil {
+		return ruleIP.Equal(ip)
+	}
+	_, ipnet, err := net.ParseCIDR(rule)
+	return err == nil && ipnet.Contains(ip)
+}
+
+// Match returns the first rule that matches s, or nil if none does.
+func Match(rules []Rule, s Subject) *Rule {
+	for i := range rules {
+		if rules[i].Matches(s) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package rules
+
+import "testing"
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		glob, hostport string
+		want           bool
+	}{
+		{"example.com", "example.com:443", true},
+		{"example.com", "example.com", true},
+		{"*.example.com", "api.example.com:443", true},
+		{"*.example.com", "example.com:443", false},
+		{"*.example.com", "a.b.example.com:443", true}, // path.Match stars do not stop at dots
+		{"EXAMPLE.com", "example.COM:80", true},
+		{"example.com:443", "example.com:443", true},
+		{"example.com:443", "example.com:8443", false},
+		{"example.com:*", "example.com:8443", true},
+		{"example.com", "example.org:443", false},
+		{"[", "example.com:443", false}, // malformed globs never match
+	}
+	for _, tt := range tests {
+		if got := MatchHost(tt.glob, tt.hostport); got != tt.want {
+			t.Errorf("MatchHost(%q, %q) = %v, want %v", tt.glob, tt.hostport, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/tiredkangaroo/cap/proxy/config"
+	"github.com/tiredkangaroo/cap/proxy/http"
+	"github.com/tiredkangaroo/cap/proxy/timing"
+)
+
+// clientSession is a connection the proxy reads client requests from. It is either the client connection
+// itself (proxy requests) or the TLS session on top of it (MITM'd requests). The buffered reader must
+// persist between requests, since a client may send its next request before the previous response.
+type clientSession struct {
+	conn net.Conn
+	buf  *bufio.Reader
+
+	requests int  // number of requests read so far
+	h2       bool // whether the client negotiated HTTP/2 (requests are read by serveH2 instead)
+}
+
+func newClientSession(conn net.Conn) *clientSession {
+	return &clientSession{
+		conn: conn,
+		buf:  bufio.NewReader(conn),
+	}
+}
+
+// readNextRequest waits for the next request on the session and reads it, timing the read under key. Waiting
+// for the first request is bounded by the client idle timeout, and for any request after it by the keep-alive
+// timeout; neither is part of the timing. Reading the head of the request is bounded by the read timeout.
+func (s *clientSession) readNextRequest(t *timing.Timing, key timing.Time) (*http.Request, error) {
+	idle := config.DefaultConfig.ClientIdleDuration()
+	if s.requests > 0 {
+		idle = config.DefaultConfig.KeepAliveDuration()
+	}
+	s.conn.SetReadDeadline(time.Now().Add(idle))
+	if _, err := s.buf.Peek(1); err != nil {
+		return nil, err
+	}
+	// the body is read (and forwarded) as it comes, only the head has to arrive in time
+	s.conn.SetReadDeadline(time.Now().Add(config.DefaultConfig.RequestReadDuration()))
+
+	t.Start(key)
+	req, err := http.ReadRequestFrom(s.conn, s.buf)
+	t.Stop()
+	s.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			slog.Warn("client did not send its request in time", "client", s.conn.RemoteAddr().String())
+		}
+		return nil, err
+	}
+	s.requests++
+	return req, nil
+}
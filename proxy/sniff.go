@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/tiredkangaroo/cap/proxy/http"
+)
+
+// sniffTimeout is how long a client is given to send something before its stream is taken to be one where
+// the server speaks first (e.g. SSH, SMTP or MySQL).
+const sniffTimeout = 300 * time.Millisecond
+
+// streamKind is what a client stream was sniffed to be.
+type streamKind int
+
+const (
+	streamOpaque streamKind = iota // anything else, tunneled as is
+	streamHTTP
+	streamTLS
+)
+
+// sniffedConn is a connection whose first bytes were peeked. Reads start with the peeked bytes.
+type sniffedConn struct {
+	net.Conn
+	buf *bufio.Reader
+}
+
+func (s *sniffedConn) Read(p []byte) (int, error) {
+	return s.buf.Read(p)
+}
+
+// sniffStream peeks at the first bytes the client sends on conn to tell HTTP and TLS streams apart from
+// anything else. For TLS, it also returns the server name the client asked for (SNI), if any. The returned
+// connection must be read from instead of conn.
+func sniffStream(conn net.Conn) (*sniffedConn, streamKind, string) {
+	// large enough for any ClientHello record
+	sc := &sniffedConn{Conn: conn, buf: bufio.NewReaderSize(conn, 5+1<<14)}
+
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	first, err := sc.buf.Peek(1)
+	if err != nil {
+		return sc, streamOpaque, ""
+	}
+
+	if first[0] == 0x16 { // TLS handshake record
+		return sc, streamTLS, sniffServerName(sc.buf)
+	}
+
+	// an HTTP request starts with a method and a space
+	b, err := sc.buf.Peek(len("OPTIONS "))
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		b, _ = sc.buf.Peek(sc.buf.Buffered())
+	}
+	if i := bytes.IndexByte(b, ' '); i > 0 && http.MethodFromString(string(b[:i])) != http.MethodUnknown {
+		return sc, streamHTTP, ""
+	}
+	return sc, streamOpaque, ""
+}
+
+// sniffServerName returns the server name of the TLS ClientHello buffered in br, or "" if it has none (or is
+// not a ClientHello).
+func sniffServerName(br *bufio.Reader) string {
+	header, err := br.Peek(5)
+	if err != nil {
+		return ""
+	}
+	record, err := br.Peek(5 + int(binary.BigEndian.Uint16(header[3:5])))
+	if err != nil {
+		return ""
+	}
+	return serverNameFromClientHello(record[5:])
+}
+
+// serverNameFromClientHello parses the server_name extension out of a ClientHello handshake message.
+func serverNameFromClientHello(b []byte) string {
+	// handshake type (1), length (3), client version (2), random (32)
+	if len(b) < 38 || b[0] != 0x01 {
+		return ""
+	}
+	b = b[38:]
+	// session id, cipher suites and compression methods
+	for _, lenSize := range []int{1, 2, 1} {
+		_, rest, ok := readVector(b, lenSize)
+		if !ok {
+			return ""
+		}
+		b = rest
+	}
+	extensions, _, ok := readVector(b, 2)
+	if !ok {
+		return ""
+	}
+	for len(extensions) >= 4 {
+		typ := binary.BigEndian.Uint16(extensions[0:2])
+		data, rest, ok := readVector(extensions[2:], 2)
+		if !ok {
+			return ""
+		}
+		extensions = rest
+		if typ != 0 { // server_name
+			continue
+		}
+		names, _, ok := readVector(data, 2)
+		for ok && len(names) >= 3 {
+			var name []byte
+			nameType := names[0]
+			name, names, ok = readVector(names[1:], 2)
+			if ok && nameType == 0 { // host_name
+				return string(name)
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// readVector reads a TLS vector with a length prefix of lenSize bytes from b. It returns the vector and
+// what follows it.
+func readVector(b []byte, lenSize int) ([]byte, []byte, bool) {
+	if len(b) < lenSize {
+		return nil, nil, false
+	}
+	n := 0
+	for _, c := range b[:lenSize] {
+		n = n<<8 | int(c)
+	}
+	b = b[lenSize:]
+	if len(b) < n {
+		return nil, nil, false
+	}
+	return b[:n], b[n:], true
+}
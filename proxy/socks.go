@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/tiredkangaroo/cap/proxy/config"
+)
+
+// socksHandshakeTimeout is how long a client of the SOCKS listener has to finish the SOCKS handshake.
+const socksHandshakeTimeout = 10 * time.Second
+
+var (
+	ErrSOCKSVersion        = errors.New("unsupported socks version")
+	ErrSOCKSNoMethod       = errors.New("socks client offered no supported authentication method")
+	ErrSOCKSCommand        = errors.New("unsupported socks command (only CONNECT is supported)")
+	ErrSOCKSAddressType    = errors.New("unsupported socks address type")
+	ErrSOCKSAuthentication = errors.New("unsupported socks username/password authentication version")
+	ErrSOCKS4Auth          = errors.New("socks4 clients cannot authenticate, proxy authentication is enforced")
+)
+
+// SOCKS5 constants (RFC 1928, RFC 1929).
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xFF
+
+	socks5CommandConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded          = 0x00
+	socks5ReplyCommandUnsupported = 0x07
+	socks5ReplyAddrUnsupported    = 0x08
+)
+
+// SOCKS4 (and SOCKS4a) constants.
+const (
+	socks4Version        = 0x04
+	socks4CommandConnect = 0x01
+	socks4ReplyGranted   = 0x5A
+	socks4ReplyRejected  = 0x5B
+)
+
+// serveSOCKS serves a connection to the SOCKS listener, which accepts SOCKS5 and SOCKS4a clients: it performs
+// the SOCKS handshake with the client on rawconn, then serves the stream it tunnels (see serveStream).
+func (c *ProxyHandler) serveSOCKS(rawconn net.Conn) {
+	defer rawconn.Close()
+
+	rawconn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	target, err := socksHandshake(rawconn)
+	if err != nil {
+		if !isConnClosed(err) {
+			slog.Error("socks handshake", "err", err.Error(), "client", rawconn.RemoteAddr().String())
+		}
+		return
+	}
+	rawconn.SetDeadline(time.Time{})
+
+	c.serveStream(rawconn, target)
+}
+
+// socksHandshake reads the greeting and the CONNECT request of a SOCKS5 or SOCKS4(a) client on conn, and
+// tells the client the connection succeeded. The target is not dialed here: it is dialed like the host of
+// any other request, once the stream is known.
+func socksHandshake(conn net.Conn) (*streamTarget, error) {
+	var version [1]byte
+	if _, err := io.ReadFull(conn, version[:]); err != nil {
+		return nil, err
+	}
+	switch version[0] {
+	case socks5Version:
+		return socks5Handshake(conn)
+	case socks4Version:
+		return socks4Handshake(conn)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrSOCKSVersion, version[0])
+	}
+}
+
+func socks5Handshake(conn net.Conn) (*streamTarget, error) {
+	target := &streamTarget{inbound: InboundSOCKS5}
+
+	// greeting: the authentication methods the client supports
+	var n [1]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return nil, fmt.Errorf("read methods: %w", err)
+	}
+	methods := make([]byte, n[0])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, fmt.Errorf("read methods: %w", err)
+	}
+	// a client only offers username/password if it has credentials, so they are asked for to be recorded (or
+	// checked, if proxy authentication is enforced, in which case clients without any are not acceptable)
+	enforced := config.DefaultConfig.ProxyAuth
+	method := byte(socks5MethodNoAcceptable)
+	for _, m := range methods {
+		if m == socks5MethodUserPass || (m == socks5MethodNoAuth && !enforced && method == socks5MethodNoAcceptable) {
+			method = m
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, fmt.Errorf("write method: %w", err)
+	}
+	if method == socks5MethodNoAcceptable {
+		return nil, ErrSOCKSNoMethod
+	}
+	if method == socks5MethodUserPass {
+		user, password, err := socks5ReadUserPass(conn)
+		if err != nil {
+			return nil, err
+		}
+		target.user, err = authenticateSOCKS(user, password)
+		if err != nil {
+			conn.Write([]byte{0x01, 0x01})
+			return nil, fmt.Errorf("authenticate %q: %w", user, err)
+		}
+		if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+			return nil, fmt.Errorf("write authentication status: %w", err)
+		}
+		if target.user == "" {
+			target.authorization = basicAuthorization(user, password)
+		}
+	}
+
+	// request: VER CMD RSV ATYP
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, fmt.Errorf("read request: %w", err)
+	}
+	if head[0] != socks5Version {
+		return nil, fmt.Errorf("%w: %d", ErrSOCKSVersion, head[0])
+	}
+	var hostname string
+	switch head[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if head[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, fmt.Errorf("read address: %w", err)
+		}
+		hostname = ip.String()
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return nil, fmt.Errorf("read address: %w", err)
+		}
+		domain := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, fmt.Errorf("read address: %w", err)
+		}
+		hostname = string(domain)
+	default:
+		socks5Reply(conn, socks5ReplyAddrUnsupported)
+		return nil, fmt.Errorf("%w: %d", ErrSOCKSAddressType, head[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return nil, fmt.Errorf("read port: %w", err)
+	}
+	if head[1] != socks5CommandConnect {
+		socks5Reply(conn, socks5ReplyCommandUnsupported)
+		return nil, fmt.Errorf("%w: %d", ErrSOCKSCommand, head[1])
+	}
+	target.host = net.JoinHostPort(hostname, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+
+	if err := socks5Reply(conn, socks5ReplySucceeded); err != nil {
+		return nil, fmt.Errorf("write reply: %w", err)
+	}
+	return target, nil
+}
+
+// socks5ReadUserPass reads a username/password authentication request (RFC 1929).
+func socks5ReadUserPass(conn net.Conn) (string, string, error) {
+	var version [1]byte
+	if _, err := io.ReadFull(conn, version[:]); err != nil {
+		return "", "", fmt.Errorf("read authentication: %w", err)
+	}
+	if version[0] != 0x01 {
+		return "", "", fmt.Errorf("%w: %d", ErrSOCKSAuthentication, version[0])
+	}
+	var fields [2]string
+	for i := range fields {
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", "", fmt.Errorf("read authentication: %w", err)
+		}
+		b := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", "", fmt.Errorf("read authentication: %w", err)
+		}
+		fields[i] = string(b)
+	}
+	return fields[0], fields[1], nil
+}
+
+// socks5Reply writes a reply with the status rep. The bound address is never known to the client, as the
+// target is only dialed once the stream is known.
+func socks5Reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socks5Version, rep, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func socks4Handshake(conn net.Conn) (*streamTarget, error) {
+	target := &streamTarget{inbound: InboundSOCKS4}
+
+	// request: CD DSTPORT DSTIP USERID NUL [HOSTNAME NUL]
+	var head [7]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, fmt.Errorf("read request: %w", err)
+	}
+	user, err := readNullTerminated(conn)
+	if err != nil {
+		return nil, fmt.Errorf("read user id: %w", err)
+	}
+	if user != "" {
+		target.authorization = basicAuthorization(user, "")
+	}
+	hostname := net.IP(head[3:7]).String()
+	if head[3] == 0 && head[4] == 0 && head[5] == 0 && head[6] != 0 {
+		// SOCKS4a: the client did not resolve the host, its name follows
+		if hostname, err = readNullTerminated(conn); err != nil {
+			return nil, fmt.Errorf("read hostname: %w", err)
+		}
+	}
+	if head[0] != socks4CommandConnect {
+		conn.Write([]byte{0x00, socks4ReplyRejected, 0, 0, 0, 0, 0, 0})
+		return nil, fmt.Errorf("%w: %d", ErrSOCKSCommand, head[0])
+	}
+	if config.DefaultConfig.ProxyAuth {
+		conn.Write([]byte{0x00, socks4ReplyRejected, 0, 0, 0, 0, 0, 0})
+		return nil, ErrSOCKS4Auth
+	}
+	target.host = net.JoinHostPort(hostname, strconv.Itoa(int(binary.BigEndian.Uint16(head[1:3]))))
+
+	if _, err := conn.Write([]byte{0x00, socks4ReplyGranted, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, fmt.Errorf("write reply: %w", err)
+	}
+	return target, nil
+}
+
+// readNullTerminated reads a NUL-terminated string of at most 255 bytes from conn, byte by byte so nothing
+// after it is consumed.
+func readNullTerminated(conn net.Conn) (string, error) {
+	var s []byte
+	var b [1]byte
+	for len(s) < 256 {
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		s = append(s, b[0])
+	}
+	return "", errors.New("string too long")
+}
+
+// basicAuthorization returns the credentials as the value of a Basic Authorization header, the way they
+// are recorded for clients of the HTTP proxy listener (from their Proxy-Authorization header).
+func basicAuthorization(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
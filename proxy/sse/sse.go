@@ -0,0 +1,132 @@
+// Package sse parses a text/event-stream (Server-Sent Events) as it is forwarded, following the event
+// stream interpretation of the HTML spec.
+package sse
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// maxLineLength is the longest line kept. The rest of a longer line is dropped (it is still forwarded,
+// only the parsed event is affected).
+const maxLineLength = 1 << 20
+
+// Event is a single dispatched event.
+type Event struct {
+	// Type is the event type, "message" unless the event set another one.
+	Type string
+	Data string
+	// ID is the last event ID at the time the event was dispatched (IDs persist across events).
+	ID string
+	// Retry is the reconnection time in milliseconds the event set, or -1.
+	Retry int
+}
+
+// Parser is an io.Writer that parses the event stream written to it and calls a function for every event
+// dispatched.
+type Parser struct {
+	onEvent func(Event)
+
+	line      []byte
+	lastID    string
+	eventType string
+	data      strings.Builder
+	hasData   bool
+	retry     int
+	firstLine bool // whether the next line is the first one (which may start with a BOM)
+}
+
+func NewParser(onEvent func(Event)) *Parser {
+	return &Parser{
+		onEvent:   onEvent,
+		retry:     -1,
+		firstLine: true,
+	}
+}
+
+// Write parses p. It never fails.
+func (p *Parser) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			p.appendLine(b)
+			break
+		}
+		p.appendLine(b[:i])
+		b = b[i+1:]
+		line := bytes.TrimSuffix(p.line, []byte{'\r'})
+		p.processLine(line)
+		p.line = p.line[:0]
+	}
+	return n, nil
+}
+
+func (p *Parser) appendLine(b []byte) {
+	if room := maxLineLength - len(p.line); len(b) > room {
+		b = b[:max(room, 0)]
+	}
+	p.line = append(p.line, b...)
+}
+
+func (p *Parser) processLine(line []byte) {
+	if p.firstLine {
+		line = bytes.TrimPrefix(line, []byte("\xEF\xBB\xBF"))
+		p.firstLine = false
+	}
+
+	if len(line) == 0 {
+		p.dispatch()
+		return
+	}
+	if line[0] == ':' {
+		return // comment (often sent as a keep-alive)
+	}
+
+	field, value := string(line), ""
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		field = string(line[:i])
+		value = strings.TrimPrefix(string(line[i+1:]), " ")
+	}
+	switch field {
+	case "event":
+		p.eventType = value
+	case "data":
+		p.data.WriteString(value)
+		p.data.WriteByte('\n')
+		p.hasData = true
+	case "id":
+		if !strings.ContainsRune(value, 0) {
+			p.lastID = value
+		}
+	case "retry":
+		if retry, err := strconv.Atoi(value); err == nil && retry >= 0 {
+			p.retry = retry
+		}
+	}
+}
+
+// dispatch dispatches the event made of the lines read since the last blank line. Events without data
+// are not dispatched, as in a browser.
+func (p *Parser) dispatch() {
+	defer func() {
+		p.eventType = ""
+		p.data.Reset()
+		p.hasData = false
+		p.retry = -1
+	}()
+	if !p.hasData {
+		return
+	}
+	e := Event{
+		Type:  p.eventType,
+		Data:  strings.TrimSuffix(p.data.String(), "\n"),
+		ID:    p.lastID,
+		Retry: p.retry,
+	}
+	if e.Type == "" {
+		e.Type = "message"
+	}
+	p.onEvent(e)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tiredkangaroo/cap/proxy/config"
+	"github.com/tiredkangaroo/cap/proxy/timing"
+)
+
+// How a client reached the proxy (see Request.Inbound).
+const (
+	InboundHTTP        = "http"
+	InboundSOCKS5      = "socks5"
+	InboundSOCKS4      = "socks4"
+	InboundSOCKS       = "socks" // a connection to the SOCKS listener rejected before its handshake
+	InboundTransparent = "transparent"
+	InboundReverse     = "reverse"
+)
+
+// streamTarget is where a stream that did not come in as an HTTP proxy request (through the SOCKS listener
+// or the transparent listener) is going.
+type streamTarget struct {
+	host          string // host:port
+	inbound       string // InboundSOCKS5, InboundSOCKS4 or InboundTransparent
+	authorization string // the credentials the client sent, as a Basic authorization
+	user          string // the proxy user the client authenticated as, if proxy authentication is enforced
+}
+
+// serveStream sniffs the stream the client sends to the target on rawconn to decide how to serve it: HTTP is
+// served request by request, TLS like a CONNECT request (MITM'd if enabled), and anything else is tunneled to
+// the target as is.
+func (c *ProxyHandler) serveStream(rawconn net.Conn, target *streamTarget) {
+	sc, kind, serverName := sniffStream(rawconn)
+	conn := NewCustomConn(sc)
+	connectionID := newID()
+	switch kind {
+	case streamHTTP:
+		c.serveStreamHTTP(conn, connectionID, target)
+	case streamTLS:
+		r := newRequest(c.m, conn, connectionID)
+		r.initStream(target, namedHost(target.host, serverName), true)
+		c.serveAfterInit(r, nil)
+	default:
+		r := newRequest(c.m, conn, connectionID)
+		r.initStream(target, target.host, false)
+		c.m.SendNew(r)
+		c.sendResult(r, r.handleNoMITM(c.m))
+	}
+}
+
+// serveStreamHTTP serves the HTTP requests a client sends to the target until the client closes the
+// connection or a request does not allow it to be kept alive.
+func (c *ProxyHandler) serveStreamHTTP(conn *CustomConn, connectionID string, target *streamTarget) {
+	session := newClientSession(conn)
+	for {
+		r := newRequest(c.m, conn, connectionID)
+		r.client = session
+		r.Inbound = target.inbound
+		r.ClientUser = target.user
+		req, err := session.readNextRequest(r.timing, timing.TimeReadProxyRequest)
+		if err != nil {
+			if !isConnClosed(err) {
+				slog.Error("failed to read request from stream", "err", err.Error(), "inbound", target.inbound)
+			}
+			return
+		}
+
+		r.Init(req)
+		// the request is sent where the client connected to, whatever its Host header says (the name the
+		// header gives is only what the request is recorded as)
+		r.streamHost = target.host
+		r.Host = namedHost(target.host, getHostname(req.Header.Get("Host")))
+		r.ClientAuthorization = target.authorization
+		keepAlive := c.serveAfterInit(r, req)
+		req.Body.CloseBody()
+		if !keepAlive {
+			return
+		}
+	}
+}
+
+// namedHost returns host (host:port) with its IP address replaced by name, if the client resolved the host
+// itself and the name it asked for is known (from the SNI of its ClientHello or the Host header of its
+// request). It is what the request is recorded (and certified) as, it is still sent to host (see hostAddr).
+func namedHost(host, name string) string {
+	name = strings.Trim(name, "[]") // an IPv6 address in a Host header without a port
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil || net.ParseIP(hostname) == nil || name == "" || net.ParseIP(name) != nil {
+		return host
+	}
+	return net.JoinHostPort(name, port)
+}
+
+// hostAddr returns the address (host:port) the request is sent to, before map remote rules apply: where the
+// client connected to for a stream, Host otherwise.
+func (r *Request) hostAddr() string {
+	if r.streamHost != "" {
+		return r.streamHost
+	}
+	return r.Host
+}
+
+// initStream initializes a request for a stream to host, as Init does for a CONNECT request. A secure
+// request is served like one, an insecure one is only ever tunneled.
+func (r *Request) initStream(target *streamTarget, host string, secure bool) {
+	r.timing.Start(timing.TimeRequestInit)
+	defer r.timing.Stop()
+	r.Secure = secure
+	r.reqBodyID = r.ID + "-req-body"
+	r.respBodyID = r.ID + "-resp-body"
+	if secure && config.DefaultConfig.MITM {
+		r.Kind = RequestKindHTTPSMITM
+	} else if secure {
+		r.Kind = RequestKindHTTPS
+	} else {
+		r.Kind = RequestKindHTTP
+	}
+	r.Datetime = time.Now()
+	r.Inbound = target.inbound
+	r.Host = host
+	r.streamHost = target.host
+	r.ClientAuthorization = target.authorization
+	r.ClientUser = target.user
+	r.initClient()
+}
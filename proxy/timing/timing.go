@@ -56,6 +56,10 @@ const (
 	// connections where the proxy is acting as the intended host (MITM).
 	TimeReadRequest Time = "Read Request"
 
+	// TimeWebSocket is the time the connection spent upgraded (e.g. to WebSocket) after a 101 Switching Protocols
+	// response, with the client and the host spliced together.
+	TimeWebSocket Time = "WebSocket"
+
 	TimeTotal = "Total"
 )
 
@@ -70,11 +74,25 @@ const (
 	SubtimeWaitApproval Subtime = "Wait Approval"
 	SubtimeDelayPerform Subtime = "Perform Delay"
 	// SubtimeDialHost includes the time taken to dial the host for both HTTP and HTTPS (TLS) connections.
-	SubtimeDialHost     Subtime = "Dial Host"
-	SubtimeWriteRequest Subtime = "Write Request"
-	SubtimeReadResponse Subtime = "Read Response"
+	SubtimeDialHost Subtime = "Dial Host"
+	// SubtimeReusePooledConn marks that an idle pooled connection to the host was reused instead of dialing one.
+	SubtimeReusePooledConn Subtime = "Reuse Pooled Connection"
+	SubtimeWriteRequest    Subtime = "Write Request"
+	SubtimeReadResponse    Subtime = "Read Response"
+	// SubtimeWaitResponseApproval is the time taken to wait for approval to forward the response.
+	SubtimeWaitResponseApproval Subtime = "Wait Response Approval"
+	// SubtimeRewrite is the time taken to apply a rewrite rule. Each rule applied is recorded as its own minor
+	// time, named SubtimeRewrite followed by the name of the rule (see RewriteSubtime).
+	SubtimeRewrite Subtime = "Rewrite"
+	// SubtimeMock is the time taken to build the response of a mock rule, in place of connecting to the host.
+	SubtimeMock Subtime = "Mock Response"
 )
 
+// RewriteSubtime returns the minor time of the rewrite rule with the name applied.
+func RewriteSubtime(name string) Subtime {
+	return SubtimeRewrite + Subtime(" ("+name+")")
+}
+
 type MinorTime struct {
 	start    time.Time
 	Duration time.Duration `json:"duration"`
@@ -129,6 +147,17 @@ func (t *Timing) Substop() {
 	minor.Duration = time.Since(minor.start)
 }
 
+// Subrecord records a minor time that started at start and ends now. Unlike Substart, it does not update
+// the state (it is used for things only known to have happened once they are over).
+func (t *Timing) Subrecord(sub Subtime, start time.Time) {
+	lastMajorIdx := len(t.MajorTimeValues) - 1
+	t.MajorTimeValues[lastMajorIdx].MinorTimeKeys = append(t.MajorTimeValues[lastMajorIdx].MinorTimeKeys, sub)
+	t.MajorTimeValues[lastMajorIdx].MinorTimeValues = append(t.MajorTimeValues[lastMajorIdx].MinorTimeValues, &MinorTime{
+		start:    start,
+		Duration: time.Since(start),
+	})
+}
+
 func (t *Timing) Export() map[string]any {
 	return map[string]any{
 		"majorTimeKeys":   t.MajorTimeKeys,
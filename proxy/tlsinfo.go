@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net"
+)
+
+// TLSInfo is what was negotiated in a TLS handshake: with the client (Request.ClientTLS) or with the host
+// (Request.UpstreamTLS).
+type TLSInfo struct {
+	Version     string `json:"version"`     // e.g. TLS 1.3
+	CipherSuite string `json:"cipherSuite"` // e.g. TLS_AES_128_GCM_SHA256
+	ALPN        string `json:"alpn"`        // the negotiated protocol (h2 or http/1.1), if any
+	ServerName  string `json:"serverName"`  // the server name indication, as sent by the client (or the proxy)
+	Resumed     bool   `json:"resumed"`     // whether a previous session was resumed
+	// Chain is the certificate chain the host presented, leaf first. The client presents none.
+	Chain []TLSCertificate `json:"chain,omitempty"`
+}
+
+// TLSCertificate describes a certificate of a chain.
+type TLSCertificate struct {
+	Subject      string   `json:"subject"`
+	Issuer       string   `json:"issuer"`
+	SerialNumber string   `json:"serialNumber"` // hex
+	NotBefore    int64    `json:"notBefore"`    // unix milli
+	NotAfter     int64    `json:"notAfter"`     // unix milli
+	DNSNames     []string `json:"dnsNames,omitempty"`
+	IPAddresses  []string `json:"ipAddresses,omitempty"`
+	Fingerprint  string   `json:"fingerprint"` // sha-256, hex
+	PEM          string   `json:"pem"`
+}
+
+// newTLSInfo returns what was negotiated in the TLS handshake of a connection in state.
+func newTLSInfo(state tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+		ServerName:  state.ServerName,
+		Resumed:     state.DidResume,
+	}
+	for _, cert := range state.PeerCertificates {
+		info.Chain = append(info.Chain, newTLSCertificate(cert))
+	}
+	return info
+}
+
+func newTLSCertificate(cert *x509.Certificate) TLSCertificate {
+	fingerprint := sha256.Sum256(cert.Raw)
+	c := TLSCertificate{
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		SerialNumber: cert.SerialNumber.Text(16),
+		NotBefore:    cert.NotBefore.UnixMilli(),
+		NotAfter:     cert.NotAfter.UnixMilli(),
+		DNSNames:     cert.DNSNames,
+		Fingerprint:  hex.EncodeToString(fingerprint[:]),
+		PEM:          string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+	}
+	for _, ip := range cert.IPAddresses {
+		c.IPAddresses = append(c.IPAddresses, ip.String())
+	}
+	return c
+}
+
+// connTLSInfo returns what was negotiated in the TLS handshake of conn, or nil if it is not a TLS connection.
+func connTLSInfo(conn net.Conn) *TLSInfo {
+	tlsconn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	return newTLSInfo(tlsconn.ConnectionState())
+}
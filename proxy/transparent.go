@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/tiredkangaroo/cap/proxy/config"
+)
+
+var (
+	// ErrTransparentUnsupported is returned when the transparent listener is started on a platform that cannot
+	// recover the original destination of redirected connections.
+	ErrTransparentUnsupported = errors.New("transparent proxying is only supported on linux")
+	// ErrNotRedirected is the error of a connection made to the transparent listener directly instead of being
+	// redirected to it, which would otherwise be tunneled back to the listener itself.
+	ErrNotRedirected = errors.New("connection was not redirected to the transparent listener")
+)
+
+// serveTransparent serves a connection redirected to the transparent listener by iptables (REDIRECT in the
+// nat table, or TPROXY in the mangle table) for a client that ignores proxy settings. The original destination
+// of the connection is recovered and the stream is served like one tunneled through the SOCKS listener.
+//
+// The traffic of the proxy itself must not be redirected, or it loops back into the listener (e.g. by
+// excluding its user with -m owner ! --uid-owner).
+func (c *ProxyHandler) serveTransparent(rawconn net.Conn) {
+	defer rawconn.Close()
+
+	host, err := originalDestination(rawconn, int(config.DefaultConfig.TransparentPort))
+	if err != nil {
+		slog.Error("transparent connection", "err", err.Error(), "client", rawconn.RemoteAddr().String())
+		return
+	}
+	c.serveStream(rawconn, &streamTarget{host: host, inbound: InboundTransparent})
+}
+
+// localDestination returns the destination of a connection redirected with TPROXY, which is its local
+// address, unless it was made to the listener (on listenerPort) directly.
+func localDestination(conn net.Conn, listenerPort int) (string, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok || local.Port == listenerPort {
+		return "", fmt.Errorf("%w (local address %s)", ErrNotRedirected, conn.LocalAddr())
+	}
+	return local.String(), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST (and IP6T_SO_ORIGINAL_DST), from linux/netfilter_ipv4.h.
+const soOriginalDst = 80
+
+// listenTransparent listens on addr with IP_TRANSPARENT set if possible, so connections redirected with TPROXY
+// (whose destination is not a local address) can be accepted. It requires CAP_NET_ADMIN: without it, only
+// connections redirected with REDIRECT are.
+func listenTransparent(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, rc syscall.RawConn) error {
+			var serr error
+			if err := rc.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			}); err != nil {
+				return err
+			}
+			if serr != nil {
+				slog.Warn("transparent listener cannot accept TPROXY connections (IP_TRANSPARENT)", "err", serr.Error())
+			}
+			return nil
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDestination returns the destination (host:port) the client connected to before its connection was
+// redirected to the listener on listenerPort.
+func originalDestination(conn net.Conn, listenerPort int) (string, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("original destination: not a tcp connection")
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return "", fmt.Errorf("original destination: %w", err)
+	}
+
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	ipv4 := local != nil && local.IP.To4() != nil
+	var dst *net.TCPAddr
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		if ipv4 {
+			// a sockaddr_in in the space of an ip_mreqn
+			var mreq *syscall.IPv6Mreq
+			if mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); serr == nil {
+				sa := mreq.Multiaddr
+				dst = &net.TCPAddr{IP: net.IP(sa[4:8]), Port: int(binary.BigEndian.Uint16(sa[2:4]))}
+			}
+			return
+		}
+		// a sockaddr_in6 in the space of an ip6_mtuinfo
+		var info *syscall.IPv6MTUInfo
+		if info, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); serr == nil {
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port) // in network byte order
+			dst = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(binary.BigEndian.Uint16(port[:]))}
+		}
+	}); err != nil {
+		return "", fmt.Errorf("original destination: %w", err)
+	}
+	if serr != nil {
+		// not NATed: redirected with TPROXY, or not redirected at all
+		return localDestination(conn, listenerPort)
+	}
+	if local != nil && dst.IP.Equal(local.IP) && dst.Port == local.Port {
+		return "", fmt.Errorf("%w (local address %s)", ErrNotRedirected, local)
+	}
+	return dst.String(), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+func listenTransparent(addr string) (net.Listener, error) {
+	return nil, ErrTransparentUnsupported
+}
+
+func originalDestination(conn net.Conn, listenerPort int) (string, error) {
+	return "", ErrTransparentUnsupported
+}
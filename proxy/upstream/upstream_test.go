@@ -0,0 +1,56 @@
+package upstream
+
+import "testing"
+
+func TestBypasses(t *testing.T) {
+	tests := []struct {
+		entry, host string
+		want        bool
+	}{
+		{"<local>", "intranet:80", true},
+		{"<local>", "intranet", true},
+		{"<local>", "example.com:443", false},
+		{"<local>", "10.0.0.1:80", false}, // an IP address is not a local hostname
+		{"10.0.0.0/8", "10.1.2.3:443", true},
+		{"10.0.0.0/8", "11.1.2.3:443", false},
+		{"10.0.0.0/8", "example.com:443", false},
+		{"fd00::/8", "[fd00::1]:443", true},
+		{"127.0.0.1", "127.0.0.1:8080", true},
+		{"127.0.0.1", "127.0.0.2:8080", false},
+		{"::1", "[::1]:443", true},
+		{"*.corp", "git.corp:22", true},
+		{"*.corp", "example.com:443", false},
+		{"example.com:443", "example.com:80", false},
+	}
+	for _, tt := range tests {
+		if got := bypasses(tt.entry, tt.host); got != tt.want {
+			t.Errorf("bypasses(%q, %q) = %v, want %v", tt.entry, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestAppliesTo(t *testing.T) {
+	p := Proxy{
+		URL:    "http://proxy.corp:3128",
+		Hosts:  []string{"*.example.com"},
+		Bypass: []string{"internal.example.com"},
+	}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"api.example.com:443", true},
+		{"internal.example.com:443", false},
+		{"example.org:443", false},
+	}
+	for _, tt := range tests {
+		if got := p.AppliesTo(tt.host); got != tt.want {
+			t.Errorf("AppliesTo(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	p.Disabled = true
+	if p.AppliesTo("api.example.com:443") {
+		t.Error("a disabled proxy applies to a host")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/tiredkangaroo/cap/proxy/config"
+	"github.com/tiredkangaroo/cap/proxy/upstream"
+)
+
+// selectUpstreamProxy picks the upstream proxy traffic to the host (host:port) goes through, if any.
+func (r *Request) selectUpstreamProxy(host string) {
+	r.proxy = upstream.Select(config.Rules(&config.DefaultConfig.UpstreamProxies), host)
+	r.UpstreamProxy = ""
+	if r.proxy != nil {
+		r.UpstreamProxy = r.proxy.Label()
+	}
+}
+
+// forwarded reports whether the request is forwarded to its upstream proxy as it is, rather than sent
+// through a tunnel to the host.
+func (r *Request) forwarded() bool {
+	return r.proxy != nil && !r.UpstreamSecure && r.proxy.Forwards()
+}
+
+// dialTimeout is how long dialing a host (through the upstream proxy, if any) may take.
+const dialTimeout = 30 * time.Second
+
+// dialUpstream returns a connection the request can be sent over: to the host, through a tunnel of the
+// upstream proxy, or to the upstream proxy itself if the request is forwarded to it.
+func (r *Request) dialUpstream() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	switch {
+	case r.proxy == nil:
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", r.UpstreamHost)
+	case r.forwarded():
+		return r.proxy.DialProxy(ctx)
+	default:
+		return r.proxy.Dial(ctx, r.UpstreamHost)
+	}
+}
+
+// dialTunnel returns a connection to the host of a tunnel (see handleNoMITM), through the upstream proxy if
+// there is one.
+func (r *Request) dialTunnel() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	if r.proxy == nil {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", r.hostAddr())
+	}
+	return r.proxy.Dial(ctx, r.hostAddr())
+}
+
+// dialMirror dials a host whose certificate is mirrored (see certificate.Dialer), through the upstream proxy
+// traffic to it goes through, if any.
+func dialMirror(host string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if p := upstream.Select(config.Rules(&config.DefaultConfig.UpstreamProxies), host); p != nil {
+		return p.Dial(ctx, host)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", host)
+}
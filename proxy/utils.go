@@ -2,16 +2,21 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/url"
+	"os"
 	"os/exec"
 	"runtime"
 	"strconv"
 	"strings"
 
+	"github.com/google/uuid"
 	"github.com/tiredkangaroo/cap/proxy/config"
+	"github.com/tiredkangaroo/cap/proxy/http"
 )
 
 // toURL converts a string to a URL. If the string does not start with "http://" or
@@ -116,3 +121,32 @@ func handleRealIPHeader(r *Request) {
 		}
 	}
 }
+
+// newID returns a new random UUID string.
+func newID() string {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		slog.Error("uuid error", "err", err.Error())
+		return "75756964-7634-6765-6e65-72726f720000" // this isn't a random UUID
+	}
+	return id.String()
+}
+
+// isConnClosed reports whether err means the peer closed the connection (or it timed out) rather than
+// something going wrong on it.
+func isConnClosed(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isIdempotent reports whether a request with method can safely be sent again if its connection fails.
+func isIdempotent(method http.Method) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
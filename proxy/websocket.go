@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/cap/proxy/http"
+	"github.com/tiredkangaroo/cap/proxy/timing"
+	"github.com/tiredkangaroo/cap/proxy/wsframe"
+)
+
+const (
+	DirectionClientToServer = "client-to-server"
+	DirectionServerToClient = "server-to-client"
+)
+
+// maxRecordedFramePayload is the most of a frame's payload that is recorded. The whole frame is always
+// forwarded.
+const maxRecordedFramePayload = 1 << 20
+
+// WebSocketFrame is a frame sent over an upgraded WebSocket connection, as recorded.
+type WebSocketFrame struct {
+	RequestID string
+	Direction string // DirectionClientToServer or DirectionServerToClient
+	Opcode    wsframe.Opcode
+	Fin       bool
+	// Compressed is whether the frame is compressed (permessage-deflate), in which case Payload is too.
+	Compressed bool
+	Payload    []byte // unmasked, at most maxRecordedFramePayload bytes
+	Length     int64
+	Truncated  bool
+	Datetime   time.Time
+}
+
+func (f *WebSocketFrame) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"id":         f.RequestID,
+		"direction":  f.Direction,
+		"opcode":     f.Opcode,
+		"opcodeName": f.Opcode.String(),
+		"fin":        f.Fin,
+		"compressed": f.Compressed,
+		"payload":    f.Payload, // base64
+		"length":     f.Length,
+		"truncated":  f.Truncated,
+		"datetime":   f.Datetime.UnixMilli(), // unix milli for js
+	})
+}
+
+// isWebSocketUpgrade reports whether req asks to upgrade the connection to WebSocket.
+func isWebSocketUpgrade(req *http.Request) bool {
+	return req.Header.HasToken("Connection", "upgrade") && req.Header.HasToken("Upgrade", "websocket")
+}
+
+// prepareUpgrade prepares an upgrade request to be sent to the host. WebSocket extensions are not
+// negotiated, so frames are sent uncompressed and can be recorded as they are.
+func (r *Request) prepareUpgrade() {
+	if isWebSocketUpgrade(r.req) {
+		r.req.Header.Del("Sec-WebSocket-Extensions")
+	}
+}
+
+// wantsUpgrade reports whether the request asks the host to switch protocols (e.g. to WebSocket).
+func (r *Request) wantsUpgrade() bool {
+	return r.req.Header.HasToken("Connection", "upgrade")
+}
+
+// upgraded reports whether the host switched the client connection to another protocol, which means
+// the connection must be handed over to serveUpgraded.
+func (r *Request) upgraded() bool {
+	return r.client != nil && r.hostconn != nil && r.resp.StatusCode == http.StatusSwitchingProtocols
+}
+
+// serveUpgraded splices the client and the host together after a 101 Switching Protocols response, until
+// either side closes its connection. If the connection was upgraded to WebSocket, every frame sent either
+// way is recorded and sent to live websocket connections.
+func (r *Request) serveUpgraded(m *Manager) error {
+	r.timing.Start(timing.TimeWebSocket)
+	defer r.timing.Stop()
+
+	record := isWebSocketUpgrade(r.req)
+	if record {
+		m.SendWebSocketOpen(r)
+	}
+
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			r.client.conn.Close()
+			r.hostconn.Close()
+		})
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	splice := func(i int, src io.Reader, dst net.Conn, direction string) {
+		defer wg.Done()
+		defer closeBoth() // the other direction is over once either side is gone
+		if record {
+			errs[i] = r.relayFrames(m, src, dst, direction)
+		} else {
+			_, errs[i] = io.Copy(dst, src)
+		}
+	}
+	wg.Add(2)
+	// the buffered readers may hold bytes the other side sent right after the upgrade
+	go splice(0, r.client.buf, r.hostconn, DirectionClientToServer)
+	go splice(1, r.hostconn.Buf, r.client.conn, DirectionServerToClient)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil && !isConnClosed(err) && !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+// relayFrames forwards everything read from src to dst and records every frame read on the way. The bytes
+// are forwarded as read, so the frames reach dst unchanged (masking included). If src stops making sense
+// as frames, it is forwarded without being recorded.
+func (r *Request) relayFrames(m *Manager, src io.Reader, dst io.Writer, direction string) error {
+	br := bufio.NewReader(io.TeeReader(src, dst))
+	for {
+		f, err := wsframe.ReadFrame(br, maxRecordedFramePayload)
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, wsframe.ErrFrameTooLarge) || errors.Is(err, wsframe.ErrControlTooLarge) {
+			slog.Warn("invalid websocket frame, no longer recording", "id", r.ID, "direction", direction, "err", err.Error())
+			if _, err := br.WriteTo(io.Discard); err != nil { // reading still forwards (through the tee)
+				return err
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		frame := &WebSocketFrame{
+			RequestID:  r.ID,
+			Direction:  direction,
+			Opcode:     f.Opcode,
+			Fin:        f.Fin,
+			Compressed: f.RSV&0x4 != 0,
+			Payload:    f.Payload,
+			Length:     f.Length,
+			Truncated:  f.Truncated,
+			Datetime:   time.Now(),
+		}
+		m.SendWebSocketFrame(frame)
+		if err := m.db.SaveWebSocketFrame(frame); err != nil {
+			slog.Error("save websocket frame", "id", r.ID, "err", err.Error())
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Package wsframe reads WebSocket frames (RFC 6455) off a connection the proxy is splicing, so they can be
+// recorded. It never writes frames: the proxy forwards the raw bytes as they were read.
+package wsframe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrFrameTooLarge   = errors.New("websocket frame length is invalid")
+	ErrControlTooLarge = errors.New("websocket control frame payload is larger than 125 bytes")
+)
+
+type Opcode uint8
+
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xA
+)
+
+func (o Opcode) String() string {
+	switch o {
+	case OpContinuation:
+		return "continuation"
+	case OpText:
+		return "text"
+	case OpBinary:
+		return "binary"
+	case OpClose:
+		return "close"
+	case OpPing:
+		return "ping"
+	case OpPong:
+		return "pong"
+	default:
+		return fmt.Sprintf("unknown (%d)", uint8(o))
+	}
+}
+
+// IsControl reports whether o is the opcode of a control frame (close, ping, pong).
+func (o Opcode) IsControl() bool {
+	return o&0x8 != 0
+}
+
+// Frame is a single WebSocket frame. Payload is always unmasked.
+type Frame struct {
+	Fin    bool
+	RSV    uint8 // RSV1-3 bits, RSV1 is set on compressed (permessage-deflate) frames
+	Opcode Opcode
+	Masked bool
+
+	// Length is the length of the payload as sent. Payload holds at most the max passed to ReadFrame, and
+	// Truncated is whether the rest was discarded.
+	Length    int64
+	Payload   []byte
+	Truncated bool
+}
+
+// ReadFrame reads the next frame from r. At most max bytes of the payload are kept in the frame, the rest
+// is read and discarded. It returns io.EOF if r ends cleanly before a frame starts.
+func ReadFrame(r io.Reader, max int64) (*Frame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	f := &Frame{
+		Fin:    header[0]&0x80 != 0,
+		RSV:    (header[0] >> 4) & 0x7,
+		Opcode: Opcode(header[0] & 0x0F),
+		Masked: header[1]&0x80 != 0,
+		Length: int64(header[1] & 0x7F),
+	}
+
+	switch f.Length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, unexpected(err)
+		}
+		f.Length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, unexpected(err)
+		}
+		l := binary.BigEndian.Uint64(ext[:])
+		if l>>63 != 0 { // the most significant bit must be 0
+			return nil, ErrFrameTooLarge
+		}
+		f.Length = int64(l)
+	}
+	if f.Opcode.IsControl() && f.Length > 125 {
+		return nil, ErrControlTooLarge
+	}
+
+	var mask [4]byte
+	if f.Masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return nil, unexpected(err)
+		}
+	}
+
+	kept := min(f.Length, max)
+	f.Payload = make([]byte, kept)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return nil, unexpected(err)
+	}
+	if f.Length > kept {
+		if _, err := io.CopyN(io.Discard, r, f.Length-kept); err != nil {
+			return nil, unexpected(err)
+		}
+		f.Truncated = true
+	}
+	if f.Masked {
+		for i := range f.Payload {
+			f.Payload[i] ^= mask[i%4]
+		}
+	}
+	return f, nil
+}
+
+// unexpected turns an io.EOF in the middle of a frame into io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}